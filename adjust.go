@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/pdfcpu/pdfcpu/pkg/api"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/model"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/types"
+)
+
+// 取引先の請求書などページの端まで内容があるPDFを、手作業で編集せずに印刷できるよう、
+// 送信する前にページの回転、切り抜き、余白の調整をPDF自体に反映します。
+
+// pageEdges は上、右、下、左の順の長さ (mm) です。
+type pageEdges [4]float64
+
+// pageAdjustment はページの回転、切り抜き、余白の指定です。
+type pageAdjustment struct {
+	Rotate      int       // rotate: 時計回りの回転角度 (0 (省略時), 90, 180, 270)
+	RotatePages string    // rotate_pages: 回転するページ ("1-3" の形式、省略時はすべてのページ)
+	Crop        pageEdges // crop: 各辺から切り取る長さ (mm)
+	Margin      pageEdges // page_margin: 内容を縮小して空ける余白 (mm)。負の値は内容を拡大して余白を詰めます
+}
+
+// parsePageAdjustment は rotate, crop, page_margin のオプションを解析します。いずれも指定されていない場合は ok が false です。
+func parsePageAdjustment(options map[string]string) (a pageAdjustment, ok bool, err error) {
+	if v, ok := options["rotate"]; ok {
+		n, err := strconv.Atoi(v)
+		if err != nil || n%90 != 0 || n <= -360 || n >= 360 {
+			return a, false, fmt.Errorf("rotate '%s' は 90, 180, 270 のいずれか (時計回りの角度) で指定してください", v)
+		}
+		a.Rotate = (n + 360) % 360
+	}
+	if v, ok := options["rotate_pages"]; ok {
+		ranges, err := parsePageRanges(v, 0)
+		if err != nil {
+			return a, false, fmt.Errorf("rotate_pages: %w", err)
+		}
+		a.RotatePages = formatPageRanges(ranges)
+	}
+	if v, ok := options["crop"]; ok {
+		if a.Crop, err = parsePageEdges("crop", v, 0, 200); err != nil {
+			return a, false, err
+		}
+	}
+	if v, ok := options["page_margin"]; ok {
+		if a.Margin, err = parsePageEdges("page_margin", v, -50, 50); err != nil {
+			return a, false, err
+		}
+	}
+	return a, a.Rotate != 0 || a.Crop != (pageEdges{}) || a.Margin != (pageEdges{}), nil
+}
+
+// checkPages は rotate_pages のページ範囲が pageCount ページの中にあるかを確認します。
+func (a pageAdjustment) checkPages(pageCount int) error {
+	if a.RotatePages == "" {
+		return nil
+	}
+	if _, err := parsePageRanges(a.RotatePages, pageCount); err != nil {
+		return fmt.Errorf("rotate_pages: %w", err)
+	}
+	return nil
+}
+
+// parsePageEdges は "10"、"10 20"、"10 20 10"、"10 20 10 20" の形式 (CSSの margin と同じく上、右、下、左の順) の長さ (mm) を解析します。
+func parsePageEdges(name, value string, min, max float64) (pageEdges, error) {
+	fields := strings.FieldsFunc(value, func(r rune) bool { return r == ' ' || r == ',' })
+	values := make([]float64, len(fields))
+	for i, s := range fields {
+		f, err := strconv.ParseFloat(strings.TrimSuffix(strings.ToLower(s), "mm"), 64)
+		if err != nil || f < min || f > max {
+			return pageEdges{}, fmt.Errorf("%s '%s' は%gから%gまでの長さ (mm) を1〜4個 (上 右 下 左) で指定してください", name, value, min, max)
+		}
+		values[i] = f
+	}
+	switch len(values) {
+	case 1:
+		return pageEdges{values[0], values[0], values[0], values[0]}, nil
+	case 2:
+		return pageEdges{values[0], values[1], values[0], values[1]}, nil
+	case 3:
+		return pageEdges{values[0], values[1], values[2], values[1]}, nil
+	case 4:
+		return pageEdges{values[0], values[1], values[2], values[3]}, nil
+	}
+	return pageEdges{}, fmt.Errorf("%s '%s' は%gから%gまでの長さ (mm) を1〜4個 (上 右 下 左) で指定してください", name, value, min, max)
+}
+
+// unrotated は表示上の上、右、下、左の長さを、/Rotate (時計回り) で回転する前のページの辺の長さに置き換えて、ポイントで返します。
+func (e pageEdges) unrotated(rotate int) pageEdges {
+	k := ((rotate/90)%4 + 4) % 4
+	var u pageEdges
+	for i := range u {
+		u[i] = e[(i+k)%4] * pointsPerMM
+	}
+	return u
+}
+
+// applyPageAdjustment は回転、切り抜き、余白を反映した新しいPDFを作成し、そのパスを返します。いずれも指定されていない場合は元のパスを返します。
+// 面付けや拡大縮小より前に、元のページに対して使用します。
+func applyPageAdjustment(documentPath string, options map[string]string) (string, error) {
+	a, ok, err := parsePageAdjustment(options)
+	if err != nil || !ok {
+		return documentPath, err
+	}
+	dst := derivedPath(documentPath, "adjusted")
+	if err := writeAdjustedPages(documentPath, dst, a); err != nil {
+		return "", err
+	}
+	return dst, nil
+}
+
+// writeAdjustedPages は各ページに回転、切り抜き、余白を反映した新しいPDFを作成します。
+func writeAdjustedPages(src, dst string, a pageAdjustment) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("ドキュメントを開けませんでした: %w", err)
+	}
+	defer f.Close()
+
+	conf := pdfConfig()
+	conf.Cmd = model.CROP
+	ctx, err := api.ReadValidateAndOptimize(f, conf)
+	if err != nil {
+		return fmt.Errorf("PDFの解析に失敗しました: %w", err)
+	}
+
+	// rotate_pages がページ数を超えていないことは、受け付けるときに checkPages で確認しています。
+	rotated := map[int]bool{}
+	if a.RotatePages != "" {
+		ranges, err := parsePageRanges(a.RotatePages, 0)
+		if err != nil {
+			return err
+		}
+		for _, r := range ranges {
+			for p := r.From; p <= r.To; p++ {
+				rotated[p] = true
+			}
+		}
+	}
+	for pageNr := 1; pageNr <= ctx.PageCount; pageNr++ {
+		rotate := 0
+		if a.RotatePages == "" || rotated[pageNr] {
+			rotate = a.Rotate
+		}
+		if err := adjustPage(ctx, pageNr, rotate, a); err != nil {
+			return fmt.Errorf("%dページ目の調整に失敗しました: %w", pageNr, err)
+		}
+	}
+	ctx.EnsureVersionForWriting()
+
+	if err := api.WriteContextFile(ctx, dst); err != nil {
+		return fmt.Errorf("調整したPDFの保存に失敗しました: %w", err)
+	}
+	return nil
+}
+
+// adjustPage は1ページを回転し、切り抜いた範囲をページの大きさにして、余白の内側に収まるようコンテンツを拡大縮小します。
+// 切り抜きと余白は回転した後の表示上の向きで指定された辺に反映します。
+func adjustPage(ctx *model.Context, pageNr int, rotate int, a pageAdjustment) error {
+	d, _, inh, err := ctx.PageDict(pageNr, false)
+	if err != nil {
+		return err
+	}
+	// /Rotate は親のページツリーから継承されている場合もあるため、ページに設定し直します。
+	pageRotate := ((inh.Rotate+rotate)%360 + 360) % 360
+	d.Update("Rotate", types.Integer(pageRotate))
+
+	box := inh.MediaBox
+	if inh.CropBox != nil {
+		box = inh.CropBox
+	}
+	crop := a.Crop.unrotated(pageRotate)
+	llx, lly := box.LL.X+crop[3], box.LL.Y+crop[2]
+	urx, ury := box.UR.X-crop[1], box.UR.Y-crop[0]
+	if urx-llx < 1 || ury-lly < 1 {
+		return fmt.Errorf("crop で切り取る範囲がページより大きくなっています")
+	}
+	page := types.NewRectangle(llx, lly, urx, ury)
+	d.Update("MediaBox", page.Array())
+	for _, key := range []string{"CropBox", "BleedBox", "TrimBox", "ArtBox"} {
+		d.Delete(key)
+	}
+	if a.Margin == (pageEdges{}) {
+		return nil
+	}
+
+	// 余白の内側の範囲に、縦横の比率を保ったままコンテンツを中央に配置します。
+	margin := a.Margin.unrotated(pageRotate)
+	aw := page.Width() - margin[1] - margin[3]
+	ah := page.Height() - margin[0] - margin[2]
+	if aw < 1 || ah < 1 {
+		return fmt.Errorf("page_margin の余白がページより大きくなっています")
+	}
+	scale := math.Min(aw/page.Width(), ah/page.Height())
+	tx := llx + margin[3] + (aw-scale*page.Width())/2 - scale*llx
+	ty := lly + margin[2] + (ah-scale*page.Height())/2 - scale*lly
+
+	var content bytes.Buffer
+	fmt.Fprintf(&content, "q %.5f 0 0 %.5f %.5f %.5f cm ", scale, scale, tx, ty)
+	bb, err := ctx.PageContent(d, pageNr)
+	if err != nil && err != model.ErrNoContent {
+		return err
+	}
+	content.Write(bb)
+	content.WriteString(" Q")
+
+	sd, err := ctx.NewStreamDictForBuf(content.Bytes())
+	if err != nil {
+		return err
+	}
+	if err := sd.Encode(); err != nil {
+		return err
+	}
+	ir, err := ctx.IndRefForNewObject(*sd)
+	if err != nil {
+		return err
+	}
+	d["Contents"] = *ir
+	return nil
+}
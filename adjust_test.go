@@ -0,0 +1,173 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParsePageEdges(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    pageEdges
+		wantErr bool
+	}{
+		{"10", pageEdges{10, 10, 10, 10}, false},
+		{"10 20", pageEdges{10, 20, 10, 20}, false},
+		{"10 20 30", pageEdges{10, 20, 30, 20}, false},
+		{"10 20 30 40", pageEdges{10, 20, 30, 40}, false},
+		{"10mm,20MM", pageEdges{10, 20, 10, 20}, false},
+		{"0 0 12.5", pageEdges{0, 0, 12.5, 0}, false},
+		{"", pageEdges{}, true},
+		{"1 2 3 4 5", pageEdges{}, true},
+		{"-1", pageEdges{}, true},
+		{"201", pageEdges{}, true},
+		{"10 abc", pageEdges{}, true},
+	}
+	for _, tt := range tests {
+		got, err := parsePageEdges("crop", tt.value, 0, 200)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parsePageEdges(%q) error = %v; want error %t", tt.value, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parsePageEdges(%q) = %v; want %v", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestParsePageAdjustment(t *testing.T) {
+	tests := []struct {
+		name    string
+		options map[string]string
+		want    pageAdjustment
+		ok      bool
+		wantErr bool
+	}{
+		{"指定なし", map[string]string{"copies": "2"}, pageAdjustment{}, false, false},
+		{"回転", map[string]string{"rotate": "90"}, pageAdjustment{Rotate: 90}, true, false},
+		{"反時計回りの回転", map[string]string{"rotate": "-90"}, pageAdjustment{Rotate: 270}, true, false},
+		{"0度の回転", map[string]string{"rotate": "0"}, pageAdjustment{}, false, false},
+		{"ページを指定した回転", map[string]string{"rotate": "180", "rotate_pages": "3, 1-2"}, pageAdjustment{Rotate: 180, RotatePages: "3,1-2"}, true, false},
+		{"回転なしのページ指定", map[string]string{"rotate_pages": "1"}, pageAdjustment{RotatePages: "1"}, false, false},
+		{"切り抜きと余白", map[string]string{"crop": "5 10", "page_margin": "-3"}, pageAdjustment{Crop: pageEdges{5, 10, 5, 10}, Margin: pageEdges{-3, -3, -3, -3}}, true, false},
+		{"90の倍数でない回転", map[string]string{"rotate": "45"}, pageAdjustment{}, false, true},
+		{"360度の回転", map[string]string{"rotate": "360"}, pageAdjustment{}, false, true},
+		{"終わりのないページ範囲", map[string]string{"rotate": "90", "rotate_pages": "2-"}, pageAdjustment{}, false, true},
+		{"余白が範囲外", map[string]string{"page_margin": "51"}, pageAdjustment{}, false, true},
+		{"切り抜きが負", map[string]string{"crop": "-1"}, pageAdjustment{}, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, ok, err := parsePageAdjustment(tt.options)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("parsePageAdjustment(%v) = %+v; want error", tt.options, a)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parsePageAdjustment(%v): %v", tt.options, err)
+			}
+			if a != tt.want || ok != tt.ok {
+				t.Errorf("parsePageAdjustment(%v) = %+v, %t; want %+v, %t", tt.options, a, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func TestPageAdjustmentCheckPages(t *testing.T) {
+	tests := []struct {
+		pages     string
+		pageCount int
+		wantErr   bool
+	}{
+		{"", 1, false},
+		{"1-3", 3, false},
+		{"1-3", 2, true},
+		{"4", 3, true},
+	}
+	for _, tt := range tests {
+		a := pageAdjustment{Rotate: 90, RotatePages: tt.pages}
+		if err := a.checkPages(tt.pageCount); (err != nil) != tt.wantErr {
+			t.Errorf("checkPages(%q, %d) = %v; want error %t", tt.pages, tt.pageCount, err, tt.wantErr)
+		}
+	}
+}
+
+func TestPageEdgesUnrotated(t *testing.T) {
+	e := pageEdges{1, 2, 3, 4}
+	for _, tt := range []struct {
+		rotate int
+		want   pageEdges
+	}{
+		{0, pageEdges{1, 2, 3, 4}},
+		{90, pageEdges{2, 3, 4, 1}},
+		{180, pageEdges{3, 4, 1, 2}},
+		{270, pageEdges{4, 1, 2, 3}},
+		{-90, pageEdges{4, 1, 2, 3}},
+	} {
+		got := e.unrotated(tt.rotate)
+		for i := range got {
+			got[i] /= pointsPerMM
+		}
+		for i := range got {
+			if d := got[i] - tt.want[i]; d > 1e-9 || d < -1e-9 {
+				t.Errorf("unrotated(%d) = %v mm; want %v", tt.rotate, got, tt.want)
+				break
+			}
+		}
+	}
+}
+
+func TestApplyPageAdjustment(t *testing.T) {
+	t.Run("指定なし", func(t *testing.T) {
+		src := writeTestPDF(t, "plain.pdf", 2)
+		got, err := applyPageAdjustment(src, map[string]string{"rotate": "0"})
+		if err != nil || got != src {
+			t.Errorf("applyPageAdjustment() = %q, %v; want %q", got, err, src)
+		}
+	})
+
+	for _, tt := range []struct {
+		name    string
+		options map[string]string
+		want    [][2]int // 調整した後のページごとの表示上の幅と高さ (ポイント)
+		margin  bool     // コンテンツが余白の内側に縮小されているかどうか
+	}{
+		{"すべてのページの回転", map[string]string{"rotate": "90"}, [][2]int{{842, 595}, {842, 595}, {842, 595}}, false},
+		{"ページを指定した回転", map[string]string{"rotate": "-90", "rotate_pages": "2"}, [][2]int{{595, 842}, {842, 595}, {595, 842}}, false},
+		{"切り抜き", map[string]string{"crop": "10"}, [][2]int{{538, 785}, {538, 785}, {538, 785}}, false},
+		{"回転した後の辺の切り抜き", map[string]string{"rotate": "90", "crop": "0 20 0 0"}, [][2]int{{785, 595}, {785, 595}, {785, 595}}, false},
+		{"余白", map[string]string{"page_margin": "10"}, [][2]int{{595, 842}, {595, 842}, {595, 842}}, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			src := writeTestPDF(t, "invoice.pdf", 3)
+			dst, err := applyPageAdjustment(src, tt.options)
+			if err != nil {
+				t.Fatalf("applyPageAdjustment: %v", err)
+			}
+			ctx := readTestPDF(t, dst)
+			if got := testPageSizes(t, ctx); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("page sizes = %v; want %v", got, tt.want)
+			}
+			for pageNr := 1; pageNr <= ctx.PageCount; pageNr++ {
+				content := testPageContent(t, ctx, pageNr)
+				// ページの順序は変わらず、i ページ目には i 個の四角形が残っています。
+				if got := strings.Count(content, "re f"); got != pageNr {
+					t.Errorf("%dページ目の四角形 = %d; want %d", pageNr, got, pageNr)
+				}
+				if scaled := strings.HasPrefix(content, "q ") && strings.Contains(content, " cm "); scaled != tt.margin {
+					t.Errorf("%dページ目の余白の反映 = %t; want %t: %q", pageNr, scaled, tt.margin, content)
+				}
+			}
+		})
+	}
+
+	t.Run("ページより大きな切り抜き", func(t *testing.T) {
+		src := writeTestPDF(t, "invoice.pdf", 1)
+		if _, err := applyPageAdjustment(src, map[string]string{"crop": "0 200 0 200"}); err == nil {
+			t.Error("applyPageAdjustment() = nil; want error")
+		}
+	})
+}
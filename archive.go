@@ -0,0 +1,69 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"fmt"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// zipMagic はZIPファイルの先頭のシグネチャです。
+var zipMagic = []byte("PK\x03\x04")
+
+// zipContentTypes はZIPアーカイブとして展開する Content-Type です。
+var zipContentTypes = map[string]bool{
+	"application/zip":              true,
+	"application/x-zip-compressed": true,
+	"application/x-zip":            true,
+}
+
+// isZipArchive はドキュメントを展開するZIPアーカイブとして扱うかどうかを、拡張子 (.zip) または Content-Type で判定します。
+// Word (.docx) や Excel (.xlsx) などのファイルもZIP形式のため、ファイルの内容では判定しません。
+func isZipArchive(name, contentType string) bool {
+	if strings.EqualFold(path.Ext(name), ".zip") {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && zipContentTypes[strings.ToLower(mediaType)]
+}
+
+// expandZipArchive はZIPアーカイブのファイルをアーカイブ内の順番どおりにスプールディレクトリへ展開し、sub に追加します。
+// ディレクトリ、隠しファイル、macOSのリソースフォーク (__MACOSX) は無視します。
+// 展開後の合計サイズにもアップロードの最大サイズを適用します。
+func expandZipArchive(archivePath string, sub *printSubmission) error {
+	r, err := zip.OpenReader(archivePath)
+	if err != nil {
+		return &submissionError{Status: http.StatusUnprocessableEntity, Err: fmt.Errorf("ZIPアーカイブを開けませんでした: %w", err)}
+	}
+	defer r.Close()
+
+	remaining := uploadMaxSize(appConfig.Uploads)
+	for _, f := range r.File {
+		name := path.Base(f.Name)
+		if f.FileInfo().IsDir() || strings.HasPrefix(f.Name, "__MACOSX/") || strings.HasPrefix(name, ".") {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return &submissionError{Status: http.StatusUnprocessableEntity, Err: fmt.Errorf("ZIPアーカイブの '%s' を展開できませんでした: %w", f.Name, err)}
+		}
+		// 拡張子を変えたZIPアーカイブも、先頭のシグネチャで判定して拒否します。
+		br := bufio.NewReader(rc)
+		if head, _ := br.Peek(len(zipMagic)); strings.EqualFold(path.Ext(name), ".zip") || bytes.Equal(head, zipMagic) {
+			rc.Close()
+			return badRequest("ZIPアーカイブ内のZIPアーカイブ '%s' はサポートされていません", f.Name)
+		}
+		counter := &sizeLimitReader{r: br, max: remaining}
+		err = sub.addDocument(name, "", counter)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+		remaining -= counter.n
+	}
+	return nil
+}
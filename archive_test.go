@@ -0,0 +1,125 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestIsZipArchive(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		want        bool
+	}{
+		{"documents.zip", "", true},
+		{"DOCUMENTS.ZIP", "application/octet-stream", true},
+		{"", "application/zip", true},
+		{"upload", "application/x-zip-compressed", true},
+		{"upload", "Application/ZIP; charset=binary", true},
+		{"report.docx", "application/vnd.openxmlformats-officedocument.wordprocessingml.document", false},
+		{"sheet.xlsx", "", false},
+		{"invoice.pdf", "application/pdf", false},
+		{"", "", false},
+	}
+	for _, tt := range tests {
+		if got := isZipArchive(tt.name, tt.contentType); got != tt.want {
+			t.Errorf("isZipArchive(%q, %q) = %t; want %t", tt.name, tt.contentType, got, tt.want)
+		}
+	}
+}
+
+// writeTestZip は entries (名前と内容の組) を順番どおりに格納したZIPアーカイブを作成します。
+func writeTestZip(t *testing.T, entries ...[2]string) string {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, e := range entries {
+		w, err := zw.Create(e[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(e[1])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	p := filepath.Join(t.TempDir(), "archive.zip")
+	if err := os.WriteFile(p, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestExpandZipArchive(t *testing.T) {
+	saved := spoolDirectory
+	spoolDirectory = t.TempDir()
+	t.Cleanup(func() { spoolDirectory = saved })
+
+	t.Run("アーカイブ内の順番", func(t *testing.T) {
+		archive := writeTestZip(t,
+			[2]string{"b.pdf", "%PDF-b"},
+			[2]string{"docs/", ""},
+			[2]string{"docs/a.pdf", "%PDF-a"},
+			[2]string{"__MACOSX/docs/._a.pdf", "resource"},
+			[2]string{".DS_Store", "hidden"},
+		)
+		sub := &printSubmission{}
+		if err := expandZipArchive(archive, sub); err != nil {
+			t.Fatalf("expandZipArchive: %v", err)
+		}
+		defer sub.removeDocuments()
+		var names []string
+		for _, doc := range sub.Documents {
+			names = append(names, doc.Name)
+			data, err := os.ReadFile(doc.Path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := "%PDF-" + doc.Name[:1]; string(data) != want {
+				t.Errorf("%s の内容 = %q; want %q", doc.Name, data, want)
+			}
+		}
+		if want := []string{"b.pdf", "a.pdf"}; !reflect.DeepEqual(names, want) {
+			t.Errorf("names = %v; want %v", names, want)
+		}
+	})
+
+	for _, tt := range []struct {
+		name  string
+		entry [2]string
+	}{
+		{"拡張子が大文字のZIP", [2]string{"inner.ZIP", "PK\x03\x04rest"}},
+		{"拡張子を変えたZIP", [2]string{"inner.pdf", "PK\x03\x04rest"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			archive := writeTestZip(t, [2]string{"a.pdf", "%PDF-a"}, tt.entry)
+			sub := &printSubmission{}
+			err := expandZipArchive(archive, sub)
+			defer sub.removeDocuments()
+			var se *submissionError
+			if !errors.As(err, &se) || se.Status != http.StatusBadRequest {
+				t.Errorf("expandZipArchive() = %v; want 400", err)
+			}
+		})
+	}
+
+	t.Run("ZIPではないファイル", func(t *testing.T) {
+		p := filepath.Join(t.TempDir(), "broken.zip")
+		if err := os.WriteFile(p, []byte("not a zip"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		err := expandZipArchive(p, &printSubmission{})
+		var se *submissionError
+		if !errors.As(err, &se) || se.Status != http.StatusUnprocessableEntity {
+			t.Errorf("expandZipArchive() = %v; want 422", err)
+		}
+	})
+}
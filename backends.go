@@ -0,0 +1,374 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// printTarget はクライアントが指定したプリンター名を解決した結果です。
+type printTarget struct {
+	Name    string            // クライアントが指定した名前 (論理プリンター名など)
+	Backend string            // "spooler", "ipp", "socket"
+	Device  string            // スプーラーのプリンター名、またはプリンターURI
+	Options map[string]string // 論理プリンターに設定されたデフォルトの印刷オプション
+	Timeout time.Duration     // 1回の送信のタイムアウト
+}
+
+// defaultPrintTimeout は送信のタイムアウトが設定されていない場合の値です。
+const defaultPrintTimeout = 5 * time.Minute
+
+// key は負荷や状態を記録するためのデバイスの識別子を返します。
+// Windowsのプリンター名は大文字と小文字を区別しないため、スプーラーのプリンターは小文字にそろえます。
+func (t printTarget) key() string {
+	if t.Backend == "spooler" {
+		return t.Backend + ":" + strings.ToLower(t.Device)
+	}
+	return t.Backend + ":" + t.Device
+}
+
+// printBackend はPDFファイルを実際にプリンターへ送信する関数です。
+type printBackend func(documentPath string, target printTarget) error
+
+// printBackends はバックエンド名と実装の対応表です。
+var printBackends = map[string]printBackend{
+	"spooler": spoolerPrint,
+	"ipp":     ippPrint,
+	"socket":  socketPrint,
+}
+
+// resolvePrinter はクライアントが指定したプリンター名を印刷先に解決します。
+// 論理プリンター、ネットワークプリンターの順に探し、どちらにもなければスプーラーのプリンター名として扱います。
+// プールの解決には resolveCandidates を使用してください。
+func resolvePrinter(cfg *Config, name string) printTarget {
+	if p, ok := cfg.Printers[name]; ok {
+		timeout := defaultPrintTimeout
+		if p.TimeoutSeconds > 0 {
+			timeout = time.Duration(p.TimeoutSeconds) * time.Second
+		}
+		return printTarget{Name: name, Backend: p.Backend, Device: p.Device, Options: p.Options, Timeout: timeout}
+	}
+	for _, p := range cfg.NetworkPrinters {
+		if p.Name == name {
+			return printTarget{Name: name, Backend: networkPrinterBackend(p.URI), Device: p.URI, Timeout: defaultPrintTimeout}
+		}
+	}
+	return printTarget{Name: name, Backend: "spooler", Device: name, Timeout: defaultPrintTimeout}
+}
+
+// networkPrinterBackend はプリンターURIのスキームから使用するバックエンドを決定します。
+func networkPrinterBackend(uri string) string {
+	if strings.HasPrefix(uri, "socket://") {
+		return "socket"
+	}
+	return "ipp"
+}
+
+// dispatchPrint は印刷先のバックエンドを使ってPDFを印刷します。
+// documentPath には transformDocument で加工したPDFを、target.Options には加工後のオプションを渡します。
+func dispatchPrint(documentPath string, target printTarget) error {
+	backend, ok := printBackends[target.Backend]
+	if !ok {
+		return notSent(fmt.Errorf("サポートされていないバックエンドです: %s", target.Backend))
+	}
+	log.Printf("プリンター '%s' を %s バックエンドのデバイス '%s' に解決しました。", target.Name, target.Backend, target.Device)
+	fmt.Printf("Resolved printer '%s' to %s backend device '%s'.\n", target.Name, target.Backend, target.Device)
+	return backend(documentPath, target)
+}
+
+// transformDocument は印刷先のオプションに合わせてPDFを加工し、加工したPDFのパスと送信に使用するオプションを返します。
+// 途中で作成したPDFは削除し、最後に作成したPDFだけを残します。加工しない場合は documentPath をそのまま返します。
+func transformDocument(jobID, documentPath string, target printTarget) (result string, options map[string]string, err error) {
+	path := documentPath
+	var created []string
+	defer func() {
+		for _, p := range created {
+			if p != result {
+				os.Remove(p)
+			}
+		}
+	}()
+	next := func(p string, err error) error {
+		if err == nil && p != path {
+			created = append(created, p)
+			path = p
+		}
+		return err
+	}
+
+	// 回転、切り抜き、余白は元のページに反映します。
+	// 面付けは拡大縮小やスタンプより前に、元のページを並べ替えて1枚の用紙にまとめます。
+	if err := next(applyPageAdjustment(path, target.Options)); err != nil {
+		return "", nil, err
+	}
+	if err := next(applyImposition(path, target.Options)); err != nil {
+		return "", nil, err
+	}
+	options = imposedOptions(target.Options)
+
+	// 拡大縮小はデバイスの用紙サイズに合わせるため、印刷先のオプションごとにPDFへ反映します。
+	opts, err := parsePrintOptions(options, 0)
+	if err != nil {
+		return "", nil, err
+	}
+	if err := next(applyScaling(path, opts)); err != nil {
+		return "", nil, err
+	}
+	// スタンプとバーコードは拡大縮小した後のページに、指定どおりの大きさと位置で重ねます。
+	job, _ := jobs.get(jobID)
+	values := stampValues{JobID: jobID, Printer: job.Printer, Document: job.Document, User: options["user"], Time: time.Now()}
+	if err := next(applyStamp(path, options, values)); err != nil {
+		return "", nil, err
+	}
+	if err := next(applyBarcode(path, options, values)); err != nil {
+		return "", nil, err
+	}
+	return path, options, nil
+}
+
+// spoolerPrint はWindowsのスプーラー経由で PDFtoPrinter を使って印刷します。
+// 部数とページ範囲は PDFtoPrinter の copies= と pages= 引数で渡します。
+// 部単位でない複数部数はドライバーの設定に左右されるため、PDFのページを並べ替えて1部として印刷します。
+// 両面や用紙サイズなどが指定された場合は、ジョブごとに印刷設定を指定できる SumatraPDF で印刷します (spooler.go)。
+func spoolerPrint(documentPath string, target printTarget) error {
+	opts, err := parsePrintOptions(target.Options, 0)
+	if err != nil {
+		return err
+	}
+	if opts.Copies > 1 && !opts.Collate {
+		if documentPath, err = applyPageSequence(documentPath, opts); err != nil {
+			return err
+		}
+		// PDFtoPrinter と SumatraPDF はスプールが終わるまで待つため、並べ替えたPDFは送信後に削除できます。
+		defer os.Remove(documentPath)
+		// ページ範囲と部数は並べ替えたPDFに反映済みです。
+		opts.Copies, opts.Pages = 1, ""
+	}
+
+	if opts.hasDeviceSettings() {
+		settings, err := spoolerPrintSettings(opts)
+		if err != nil {
+			return notSent(err)
+		}
+		return sumatraPrint(documentPath, target.Device, settings, target.Timeout)
+	}
+
+	var args []string
+	if opts.Copies > 1 {
+		args = append(args, fmt.Sprintf("copies=%d", opts.Copies))
+	}
+	if opts.Pages != "" {
+		args = append(args, "pages="+opts.Pages)
+	}
+	return printPDF(documentPath, target.Device, args, target.Timeout)
+}
+
+// ippPrint はIPPのPrint-JobオペレーションでPDFを送信します。
+func ippPrint(documentPath string, target printTarget) error {
+	file, err := os.Open(documentPath)
+	if err != nil {
+		return fmt.Errorf("ドキュメントを開けませんでした: %w", err)
+	}
+	defer file.Close()
+
+	req := newIPPRequest(ippOpPrintJob, target.Device)
+	req.addAttr(ippTagOperation, ippAttr{Name: "requesting-user-name", Tag: ippTagName, Values: []interface{}{"print-pdf-service"}})
+	req.addAttr(ippTagOperation, ippAttr{Name: "job-name", Tag: ippTagName, Values: []interface{}{filepath.Base(documentPath)}})
+	req.addAttr(ippTagOperation, ippAttr{Name: "document-format", Tag: ippTagMimeType, Values: []interface{}{"application/pdf"}})
+	if err := addIPPJobAttributes(req, target.Options); err != nil {
+		return err
+	}
+
+	res, err := sendIPP(target.Device, req, file, target.Timeout)
+	if err != nil {
+		log.Printf("IPP印刷に失敗しました (%s): %v", target.Device, err)
+		return fmt.Errorf("IPP印刷に失敗しました: %w", err)
+	}
+	if a, ok := res.attr("job-id"); ok && len(a.Values) > 0 {
+		log.Printf("IPPジョブを送信しました (%s, job-id: %v)", target.Device, a.Values[0])
+	}
+	return nil
+}
+
+// addIPPJobAttributes は印刷オプションをIPPのジョブテンプレート属性として追加します。
+func addIPPJobAttributes(req *ippMessage, options map[string]string) error {
+	opts, err := parsePrintOptions(options, 0)
+	if err != nil {
+		return err
+	}
+	if opts.Copies > 1 {
+		req.addAttr(ippTagJob, ippAttr{Name: "copies", Tag: ippTagInteger, Values: []interface{}{opts.Copies}})
+		handling := "separate-documents-collated-copies"
+		if !opts.Collate {
+			handling = "separate-documents-uncollated-copies"
+		}
+		req.addAttr(ippTagJob, ippAttr{Name: "multiple-document-handling", Tag: ippTagKeyword, Values: []interface{}{handling}})
+	}
+	if opts.Pages != "" {
+		ranges, err := parsePageRanges(opts.Pages, 0)
+		if err != nil {
+			return err
+		}
+		values := make([]interface{}, len(ranges))
+		for i, r := range ranges {
+			values[i] = ippRange{Lower: r.From, Upper: r.To}
+		}
+		req.addAttr(ippTagJob, ippAttr{Name: "page-ranges", Tag: ippTagRange, Values: values})
+	}
+
+	switch opts.Duplex {
+	case "simplex":
+		req.addAttr(ippTagJob, ippAttr{Name: "sides", Tag: ippTagKeyword, Values: []interface{}{"one-sided"}})
+	case "long-edge":
+		req.addAttr(ippTagJob, ippAttr{Name: "sides", Tag: ippTagKeyword, Values: []interface{}{"two-sided-long-edge"}})
+	case "short-edge":
+		req.addAttr(ippTagJob, ippAttr{Name: "sides", Tag: ippTagKeyword, Values: []interface{}{"two-sided-short-edge"}})
+	}
+	switch opts.Orientation {
+	case "portrait":
+		req.addAttr(ippTagJob, ippAttr{Name: "orientation-requested", Tag: ippTagEnum, Values: []interface{}{3}})
+	case "landscape":
+		req.addAttr(ippTagJob, ippAttr{Name: "orientation-requested", Tag: ippTagEnum, Values: []interface{}{4}})
+	}
+	if opts.Color != "" {
+		req.addAttr(ippTagJob, ippAttr{Name: "print-color-mode", Tag: ippTagKeyword, Values: []interface{}{opts.Color}})
+	}
+	if opts.Scale != "" {
+		// 拡大縮小は dispatchPrint でPDFに反映済みのため、プリンター側では拡大縮小させません。
+		req.addAttr(ippTagJob, ippAttr{Name: "print-scaling", Tag: ippTagKeyword, Values: []interface{}{"none"}})
+	}
+
+	// 用紙サイズだけの場合は media キーワード、トレイも指定された場合は media-col で指定します。
+	var media *mediaSize
+	if opts.Media != "" {
+		m, err := parseMediaSize(opts.Media)
+		if err != nil {
+			return err
+		}
+		media = &m
+	}
+	_, knownMedia := knownMediaSizes[strings.ToLower(opts.Media)]
+	if opts.Tray == "" && media != nil && knownMedia {
+		req.addAttr(ippTagJob, ippAttr{Name: "media", Tag: ippTagKeyword, Values: []interface{}{media.Keyword}})
+	} else if opts.Tray != "" || media != nil {
+		var members []ippAttr
+		if media != nil {
+			// media-size は 1/100 mm 単位です。
+			members = append(members, ippAttr{Name: "media-size", Tag: ippTagBegCollection, Values: []interface{}{[]ippAttr{
+				{Name: "x-dimension", Tag: ippTagInteger, Values: []interface{}{int(media.Width * 100)}},
+				{Name: "y-dimension", Tag: ippTagInteger, Values: []interface{}{int(media.Height * 100)}},
+			}}})
+		}
+		if opts.Tray != "" {
+			members = append(members, ippAttr{Name: "media-source", Tag: ippTagKeyword, Values: []interface{}{opts.Tray}})
+		}
+		req.addAttr(ippTagJob, ippAttr{Name: "media-col", Tag: ippTagBegCollection, Values: []interface{}{members}})
+	}
+	return nil
+}
+
+// pjlUEL はPJLのUniversal Exit Languageコマンドです。
+const pjlUEL = "\x1b%-12345X"
+
+// pjlDecipoints は長さ (mm) をPJLの単位のデシポイント (1/720インチ) に変換します。
+func pjlDecipoints(mm float64) int {
+	return int(math.Round(mm / 25.4 * 720))
+}
+
+// pjlHeader は用紙や両面などの設定を指定する、PDFの前に送るPJLコマンドを返します。PDFの後には pjlUEL を送ります。
+// PJLに対応していないプリンターでは無視されるか、印刷に失敗する場合があります。
+func pjlHeader(opts printOptions) string {
+	var b strings.Builder
+	b.WriteString(pjlUEL + "@PJL\r\n")
+	switch opts.Duplex {
+	case "simplex":
+		b.WriteString("@PJL SET DUPLEX=OFF\r\n")
+	case "long-edge":
+		b.WriteString("@PJL SET DUPLEX=ON\r\n@PJL SET BINDING=LONGEDGE\r\n")
+	case "short-edge":
+		b.WriteString("@PJL SET DUPLEX=ON\r\n@PJL SET BINDING=SHORTEDGE\r\n")
+	}
+	if opts.Orientation != "" {
+		fmt.Fprintf(&b, "@PJL SET ORIENTATION=%s\r\n", strings.ToUpper(opts.Orientation))
+	}
+	if m, ok := knownMediaSizes[strings.ToLower(opts.Media)]; ok {
+		fmt.Fprintf(&b, "@PJL SET PAPER=%s\r\n", strings.ToUpper(m.Name))
+	} else if m, err := parseMediaSize(opts.Media); opts.Media != "" && err == nil {
+		// 任意サイズは幅と長さをデシポイント (1/720インチ) で指定します。
+		fmt.Fprintf(&b, "@PJL SET PAPER=CUSTOM\r\n@PJL SET CUSTWIDTH=%d\r\n@PJL SET CUSTLENGTH=%d\r\n", pjlDecipoints(m.Width), pjlDecipoints(m.Height))
+	}
+	if opts.Tray != "" {
+		fmt.Fprintf(&b, "@PJL SET MEDIASOURCE=%s\r\n", strings.ToUpper(strings.ReplaceAll(opts.Tray, " ", "")))
+	}
+	switch opts.Color {
+	case "color":
+		b.WriteString("@PJL SET RENDERMODE=COLOR\r\n")
+	case "monochrome":
+		b.WriteString("@PJL SET RENDERMODE=GRAYSCALE\r\n")
+	}
+	b.WriteString("@PJL ENTER LANGUAGE=PDF\r\n")
+	return b.String()
+}
+
+// socketPrint はRAWポート (通常9100) にPDFをそのまま送信します。
+// 印刷オプションを渡す手段がないため、部数とページ範囲はPDF自体に反映し、用紙や両面などはPJLで指定します。
+func socketPrint(documentPath string, target printTarget) error {
+	opts, err := parsePrintOptions(target.Options, 0)
+	if err != nil {
+		return err
+	}
+	sequenced, err := applyPageSequence(documentPath, opts)
+	if err != nil {
+		return err
+	}
+	if sequenced != documentPath {
+		// 並べ替えたPDFは送信を終えたら不要です。
+		defer os.Remove(sequenced)
+		documentPath = sequenced
+	}
+
+	address := target.Device
+	if strings.Contains(address, "://") {
+		if address, err = networkPrinterAddress(address); err != nil {
+			return notSent(err)
+		}
+	}
+
+	file, err := os.Open(documentPath)
+	if err != nil {
+		return notSent(fmt.Errorf("ドキュメントを開けませんでした: %w", err))
+	}
+	defer file.Close()
+	conn, err := net.DialTimeout("tcp", address, 10*time.Second)
+	if err != nil {
+		log.Printf("プリンター '%s' への接続に失敗しました: %v", address, err)
+		return notSent(fmt.Errorf("プリンター '%s' への接続に失敗しました: %w", address, err))
+	}
+	defer conn.Close()
+	conn.SetWriteDeadline(time.Now().Add(target.Timeout))
+
+	// PDFはメモリに読み込まずに送信し、PJLを付ける場合はその前後にPJLコマンドを送ります。
+	pjl := opts.hasDeviceSettings()
+	if pjl {
+		if _, err := io.WriteString(conn, pjlHeader(opts)); err != nil {
+			return fmt.Errorf("プリンター '%s' への送信に失敗しました: %w", address, err)
+		}
+	}
+	sent, err := io.Copy(conn, file)
+	if err != nil {
+		return fmt.Errorf("プリンター '%s' への送信に失敗しました: %w", address, err)
+	}
+	if pjl {
+		if _, err := io.WriteString(conn, pjlUEL); err != nil {
+			return fmt.Errorf("プリンター '%s' への送信に失敗しました: %w", address, err)
+		}
+	}
+	log.Printf("RAWポート '%s' に %d バイトを送信しました。", address, sent)
+	return nil
+}
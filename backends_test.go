@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// receiveSocketJob はRAWポートの代わりに127.0.0.1で待ち受け、socketPrint が送信したデータを返します。
+func receiveSocketJob(t *testing.T, documentPath string, options map[string]string) []byte {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	received := make(chan []byte, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			received <- nil
+			return
+		}
+		defer conn.Close()
+		b, _ := io.ReadAll(conn)
+		received <- b
+	}()
+
+	target := printTarget{Name: "label", Backend: "socket", Device: ln.Addr().String(), Options: options, Timeout: 10 * time.Second}
+	if err := socketPrint(documentPath, target); err != nil {
+		t.Fatalf("socketPrint: %v", err)
+	}
+	return <-received
+}
+
+func TestSocketPrint(t *testing.T) {
+	src := writeTestPDF(t, "invoice.pdf", 2)
+	pdf, err := os.ReadFile(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("PJLなし", func(t *testing.T) {
+		if got := receiveSocketJob(t, src, nil); !bytes.Equal(got, pdf) {
+			t.Errorf("送信したデータ (%d バイト) がPDF (%d バイト) と一致しません", len(got), len(pdf))
+		}
+	})
+
+	t.Run("PJLあり", func(t *testing.T) {
+		got := string(receiveSocketJob(t, src, map[string]string{"duplex": "long-edge", "media": "A4"}))
+		header := pjlUEL + "@PJL\r\n@PJL SET DUPLEX=ON\r\n@PJL SET BINDING=LONGEDGE\r\n@PJL SET PAPER=A4\r\n@PJL ENTER LANGUAGE=PDF\r\n"
+		if want := header + string(pdf) + pjlUEL; got != want {
+			t.Errorf("送信したデータの先頭 = %q; want %q", got[:min(len(got), len(header))], header)
+		}
+		if !strings.HasSuffix(got, "%%EOF\n"+pjlUEL) {
+			t.Errorf("PDFの後に %q がありません", pjlUEL)
+		}
+	})
+}
+
+func TestPJLHeaderCustomMedia(t *testing.T) {
+	opts, err := parsePrintOptions(map[string]string{"media": "100x150mm"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 100mm = 2835 デシポイント、150mm = 4252 デシポイントです。
+	want := "@PJL SET PAPER=CUSTOM\r\n@PJL SET CUSTWIDTH=2835\r\n@PJL SET CUSTLENGTH=4252\r\n"
+	if got := pjlHeader(opts); !strings.Contains(got, want) {
+		t.Errorf("pjlHeader() = %q; want %q", got, want)
+	}
+}
+
+func TestPrintTargetKeySpoolerCase(t *testing.T) {
+	// スプーラーが返す名前と、リクエストで指定された名前の大文字と小文字が異なっても同じデバイスとして扱います。
+	m := &healthMonitor{devices: make(map[string]*printerHealth)}
+	m.record(printTarget{Backend: "spooler", Device: "RICOH MP C3004 2F"}, healthOffline, nil)
+
+	requested := printTarget{Backend: "spooler", Device: "ricoh mp c3004 2f"}
+	if h := m.get(requested); h.State != healthOffline || h.Device != "RICOH MP C3004 2F" {
+		t.Errorf("get() = %+v; want offline RICOH MP C3004 2F", h)
+	}
+	if !m.isDown(requested.key()) {
+		t.Errorf("isDown(%q) = false; want true", requested.key())
+	}
+
+	// ネットワークのデバイスのURIはそのまま区別します。
+	if a, b := (printTarget{Backend: "ipp", Device: "ipp://Printer/ipp"}).key(), (printTarget{Backend: "ipp", Device: "ipp://printer/ipp"}).key(); a == b {
+		t.Errorf("key() = %q for both URIs; want distinct", a)
+	}
+}
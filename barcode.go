@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"strconv"
+	"strings"
+
+	"github.com/boombuler/barcode"
+	"github.com/boombuler/barcode/code128"
+	"github.com/boombuler/barcode/code39"
+	"github.com/boombuler/barcode/datamatrix"
+	"github.com/boombuler/barcode/qr"
+	"github.com/pdfcpu/pdfcpu/pkg/api"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/types"
+)
+
+// スキャンしたドキュメントをジョブと照合できるよう、ジョブIDや追跡番号などのバーコードをページに重ねて印刷します。
+
+// barcodeModulePixels はバーコードの1モジュール (最も細いバーやQRコードの1セル) を描画するピクセル数です。
+// 印刷するときは barcode_size に合わせて拡大縮小します。
+const barcodeModulePixels = 8
+
+// barcodeBarHeight は barcode_size に対する1次元バーコードの高さの比率です。
+const barcodeBarHeight = 0.3
+
+// barcodeSpec はページに重ねて印刷するバーコードです。
+type barcodeSpec struct {
+	Content  string  // barcode: バーコードにする文字列 ({job_id} などのプレースホルダーを含みます)
+	Type     string  // barcode_type: qr (省略時), datamatrix, code128, code39
+	Position string  // barcode_position: stamp_position と同じ値 (省略時は top-right)
+	Size     float64 // barcode_size: 余白を含めた幅 (mm、省略時はQRコードとデータマトリックスが20、それ以外が50)
+	Pages    string  // barcode_pages: first (省略時), all、またはページ範囲 ("1-3")
+}
+
+// parseBarcode は barcode で始まるオプションを解析します。barcode がない場合は ok が false です。
+func parseBarcode(options map[string]string) (b barcodeSpec, ok bool, err error) {
+	b = barcodeSpec{Content: options["barcode"], Type: "qr", Position: "top-right", Pages: "first"}
+	if v, ok := options["barcode_type"]; ok {
+		switch t := strings.ToLower(v); t {
+		case "qr", "datamatrix", "code128", "code39":
+			b.Type = t
+		default:
+			return b, false, fmt.Errorf("barcode_type '%s' は qr, datamatrix, code128, code39 のいずれかで指定してください", v)
+		}
+	}
+	if v, ok := options["barcode_position"]; ok {
+		if _, known := stampPositions[strings.ToLower(v)]; !known {
+			return b, false, fmt.Errorf("barcode_position '%s' は center, top-left, top, top-right, left, right, bottom-left, bottom, bottom-right のいずれかで指定してください", v)
+		}
+		b.Position = strings.ToLower(v)
+	}
+	b.Size = 50
+	if b.twoDimensional() {
+		b.Size = 20
+	}
+	if v, ok := options["barcode_size"]; ok {
+		f, err := strconv.ParseFloat(strings.TrimSuffix(strings.ToLower(v), "mm"), 64)
+		if err != nil || f < 5 || f > 200 {
+			return b, false, fmt.Errorf("barcode_size '%s' は5から200までの数値 (mm) で指定してください", v)
+		}
+		b.Size = f
+	}
+	if v, ok := options["barcode_pages"]; ok {
+		switch p := strings.ToLower(v); p {
+		case "first", "all":
+			b.Pages = p
+		default:
+			ranges, err := parsePageRanges(v, 0)
+			if err != nil {
+				return b, false, fmt.Errorf("barcode_pages: %w", err)
+			}
+			b.Pages = formatPageRanges(ranges)
+		}
+	}
+	return b, b.Content != "", nil
+}
+
+// checkPages は barcode_pages のページ範囲が pageCount ページの中にあるかを確認します。
+// pageCount はバーコードを重ねるPDFのページ数 (面付けした場合は面付けした後のページ数) です。
+func (b barcodeSpec) checkPages(pageCount int) error {
+	if b.Pages == "first" || b.Pages == "all" {
+		return nil
+	}
+	if _, err := parsePageRanges(b.Pages, pageCount); err != nil {
+		return fmt.Errorf("barcode_pages: %w", err)
+	}
+	return nil
+}
+
+// twoDimensional はQRコードやデータマトリックスのような正方形のバーコードかどうかを返します。
+func (b barcodeSpec) twoDimensional() bool {
+	return b.Type == "qr" || b.Type == "datamatrix"
+}
+
+// selectedPages は pdfcpu に渡すページの選択を返します。nil は全ページです。
+func (b barcodeSpec) selectedPages() []string {
+	switch b.Pages {
+	case "first":
+		return []string{"1"}
+	case "all":
+		return nil
+	}
+	return strings.Split(b.Pages, ",")
+}
+
+// encode は content のバーコードを、周囲に読み取りに必要な余白 (クワイエットゾーン) を付けたPNG画像にします。
+func (b barcodeSpec) encode(content string) ([]byte, error) {
+	var code barcode.Barcode
+	var err error
+	quiet := 10 // 1次元バーコードの左右の余白 (モジュール数)
+	switch b.Type {
+	case "qr":
+		code, err = qr.Encode(content, qr.M, qr.Auto)
+		quiet = 4
+	case "datamatrix":
+		code, err = datamatrix.Encode(content)
+		quiet = 2
+	case "code128":
+		code, err = code128.Encode(content)
+	case "code39":
+		code, err = code39.Encode(content, false, true)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("'%s' を %s のバーコードにできませんでした: %w", content, b.Type, err)
+	}
+
+	modules := code.Bounds().Dx()
+	w := modules * barcodeModulePixels
+	h := code.Bounds().Dy() * barcodeModulePixels
+	qy := quiet
+	if !b.twoDimensional() {
+		// 1次元バーコードは幅に対する比率で高さを決め、上下には余白を付けません。
+		h = int(float64(w) * barcodeBarHeight)
+		qy = 0
+	}
+	if code, err = barcode.Scale(code, w, h); err != nil {
+		return nil, fmt.Errorf("バーコードの拡大に失敗しました: %w", err)
+	}
+	img := image.NewGray(image.Rect(0, 0, w+2*quiet*barcodeModulePixels, h+2*qy*barcodeModulePixels))
+	draw.Draw(img, img.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.Draw(img, image.Rect(quiet*barcodeModulePixels, qy*barcodeModulePixels, quiet*barcodeModulePixels+w, qy*barcodeModulePixels+h), code, code.Bounds().Min, draw.Src)
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// applyBarcode はバーコードをページに重ねた新しいPDFを作成し、そのパスを返します。barcode が指定されていない場合は元のパスを返します。
+func applyBarcode(documentPath string, options map[string]string, values stampValues) (string, error) {
+	b, ok, err := parseBarcode(options)
+	if err != nil || !ok {
+		return documentPath, err
+	}
+	data, err := b.encode(expandJobPlaceholders(b.Content, values))
+	if err != nil {
+		return "", err
+	}
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	// 余白を含めた画像の幅が barcode_size になるように、1ピクセルあたりのポイント数を指定します。
+	scale := b.Size * pointsPerMM / float64(cfg.Width)
+	desc := fmt.Sprintf("%s, rotation:0, opacity:1, scalefactor:%g abs", stampAnchor(b.Position), scale)
+	wm, err := api.ImageWatermarkForReader(bytes.NewReader(data), desc, true, false, types.POINTS)
+	if err != nil {
+		return "", fmt.Errorf("バーコードの画像を作成できませんでした: %w", err)
+	}
+	dst := derivedPath(documentPath, "barcode")
+	if err := addStamp(documentPath, dst, b.selectedPages(), wm); err != nil {
+		return "", err
+	}
+	return dst, nil
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseBarcode(t *testing.T) {
+	tests := []struct {
+		name    string
+		options map[string]string
+		want    barcodeSpec
+		ok      bool
+		wantErr bool
+	}{
+		{"指定なし", map[string]string{}, barcodeSpec{Type: "qr", Position: "top-right", Size: 20, Pages: "first"}, false, false},
+		{"QRコード", map[string]string{"barcode": "{job_id}"}, barcodeSpec{Content: "{job_id}", Type: "qr", Position: "top-right", Size: 20, Pages: "first"}, true, false},
+		{"1次元バーコードの既定の幅", map[string]string{"barcode": "A-1", "barcode_type": "CODE128"}, barcodeSpec{Content: "A-1", Type: "code128", Position: "top-right", Size: 50, Pages: "first"}, true, false},
+		{"すべて指定", map[string]string{
+			"barcode": "A-1", "barcode_type": "datamatrix", "barcode_position": "Bottom-Left", "barcode_size": "15mm", "barcode_pages": "3, 1-2",
+		}, barcodeSpec{Content: "A-1", Type: "datamatrix", Position: "bottom-left", Size: 15, Pages: "3,1-2"}, true, false},
+		{"全ページ", map[string]string{"barcode": "A-1", "barcode_pages": "ALL"}, barcodeSpec{Content: "A-1", Type: "qr", Position: "top-right", Size: 20, Pages: "all"}, true, false},
+		{"不明な種類", map[string]string{"barcode": "A-1", "barcode_type": "ean13"}, barcodeSpec{}, false, true},
+		{"不明な位置", map[string]string{"barcode": "A-1", "barcode_position": "middle"}, barcodeSpec{}, false, true},
+		{"小さすぎる", map[string]string{"barcode": "A-1", "barcode_size": "4"}, barcodeSpec{}, false, true},
+		{"大きすぎる", map[string]string{"barcode": "A-1", "barcode_size": "201"}, barcodeSpec{}, false, true},
+		{"終わりのないページ範囲", map[string]string{"barcode": "A-1", "barcode_pages": "2-"}, barcodeSpec{}, false, true},
+		{"ページ範囲が正しくない", map[string]string{"barcode": "A-1", "barcode_pages": "3-1"}, barcodeSpec{}, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, ok, err := parseBarcode(tt.options)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("parseBarcode(%v) = %+v; want error", tt.options, b)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseBarcode(%v): %v", tt.options, err)
+			}
+			if b != tt.want || ok != tt.ok {
+				t.Errorf("parseBarcode(%v) = %+v, %t; want %+v, %t", tt.options, b, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func TestBarcodeCheckPages(t *testing.T) {
+	tests := []struct {
+		pages     string
+		pageCount int
+		wantErr   bool
+	}{
+		{"first", 1, false},
+		{"all", 1, false},
+		{"1-3", 3, false},
+		{"1-3", 2, true},
+		{"5", 4, true},
+	}
+	for _, tt := range tests {
+		b := barcodeSpec{Content: "A-1", Type: "qr", Pages: tt.pages}
+		if err := b.checkPages(tt.pageCount); (err != nil) != tt.wantErr {
+			t.Errorf("checkPages(%q, %d) = %v; want error %t", tt.pages, tt.pageCount, err, tt.wantErr)
+		}
+	}
+}
+
+func TestBarcodeEncode(t *testing.T) {
+	tests := []struct {
+		typ     string
+		content string
+		wantErr bool
+	}{
+		{"qr", "0123456789abcdef", false},
+		{"qr", "請求書.pdf", false},
+		{"datamatrix", "0123456789abcdef", false},
+		{"code128", "JOB-0123456789abcdef", false},
+		{"code128", "請求書.pdf", true},
+		{"code39", "JOB-0123", false},
+		{"code39", "請求書", true},
+	}
+	for _, tt := range tests {
+		b := barcodeSpec{Type: tt.typ}
+		data, err := b.encode(tt.content)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("encode(%s, %q) error = %v; want error %t", tt.typ, tt.content, err, tt.wantErr)
+			continue
+		}
+		if err == nil && len(data) == 0 {
+			t.Errorf("encode(%s, %q) returned an empty image", tt.typ, tt.content)
+		}
+	}
+}
+
+func TestApplyBarcode(t *testing.T) {
+	values := stampValues{JobID: "0123456789abcdef", Printer: "2F-color", Document: "invoice.pdf", Time: time.Now()}
+
+	t.Run("指定なし", func(t *testing.T) {
+		src := writeTestPDF(t, "plain.pdf", 1)
+		got, err := applyBarcode(src, map[string]string{"barcode_type": "code128"}, values)
+		if err != nil || got != src {
+			t.Errorf("applyBarcode() = %q, %v; want %q", got, err, src)
+		}
+	})
+
+	for _, tt := range []struct {
+		name    string
+		options map[string]string
+		stamped []bool // ページごとにバーコードを重ねるかどうか
+	}{
+		{"最初のページ", map[string]string{"barcode": "{job_id}"}, []bool{true, false, false}},
+		{"全ページ", map[string]string{"barcode": "{job_id}", "barcode_type": "datamatrix", "barcode_pages": "all"}, []bool{true, true, true}},
+		{"ページ範囲", map[string]string{"barcode": "JOB-{job_id}", "barcode_type": "code128", "barcode_pages": "2-3"}, []bool{false, true, true}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			src := writeTestPDF(t, "invoice.pdf", 3)
+			dst, err := applyBarcode(src, tt.options, values)
+			if err != nil {
+				t.Fatalf("applyBarcode: %v", err)
+			}
+			ctx := readTestPDF(t, dst)
+			if ctx.PageCount != 3 {
+				t.Fatalf("PageCount = %d; want 3", ctx.PageCount)
+			}
+			for i, want := range tt.stamped {
+				content := testPageContent(t, ctx, i+1)
+				if got := strings.Contains(content, "Do"); got != want {
+					t.Errorf("%dページ目のバーコード = %t; want %t (%q)", i+1, got, want, content)
+				}
+				if !strings.Contains(content, "re f") {
+					t.Errorf("%dページ目の元の内容がありません: %q", i+1, content)
+				}
+			}
+		})
+	}
+
+	t.Run("バーコードにできない内容", func(t *testing.T) {
+		src := writeTestPDF(t, "invoice.pdf", 1)
+		if _, err := applyBarcode(src, map[string]string{"barcode": "請求書", "barcode_type": "code39"}, values); err == nil {
+			t.Errorf("applyBarcode() succeeded; want error")
+		}
+	})
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// capabilitiesCacheTTL はバックエンドから取得した機能情報をキャッシュする時間です。
+const capabilitiesCacheTTL = 10 * time.Minute
+
+// printerCapabilities はプリンターが対応している用紙サイズ、トレイ、両面、カラー、解像度、最大部数です。
+type printerCapabilities struct {
+	PaperSizes  []string `json:"paper_sizes"`
+	Trays       []string `json:"trays"`
+	Duplex      bool     `json:"duplex"`
+	Color       bool     `json:"color"`
+	Resolutions []string `json:"resolutions"`
+	MaxCopies   int      `json:"max_copies"`
+	Source      string   `json:"source"` // "spooler", "ipp", "config" のいずれか
+}
+
+// capabilitiesEntry はキャッシュされた機能情報です。
+type capabilitiesEntry struct {
+	caps      *printerCapabilities
+	fetchedAt time.Time
+}
+
+// capabilitiesCache はデバイスごとの機能情報のキャッシュです。
+var capabilitiesCache = struct {
+	sync.Mutex
+	entries map[string]capabilitiesEntry
+}{entries: make(map[string]capabilitiesEntry)}
+
+// getCapabilities は印刷先の機能情報を返します。
+// 設定ファイルに静的な機能情報があればそれを使い、なければバックエンドに問い合わせた結果をキャッシュして返します。
+func getCapabilities(cfg *Config, t printTarget) (*printerCapabilities, error) {
+	if caps := staticCapabilities(cfg, t); caps != nil {
+		return caps, nil
+	}
+
+	capabilitiesCache.Lock()
+	entry, ok := capabilitiesCache.entries[t.key()]
+	capabilitiesCache.Unlock()
+	if ok && time.Since(entry.fetchedAt) < capabilitiesCacheTTL {
+		return entry.caps, nil
+	}
+
+	var caps *printerCapabilities
+	var err error
+	switch t.Backend {
+	case "spooler":
+		caps, err = spoolerCapabilities(t.Device)
+	case "ipp":
+		caps, err = ippCapabilities(t.Device)
+	default:
+		return nil, fmt.Errorf("%s バックエンドは機能情報の問い合わせに対応していません。設定ファイルに capabilities を指定してください", t.Backend)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	capabilitiesCache.Lock()
+	capabilitiesCache.entries[t.key()] = capabilitiesEntry{caps: caps, fetchedAt: time.Now()}
+	capabilitiesCache.Unlock()
+	return caps, nil
+}
+
+// staticCapabilities は設定ファイルで印刷先のデバイスに指定された機能情報を返します。
+// 同じデバイスを参照する論理プリンターまたはネットワークプリンターの capabilities を使用します。
+func staticCapabilities(cfg *Config, t printTarget) *printerCapabilities {
+	var caps *printerCapabilities
+	for _, p := range cfg.Printers {
+		if caps == nil && p.Backend == t.Backend && p.Device == t.Device && p.Capabilities != nil {
+			caps = p.Capabilities
+		}
+	}
+	for _, p := range cfg.NetworkPrinters {
+		if caps == nil && p.URI == t.Device && p.Capabilities != nil {
+			caps = p.Capabilities
+		}
+	}
+	if caps == nil {
+		return nil
+	}
+	c := *caps
+	c.Source = "config"
+	return &c
+}
+
+// dotnetPrinterSettings は System.Drawing.Printing.PrinterSettings をJSONに変換したときのフィールドです。
+type dotnetPrinterSettings struct {
+	IsValid       bool
+	PaperSizes    []string
+	PaperSources  []string
+	CanDuplex     bool
+	SupportsColor bool
+	Resolutions   []string
+	MaximumCopies int
+}
+
+// spoolerCapabilities はスプーラーのプリンターの機能情報を .NET の PrinterSettings (DeviceCapabilities) から取得します。
+func spoolerCapabilities(printerName string) (*printerCapabilities, error) {
+	if runtime.GOOS != "windows" {
+		return nil, fmt.Errorf("スプーラーの機能情報はWindowsでのみ取得できます")
+	}
+
+	// プリンター名はスクリプトに埋め込まず、環境変数で渡します。
+	script := `[Console]::OutputEncoding = [Text.Encoding]::UTF8; ` +
+		`Add-Type -AssemblyName System.Drawing; ` +
+		`$s = New-Object System.Drawing.Printing.PrinterSettings; ` +
+		`$s.PrinterName = $env:PRINT_SERVICE_PRINTER; ` +
+		`ConvertTo-Json -Compress @{` +
+		`IsValid = $s.IsValid; ` +
+		`PaperSizes = @($s.PaperSizes | ForEach-Object { $_.PaperName }); ` +
+		`PaperSources = @($s.PaperSources | ForEach-Object { $_.SourceName }); ` +
+		`CanDuplex = $s.CanDuplex; ` +
+		`SupportsColor = $s.SupportsColor; ` +
+		`Resolutions = @($s.PrinterResolutions | Where-Object { $_.X -gt 0 } | ForEach-Object { "$($_.X)x$($_.Y)dpi" }); ` +
+		`MaximumCopies = $s.MaximumCopies }`
+	cmd := exec.Command("powershell", "-NoProfile", "-NonInteractive", "-Command", script)
+	cmd.Env = append(os.Environ(), "PRINT_SERVICE_PRINTER="+printerName)
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("プリンター '%s' の機能情報の取得に失敗しました: %w", printerName, err)
+	}
+
+	var settings dotnetPrinterSettings
+	if err := json.Unmarshal(output, &settings); err != nil {
+		return nil, fmt.Errorf("プリンター '%s' の機能情報のパースに失敗しました: %w", printerName, err)
+	}
+	if !settings.IsValid {
+		return nil, fmt.Errorf("プリンター '%s' はスプーラーに登録されていません", printerName)
+	}
+	return &printerCapabilities{
+		PaperSizes:  settings.PaperSizes,
+		Trays:       settings.PaperSources,
+		Duplex:      settings.CanDuplex,
+		Color:       settings.SupportsColor,
+		Resolutions: settings.Resolutions,
+		MaxCopies:   settings.MaximumCopies,
+		Source:      "spooler",
+	}, nil
+}
+
+// ippCapabilities はIPPのGet-Printer-Attributesでプリンターの機能情報を取得します。
+func ippCapabilities(printerURI string) (*printerCapabilities, error) {
+	req := newIPPRequest(ippOpGetPrinterAttributes, printerURI)
+	req.addAttr(ippTagOperation, ippAttr{
+		Name: "requested-attributes",
+		Tag:  ippTagKeyword,
+		Values: []interface{}{
+			"media-supported", "media-source-supported", "sides-supported",
+			"print-color-mode-supported", "printer-resolution-supported", "copies-supported",
+		},
+	})
+	res, err := sendIPP(printerURI, req, nil, 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+
+	caps := &printerCapabilities{MaxCopies: 1, Source: "ipp"}
+	if a, ok := res.attr("media-supported"); ok {
+		caps.PaperSizes = ippStrings(a)
+	}
+	if a, ok := res.attr("media-source-supported"); ok {
+		caps.Trays = ippStrings(a)
+	}
+	if a, ok := res.attr("sides-supported"); ok {
+		for _, s := range ippStrings(a) {
+			if s != "one-sided" {
+				caps.Duplex = true
+			}
+		}
+	}
+	if a, ok := res.attr("print-color-mode-supported"); ok {
+		for _, s := range ippStrings(a) {
+			if s == "color" || s == "auto" {
+				caps.Color = true
+			}
+		}
+	}
+	if a, ok := res.attr("printer-resolution-supported"); ok {
+		for _, v := range a.Values {
+			if r, ok := v.(ippResolution); ok {
+				unit := "dpi"
+				if r.Units == 4 {
+					unit = "dpcm"
+				}
+				caps.Resolutions = append(caps.Resolutions, fmt.Sprintf("%dx%d%s", r.X, r.Y, unit))
+			}
+		}
+	}
+	if a, ok := res.attr("copies-supported"); ok && len(a.Values) > 0 {
+		if r, ok := a.Values[0].(ippRange); ok {
+			caps.MaxCopies = r.Upper
+		}
+	}
+	return caps, nil
+}
+
+// ippStrings は属性の値を文字列の一覧に変換します。
+func ippStrings(a ippAttr) []string {
+	result := make([]string, 0, len(a.Values))
+	for _, v := range a.Values {
+		if s, ok := v.(string); ok {
+			result = append(result, s)
+		}
+	}
+	return result
+}
+
+// normalizeMediaName は用紙サイズ名を比較用に正規化します。
+// 例: "A4", "A4 (210 x 297 mm)", "iso_a4_210x297mm" はすべて "a4" になります。
+func normalizeMediaName(name string) string {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if parts := strings.Split(name, "_"); len(parts) >= 3 {
+		// IPPの自己記述的な名前 (class_name_size) の name 部分を使用します。
+		name = strings.Join(parts[1:len(parts)-1], "_")
+	}
+	if i := strings.IndexAny(name, " ("); i > 0 {
+		name = name[:i]
+	}
+	return name
+}
+
+// containsFold は一覧に大文字・小文字を区別せずに一致する値があるかを返します。
+func containsFold(list []string, value string) bool {
+	for _, v := range list {
+		if strings.EqualFold(strings.TrimSpace(v), strings.TrimSpace(value)) {
+			return true
+		}
+	}
+	return false
+}
+
+// validateOptions は印刷オプションが印刷先の機能の範囲内かを確認します。
+// 機能情報で確認できないオプション (任意サイズの用紙など) は検証せずにバックエンドに任せます。
+func validateOptions(options map[string]string, caps *printerCapabilities) error {
+	opts, err := parsePrintOptions(options, 0)
+	if err != nil {
+		return err
+	}
+	if caps.MaxCopies > 0 && opts.Copies > caps.MaxCopies {
+		return fmt.Errorf("部数 %d はこのプリンターの最大部数 %d を超えています", opts.Copies, caps.MaxCopies)
+	}
+	if opts.Duplex != "" && opts.Duplex != "simplex" && !caps.Duplex {
+		return fmt.Errorf("このプリンターは両面印刷 (%s) に対応していません", opts.Duplex)
+	}
+	if opts.Color == "color" && !caps.Color {
+		return fmt.Errorf("このプリンターはカラー印刷に対応していません")
+	}
+	if _, known := knownMediaSizes[strings.ToLower(opts.Media)]; known && len(caps.PaperSizes) > 0 {
+		found := false
+		for _, size := range caps.PaperSizes {
+			if normalizeMediaName(size) == normalizeMediaName(opts.Media) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("このプリンターは用紙サイズ '%s' に対応していません (対応: %s)", opts.Media, strings.Join(caps.PaperSizes, ", "))
+		}
+	}
+	if opts.Tray != "" && len(caps.Trays) > 0 && !containsFold(caps.Trays, opts.Tray) {
+		return fmt.Errorf("このプリンターにトレイ '%s' はありません (対応: %s)", opts.Tray, strings.Join(caps.Trays, ", "))
+	}
+	return nil
+}
+
+// filterCapableCandidates は印刷オプションに対応している候補だけを返します。
+// 機能情報を取得できない候補は対応しているものとして残します。すべての候補が対応していない場合は最初の理由を返します。
+func filterCapableCandidates(cfg *Config, candidates []printTarget) ([]printTarget, error) {
+	var result []printTarget
+	var firstErr error
+	for _, c := range candidates {
+		if len(c.Options) == 0 {
+			result = append(result, c)
+			continue
+		}
+		if c.Backend == "spooler" {
+			if err := checkSpoolerOptions(c.Options); err != nil {
+				if firstErr == nil {
+					firstErr = fmt.Errorf("%s: %w", c.Device, err)
+				}
+				continue
+			}
+		}
+		caps, err := getCapabilities(cfg, c)
+		if err != nil {
+			log.Printf("警告: '%s' の機能情報を取得できないため、オプションの検証を省略します: %v", c.Device, err)
+			result = append(result, c)
+			continue
+		}
+		if err := validateOptions(c.Options, caps); err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("%s: %w", c.Device, err)
+			}
+			continue
+		}
+		result = append(result, c)
+	}
+	if len(result) == 0 {
+		return nil, firstErr
+	}
+	return result, nil
+}
+
+// printerCapabilitiesHandler は GET /printers/{name}/capabilities のリクエストを処理します。
+// プールの場合はメンバーごとの機能情報を返します。設定にもスプーラーにもないプリンター名は 404 Not Found にします。
+func printerCapabilitiesHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if !requireKnownPrinter(w, name) {
+		return
+	}
+	candidates := resolveCandidates(appConfig, name)
+
+	type deviceCapabilities struct {
+		Backend string `json:"backend"`
+		Device  string `json:"device"`
+		*printerCapabilities
+		Error string `json:"error,omitempty"`
+	}
+	var devices []deviceCapabilities
+	for _, c := range candidates {
+		d := deviceCapabilities{Backend: c.Backend, Device: c.Device}
+		caps, err := getCapabilities(appConfig, c)
+		if err != nil {
+			log.Printf("プリンター '%s' の機能情報の取得に失敗しました: %v", c.Device, err)
+			d.Error = err.Error()
+		} else {
+			d.printerCapabilities = caps
+		}
+		devices = append(devices, d)
+	}
+
+	// プールでない場合は、デバイスの機能情報をそのまま返します。
+	if len(devices) == 1 {
+		if devices[0].Error != "" {
+			http.Error(w, fmt.Sprintf("プリンター '%s' の機能情報の取得に失敗しました: %s", name, devices[0].Error), http.StatusBadGateway)
+			return
+		}
+		writeJSON(w, http.StatusOK, devices[0])
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"name": name, "devices": devices})
+}
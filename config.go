@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+)
+
+// Config はサービスの設定ファイル (config.json) の内容を表します。
+type Config struct {
+	// NetworkPrinters はOSのスプーラーを経由せずに直接利用するネットワークプリンターの一覧です。
+	NetworkPrinters []NetworkPrinterConfig `json:"network_printers"`
+	// Printers は論理プリンター名から実際のバックエンドとデバイスへの対応表です。
+	Printers map[string]LogicalPrinterConfig `json:"printers"`
+	// Health はプリンターの状態監視の設定です。
+	Health HealthConfig `json:"health"`
+	// Presets はプリセット名 (例: "invoice-duplex", "label-4x6") から印刷先と印刷オプションの組み合わせへの対応表です。
+	Presets map[string]PresetConfig `json:"presets"`
+	// Uploads は /print-pdf で受け付けるドキュメントの設定です。
+	Uploads UploadConfig `json:"uploads"`
+	// Downloads は url で指定されたドキュメントをダウンロードする場合の設定です。
+	Downloads DownloadConfig `json:"downloads"`
+	// Font はテキストやCSVをPDFに変換するときに埋め込むフォントの設定です。
+	Font FontConfig `json:"font"`
+	// Stylesheets はスタイルシート名から、MarkdownやHTMLをPDFに変換するときの要素ごとの表示方法への対応表です。
+	// "default" という名前のスタイルシートは、stylesheet オプションを省略したときに使用します。
+	Stylesheets map[string]Stylesheet `json:"stylesheets"`
+	// StampImages は stamp_image オプションで指定する名前から、スタンプに使う画像ファイル (PNG, JPEG, TIFF) のパスへの対応表です。
+	StampImages map[string]string `json:"stamp_images"`
+}
+
+// FontConfig はテキストやCSVをPDFに変換するときに埋め込むフォントの設定です。
+// 日本語を表示するため、CJKの文字を含む等幅のTrueTypeフォントを指定してください。
+type FontConfig struct {
+	Path string `json:"path"` // TrueTypeフォント (.ttf) またはコレクション (.ttc) のパス (省略時は C:\Windows\Fonts\msgothic.ttc)
+	Name string `json:"name"` // 使用するフォントのPostScript名 (例: "MS-Gothic")。省略時はファイル内で名前順が最初のフォント
+}
+
+// UploadConfig は /print-pdf で受け付けるドキュメントの設定です。
+type UploadConfig struct {
+	MaxSizeMB int `json:"max_size_mb"` // ドキュメントの最大サイズ (省略時は500MB)
+}
+
+// DownloadConfig は /print-pdf の url で指定されたドキュメントのダウンロードの設定です。
+// AllowedHosts が空の場合、URLでの印刷は無効です。
+type DownloadConfig struct {
+	// AllowedHosts はダウンロードを許可するホスト名です。"*.example.local" のようにサブドメインも指定できます。
+	AllowedHosts   []string `json:"allowed_hosts"`
+	TimeoutSeconds int      `json:"timeout_seconds"` // ダウンロードのタイムアウト (省略時は60秒)
+	MaxSizeMB      int      `json:"max_size_mb"`     // ダウンロードするドキュメントの最大サイズ (省略時は100MB)
+	// Headers はホスト名 (AllowedHosts と同じ形式) ごとにダウンロード時に付加するヘッダーです (例: Authorization)。
+	Headers map[string]map[string]string `json:"headers"`
+}
+
+// PresetConfig は /print-pdf の preset で指定する印刷設定の組み合わせです。
+// リクエストで指定されたプリンターとオプションはプリセットより優先します。
+type PresetConfig struct {
+	Printer     string            `json:"printer"`     // printer が指定されなかった場合に使用するプリンター名
+	Options     map[string]string `json:"options"`     // 論理プリンターのデフォルトより優先する印刷オプション
+	Description string            `json:"description"` // 表示用の説明 (任意)
+}
+
+// HealthConfig はプリンターの状態監視と、停止中のプリンターへのジョブの扱いの設定です。
+type HealthConfig struct {
+	IntervalSeconds int `json:"interval_seconds"` // 状態を確認する間隔 (省略時は60秒)
+	// DownPolicy は停止中と分かっているプリンターへのジョブの扱いです。
+	// "fail" (省略時) はすぐに失敗させ、"hold" は復旧するまで保留し、"ignore" は状態に関係なく送信します。
+	DownPolicy         string `json:"down_policy"`
+	HoldTimeoutSeconds int    `json:"hold_timeout_seconds"` // "hold" の場合に保留する最大時間 (省略時は10分)
+	// SupplyThresholdPercent を下回った消耗品はログと AlertWebhookURL に通知します (省略時は10%)。
+	SupplyThresholdPercent int    `json:"supply_threshold_percent"`
+	AlertWebhookURL        string `json:"alert_webhook_url"`
+}
+
+// NetworkPrinterConfig はネットワークプリンター1台分の設定です。
+type NetworkPrinterConfig struct {
+	Name     string `json:"name"`     // クライアントが指定するプリンター名
+	URI      string `json:"uri"`      // 例: "ipp://192.168.1.50/ipp/print", "socket://192.168.1.51:9100"
+	Driver   string `json:"driver"`   // 表示用のドライバー名 (任意)
+	Location string `json:"location"` // 表示用の設置場所 (任意)
+	// SNMPCommunity を設定すると、SNMP (v2c) でプリンターの状態を確認します。
+	SNMPCommunity string `json:"snmp_community"`
+	// Capabilities を設定すると、プリンターに問い合わせずにこの機能情報を使用します。
+	Capabilities *printerCapabilities `json:"capabilities"`
+}
+
+// LogicalPrinterConfig は論理プリンター (例: "shipping-labels", "2F-color") 1つ分の設定です。
+type LogicalPrinterConfig struct {
+	Backend     string            `json:"backend"`     // "spooler" (省略時), "ipp", "socket" のいずれか
+	Device      string            `json:"device"`      // スプーラーのプリンター名、またはプリンターURI
+	Options     map[string]string `json:"options"`     // リクエストで指定されなかった場合に使用する印刷オプション
+	Description string            `json:"description"` // 表示用の説明 (任意)
+	// Members を指定するとプリンタープールになります。要素はスプーラー、ネットワーク、論理プリンターの名前です。
+	// ジョブは正常なメンバーのうち最も負荷の低いものに送られ、失敗した場合は別のメンバーに切り替わります。
+	Members        []string `json:"members"`
+	TimeoutSeconds int      `json:"timeout_seconds"` // 1回の送信のタイムアウト (省略時は5分)
+	// Capabilities を設定すると、バックエンドに問い合わせずにこの機能情報を使用します (socket バックエンドでは必須)。
+	Capabilities *printerCapabilities `json:"capabilities"`
+}
+
+// appConfig は起動時に読み込まれた設定です。起動後は読み取り専用として扱います。
+var appConfig = &Config{}
+
+// configPath は設定ファイルのパスを返します。
+// PRINT_SERVICE_CONFIG 環境変数が設定されていない場合は、現在のディレクトリの config.json を使用します。
+func configPath() string {
+	if path := os.Getenv("PRINT_SERVICE_CONFIG"); path != "" {
+		return path
+	}
+	return "config.json"
+}
+
+// loadConfig は設定ファイルを読み込みます。
+// ファイルが存在しない場合は空の設定を返し、サービスは従来どおりスプーラーのプリンターのみで動作します。
+func loadConfig(path string) (*Config, error) {
+	cfg := &Config{}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		log.Printf("設定ファイル '%s' が見つかりません。デフォルト設定を使用します。", path)
+		return cfg, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("設定ファイル '%s' の読み込みに失敗しました: %w", path, err)
+	}
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("設定ファイル '%s' のパースに失敗しました: %w", path, err)
+	}
+	for i, p := range cfg.NetworkPrinters {
+		if p.Name == "" || p.URI == "" {
+			return nil, fmt.Errorf("network_printers[%d] には name と uri が必要です", i)
+		}
+	}
+	switch cfg.Health.DownPolicy {
+	case "", "fail", "hold", "ignore":
+	default:
+		return nil, fmt.Errorf("health.down_policy '%s' はサポートされていません", cfg.Health.DownPolicy)
+	}
+	for name, s := range cfg.Stylesheets {
+		if err := s.validate(); err != nil {
+			return nil, fmt.Errorf("stylesheets['%s'] が正しくありません: %w", name, err)
+		}
+	}
+	for name, path := range cfg.StampImages {
+		if _, err := os.Stat(path); err != nil {
+			return nil, fmt.Errorf("stamp_images['%s'] の画像 '%s' を読み込めません: %w", name, path, err)
+		}
+	}
+	for name, p := range cfg.Presets {
+		if err := validateOptionSet(cfg, p.Options); err != nil {
+			return nil, fmt.Errorf("presets['%s'] の印刷オプションが正しくありません: %w", name, err)
+		}
+	}
+	for name, p := range cfg.Printers {
+		if err := validateOptionSet(cfg, p.Options); err != nil {
+			return nil, fmt.Errorf("printers['%s'] の options が正しくありません: %w", name, err)
+		}
+		if len(p.Members) > 0 {
+			for _, member := range p.Members {
+				if m, ok := cfg.Printers[member]; ok && len(m.Members) > 0 {
+					return nil, fmt.Errorf("printers['%s'] のメンバー '%s' はプールです。プールの入れ子はサポートされていません", name, member)
+				}
+			}
+			continue
+		}
+		if p.Backend == "" {
+			p.Backend = "spooler"
+			cfg.Printers[name] = p
+		}
+		if p.Device == "" {
+			return nil, fmt.Errorf("printers['%s'] には device が必要です", name)
+		}
+		if _, ok := printBackends[p.Backend]; !ok {
+			return nil, fmt.Errorf("printers['%s'] のバックエンド '%s' はサポートされていません", name, p.Backend)
+		}
+		if p.Backend == "spooler" {
+			if err := checkSpoolerOptions(p.Options); err != nil {
+				return nil, fmt.Errorf("printers['%s'] の options が正しくありません: %w", name, err)
+			}
+		}
+	}
+	return cfg, nil
+}
+
+// validateOptionSet はプリセットや論理プリンターに設定された印刷オプションを、リクエストの印刷オプションと同じ規則で検証します。
+func validateOptionSet(cfg *Config, options map[string]string) error {
+	if _, err := parsePrintOptions(options, 0); err != nil {
+		return err
+	}
+	if _, err := parseDocumentMerge(options); err != nil {
+		return err
+	}
+	if _, err := parseImageLayout(options); err != nil {
+		return err
+	}
+	if _, err := parseTextLayout(options); err != nil {
+		return err
+	}
+	if _, err := lookupStylesheet(cfg, options["stylesheet"]); err != nil {
+		return err
+	}
+	if _, _, err := parseStamp(cfg, options); err != nil {
+		return err
+	}
+	if _, _, err := parseBarcode(options); err != nil {
+		return err
+	}
+	if _, _, err := parseImposition(options); err != nil {
+		return err
+	}
+	if _, _, err := parsePageAdjustment(options); err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadConfigOptions(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  string
+		wantErr bool
+	}{
+		{"正しいオプション", `{"presets": {"label": {"options": {"media": "100x150mm", "nup": "2"}}}, "printers": {"label": {"backend": "socket", "device": "socket://192.0.2.1", "options": {"crop": "5"}}}}`, false},
+		{"プリセットの面付け", `{"presets": {"label": {"options": {"nup": "3"}}}}`, true},
+		{"ipp のプリンターの部数", `{"printers": {"2F": {"backend": "ipp", "device": "ipp://192.0.2.1/ipp/print", "options": {"copies": "0"}}}}`, true},
+		{"socket のプリンターのバーコード", `{"printers": {"label": {"backend": "socket", "device": "socket://192.0.2.1", "options": {"barcode": "{job_id}", "barcode_type": "ean"}}}}`, true},
+		{"プールの余白", `{"printers": {"pool": {"members": ["a", "b"], "options": {"page_margin": "51"}}}}`, true},
+		{"スプーラーの任意サイズの用紙", `{"printers": {"2F": {"device": "RICOH 2F", "options": {"media": "100x150mm"}}}}`, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := filepath.Join(t.TempDir(), "config.json")
+			if err := os.WriteFile(p, []byte(tt.config), 0644); err != nil {
+				t.Fatal(err)
+			}
+			_, err := loadConfig(p)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("loadConfig() error = %v; want error %t", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// 画像やテキストなど、PDF以外のドキュメントは印刷する前にPDFに変換します。
+// 変換したPDFはスプールディレクトリの元のファイルの隣に保存し、以降はPDFと同じように扱います。
+
+// defaultConvertMedia と defaultConvertMargin は、PDFに変換するときの既定の用紙サイズと余白 (mm) です。
+const (
+	defaultConvertMedia  = "A4"
+	defaultConvertMargin = 10.0
+)
+
+// pageLayout はドキュメントをPDFに変換するときの用紙と余白です。
+type pageLayout struct {
+	Media       mediaSize // media: 用紙サイズ (省略時はA4)
+	Orientation string    // orientation: 省略時は内容に合わせます
+	Margin      float64   // margin: 用紙の端からの余白 (mm)
+}
+
+// parsePageLayout は media, orientation, margin のオプションを解析します。
+func parsePageLayout(options map[string]string) (pageLayout, error) {
+	l := pageLayout{Margin: defaultConvertMargin}
+	media := defaultConvertMedia
+	if v := options["media"]; v != "" && !strings.EqualFold(v, mediaAuto) {
+		media = v
+	}
+	m, err := parseMediaSize(media)
+	if err != nil {
+		return l, err
+	}
+	l.Media = m
+	switch v := strings.ToLower(options["orientation"]); v {
+	case "", "portrait", "landscape":
+		l.Orientation = v
+	default:
+		return l, fmt.Errorf("orientation '%s' は portrait または landscape で指定してください", options["orientation"])
+	}
+	if v, ok := options["margin"]; ok {
+		margin, err := strconv.ParseFloat(strings.TrimSuffix(strings.ToLower(v), "mm"), 64)
+		if err != nil || margin < 0 || margin*2 >= math.Min(m.Width, m.Height) {
+			return l, fmt.Errorf("margin '%s' は用紙に収まる0以上の数値 (mm) で指定してください", v)
+		}
+		l.Margin = margin
+	}
+	return l, nil
+}
+
+// pageSize は用紙の幅と高さ (ポイント) を返します。
+// orientation が指定されていない場合は、wide (内容が横長かどうか) に合わせた向きにします。
+func (l pageLayout) pageSize(wide bool) (float64, float64) {
+	w, h := l.Media.Width*pointsPerMM, l.Media.Height*pointsPerMM
+	landscape := l.Orientation == "landscape" || (l.Orientation == "" && wide)
+	if landscape != (w > h) {
+		w, h = h, w
+	}
+	return w, h
+}
+
+// convertDocument はドキュメントの種類に応じてPDFに変換し、変換後のドキュメントを返します。
+// PDFや変換の対象でないドキュメントはそのまま返します。
+func convertDocument(doc submittedDocument, options map[string]string) (submittedDocument, error) {
+	if format := imageFormat(doc.Path); format != "" {
+		return convertImageDocument(doc, format, options)
+	}
+	if format := textFormat(doc.Name, doc.Path); format != "" {
+		return convertTextDocument(doc, format, options)
+	}
+	if format := markupFormat(doc.Name, doc.Path); format != "" {
+		return convertMarkupDocument(doc, format, options)
+	}
+	return doc, nil
+}
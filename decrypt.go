@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/pdfcpu/pdfcpu/pkg/api"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu"
+)
+
+// 印刷ツールはパスワードで保護されたPDFを開くとき、サービスからは見えないパスワードの入力画面で止まってしまいます。
+// そのため、暗号化されたPDFはリクエストの password で復号してから印刷ツールに渡します。
+
+// pdfEncryption はPDFの暗号化の状態です。
+type pdfEncryption int
+
+const (
+	pdfNotEncrypted      pdfEncryption = iota // 暗号化されていない (またはPDFとして読み込めない)
+	pdfOwnerEncrypted                         // 権限パスワードだけで暗号化されており、パスワードなしで開ける
+	pdfPasswordProtected                      // 開くためにパスワードが必要
+)
+
+// detectEncryption はPDFが暗号化されているかどうかを、パスワードを指定せずに開いて確認します。
+// PDFとして読み込めない場合は暗号化されていないものとして扱い、後の検証でエラーにします。
+func detectEncryption(path string) pdfEncryption {
+	f, err := os.Open(path)
+	if err != nil {
+		return pdfNotEncrypted
+	}
+	defer f.Close()
+	ctx, err := api.ReadContext(f, pdfConfig())
+	switch {
+	case errors.Is(err, pdfcpu.ErrWrongPassword):
+		return pdfPasswordProtected
+	case err != nil:
+		return pdfNotEncrypted
+	case ctx.Encrypt != nil:
+		return pdfOwnerEncrypted
+	}
+	return pdfNotEncrypted
+}
+
+// decryptDocument は暗号化されたPDFを password で復号し、復号したドキュメントを返します。暗号化されていない場合はそのまま返します。
+// パスワードは開くためのパスワードと権限パスワードのどちらでも受け付けます。
+// パスワードがない場合や正しくない場合は 422 Unprocessable Entity のエラーを返します。
+func decryptDocument(doc submittedDocument, password string) (submittedDocument, error) {
+	encryption := detectEncryption(doc.Path)
+	if encryption == pdfNotEncrypted {
+		return doc, nil
+	}
+	if encryption == pdfPasswordProtected && password == "" {
+		return doc, &submissionError{
+			Status: http.StatusUnprocessableEntity,
+			Err:    fmt.Errorf("'%s' はパスワードで保護されています。password を指定してください", doc.Name),
+		}
+	}
+
+	conf := pdfConfig()
+	conf.UserPW = password
+	conf.OwnerPW = password
+	dst := derivedPath(doc.Path, "decrypted")
+	if err := api.DecryptFile(doc.Path, dst, conf); err != nil {
+		if errors.Is(err, pdfcpu.ErrWrongPassword) {
+			return doc, &submissionError{
+				Status: http.StatusUnprocessableEntity,
+				Err:    fmt.Errorf("'%s' のパスワードが正しくありません", doc.Name),
+			}
+		}
+		return doc, &submissionError{Status: http.StatusUnprocessableEntity, Err: fmt.Errorf("'%s' を復号できませんでした: %w", doc.Name, err)}
+	}
+	// 暗号化されたままのファイルは以降の処理で使用しないため削除します。
+	os.Remove(doc.Path)
+	log.Printf("暗号化されたPDF '%s' を復号しました: %s", doc.Name, dst)
+	return submittedDocument{Name: doc.Name, Path: dst, Encrypted: true}, nil
+}
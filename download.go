@@ -0,0 +1,137 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+// ダウンロードの設定が省略された場合の値
+const (
+	defaultDownloadTimeout = 60 * time.Second
+	defaultDownloadMaxSize = 100 << 20 // 100MB
+)
+
+// hostAllowed はホスト名がパターン (例: "reports.example.local", "*.example.local") のいずれかに一致するかを返します。
+func hostAllowed(host string, patterns []string) bool {
+	host = strings.ToLower(host)
+	for _, p := range patterns {
+		p = strings.ToLower(p)
+		if p == host {
+			return true
+		}
+		if strings.HasPrefix(p, "*.") && strings.HasSuffix(host, p[1:]) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkDownloadURL はURLがダウンロードを許可されたものかを確認します。
+func checkDownloadURL(cfg DownloadConfig, u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return badRequest("URL '%s' のスキームはサポートされていません (http, https)", u)
+	}
+	if !hostAllowed(u.Hostname(), cfg.AllowedHosts) {
+		return &submissionError{Status: http.StatusForbidden, Err: fmt.Errorf("ホスト '%s' からのダウンロードは許可されていません", u.Hostname())}
+	}
+	return nil
+}
+
+// downloadDocument は url のドキュメントをダウンロードしてスプールディレクトリに保存し、そのパス、ファイル名、レスポンスの Content-Type を返します。
+// リダイレクト先も許可されたホストである必要があります。
+func downloadDocument(cfg DownloadConfig, rawURL string) (string, string, string, error) {
+	if len(cfg.AllowedHosts) == 0 {
+		return "", "", "", &submissionError{Status: http.StatusForbidden, Err: errors.New("URLでの印刷は設定されていません (downloads.allowed_hosts)")}
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", "", "", badRequest("URL '%s' のパースに失敗しました: %v", rawURL, err)
+	}
+	if err := checkDownloadURL(cfg, u); err != nil {
+		return "", "", "", err
+	}
+
+	timeout := defaultDownloadTimeout
+	if cfg.TimeoutSeconds > 0 {
+		timeout = time.Duration(cfg.TimeoutSeconds) * time.Second
+	}
+	maxSize := int64(defaultDownloadMaxSize)
+	if cfg.MaxSizeMB > 0 {
+		maxSize = int64(cfg.MaxSizeMB) << 20
+	}
+
+	client := &http.Client{
+		Timeout: timeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 10 {
+				return errors.New("リダイレクトが多すぎます")
+			}
+			if err := checkDownloadURL(cfg, req.URL); err != nil {
+				return err
+			}
+			// リダイレクト先のホスト用のヘッダーに付け替えます。
+			for name := range downloadHeaders(cfg, via[len(via)-1].URL.Hostname()) {
+				req.Header.Del(name)
+			}
+			for name, value := range downloadHeaders(cfg, req.URL.Hostname()) {
+				req.Header.Set(name, value)
+			}
+			return nil
+		},
+	}
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return "", "", "", badRequest("URL '%s' が正しくありません: %v", rawURL, err)
+	}
+	for name, value := range downloadHeaders(cfg, u.Hostname()) {
+		req.Header.Set(name, value)
+	}
+
+	log.Printf("ドキュメントをダウンロードしています: %s", u.Redacted())
+	res, err := client.Do(req)
+	if err != nil {
+		var se *submissionError
+		if errors.As(err, &se) {
+			return "", "", "", se
+		}
+		return "", "", "", &submissionError{Status: http.StatusBadGateway, Err: fmt.Errorf("ドキュメントのダウンロードに失敗しました: %w", err)}
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", "", "", &submissionError{Status: http.StatusBadGateway, Err: fmt.Errorf("ドキュメントのダウンロードに失敗しました: %s", res.Status)}
+	}
+	if res.ContentLength > maxSize {
+		return "", "", "", documentTooLarge(maxSize)
+	}
+
+	name := path.Base(res.Request.URL.Path)
+	if name == "/" || name == "." {
+		name = ""
+	}
+	body := &sizeLimitReader{r: res.Body, max: maxSize}
+	documentPath, err := spoolDocument(name, body)
+	if err != nil {
+		return "", "", "", err
+	}
+	log.Printf("ドキュメントをダウンロードしました: %s (%d バイト)", u.Redacted(), body.n)
+	return documentPath, name, res.Header.Get("Content-Type"), nil
+}
+
+// downloadHeaders はホストに一致する設定のヘッダーを返します。
+func downloadHeaders(cfg DownloadConfig, host string) map[string]string {
+	headers := make(map[string]string)
+	for pattern, h := range cfg.Headers {
+		if hostAllowed(host, []string{pattern}) {
+			for name, value := range h {
+				headers[name] = value
+			}
+		}
+	}
+	return headers
+}
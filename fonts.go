@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pdfcpu/pdfcpu/pkg/font"
+	"golang.org/x/image/font/gofont/gomono"
+)
+
+// defaultFontPath は設定ファイルでフォントが指定されなかった場合に使用する、日本語を含む等幅フォントです。
+const defaultFontPath = `C:\Windows\Fonts\msgothic.ttc`
+
+// fallbackFontName は設定のフォントを読み込めなかった場合に使用する、組み込みの等幅フォント (Go Mono) の名前です。
+// 英数字のみに対応しているため、日本語は表示されません。
+const fallbackFontName = "GoMono"
+
+// documentFonts は変換に使用するフォントです。最初に使用するときに一度だけ読み込みます。
+var documentFonts struct {
+	once sync.Once
+	name string
+}
+
+// documentFont はテキストの変換に使用する、pdfcpu に登録済みのフォントの名前を返します。
+// pdfcpu はフォントを自身の形式に変換してから使用するため、初回は設定のフォントを一時ディレクトリに登録します。
+func documentFont() string {
+	documentFonts.once.Do(func() {
+		documentFonts.name = loadDocumentFont(appConfig.Font)
+	})
+	return documentFonts.name
+}
+
+// loadDocumentFont は設定のフォントと組み込みのフォントを pdfcpu に登録し、使用するフォントの名前を返します。
+func loadDocumentFont(cfg FontConfig) string {
+	dir := filepath.Join(os.TempDir(), "print-service-fonts")
+	os.RemoveAll(dir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		log.Printf("警告: フォントの保存先を作成できませんでした: %v", err)
+		return fallbackFontName
+	}
+	font.UserFontDir = dir
+
+	// 設定のフォントを先に登録し、登録されたフォントの名前を確認します。
+	name, err := installFontFile(dir, cfg)
+	if err != nil {
+		log.Printf("警告: フォント '%s' を読み込めませんでした。組み込みのフォント (日本語は表示されません) を使用します: %v", cfg.Path, err)
+		name = fallbackFontName
+	}
+	if err := font.InstallFontFromBytes(dir, fallbackFontName, gomono.TTF); err != nil {
+		log.Printf("警告: 組み込みのフォントを登録できませんでした: %v", err)
+	}
+	if err := font.LoadUserFonts(); err != nil {
+		log.Printf("警告: フォントを読み込めませんでした: %v", err)
+	}
+	log.Printf("ドキュメントの変換にフォント '%s' を使用します。", name)
+	return name
+}
+
+// installFontFile は設定のTrueTypeフォント (.ttf) またはコレクション (.ttc) を dir に登録し、使用するフォントの名前を返します。
+func installFontFile(dir string, cfg FontConfig) (string, error) {
+	path := cfg.Path
+	if path == "" {
+		path = defaultFontPath
+	}
+	var err error
+	if strings.EqualFold(filepath.Ext(path), ".ttc") {
+		err = font.InstallTrueTypeCollection(dir, path)
+	} else {
+		err = font.InstallTrueTypeFont(dir, path)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	// 登録したフォントは "<PostScript名>.gob" として保存されます。
+	matches, err := filepath.Glob(filepath.Join(dir, "*.gob"))
+	if err != nil || len(matches) == 0 {
+		return "", fmt.Errorf("'%s' にフォントがありません", path)
+	}
+	names := make([]string, len(matches))
+	for i, m := range matches {
+		names[i] = strings.TrimSuffix(filepath.Base(m), ".gob")
+	}
+	sort.Strings(names)
+	if cfg.Name == "" {
+		return names[0], nil
+	}
+	for _, n := range names {
+		if n == cfg.Name {
+			return n, nil
+		}
+	}
+	return "", fmt.Errorf("'%s' にフォント '%s' がありません (%s)", path, cfg.Name, strings.Join(names, ", "))
+}
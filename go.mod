@@ -3,6 +3,18 @@ module service-test
 go 1.24.4
 
 require (
+	github.com/boombuler/barcode v1.1.0
+	github.com/getlantern/systray v1.2.2
+	github.com/gosnmp/gosnmp v1.45.0
+	github.com/pdfcpu/pdfcpu v0.11.1
+	github.com/yuin/goldmark v1.7.13
+	golang.org/x/image v0.32.0
+	golang.org/x/net v0.46.0
+	golang.org/x/text v0.30.0
+)
+
+require (
+	github.com/clipperhouse/uax29/v2 v2.2.0 // indirect
 	github.com/cratonica/2goarray v0.0.0-20190331194516-514510793eaa // indirect
 	github.com/getlantern/context v0.0.0-20190109183933-c447772a6520 // indirect
 	github.com/getlantern/errors v0.0.0-20190325191628-abdb3e3e36f7 // indirect
@@ -10,10 +22,15 @@ require (
 	github.com/getlantern/hex v0.0.0-20190417191902-c6586a6fe0b7 // indirect
 	github.com/getlantern/hidden v0.0.0-20190325191715-f02dbb02be55 // indirect
 	github.com/getlantern/ops v0.0.0-20190325191751-d70cb0d6f85f // indirect
-	github.com/getlantern/systray v1.2.2 // indirect
 	github.com/go-stack/stack v1.8.0 // indirect
+	github.com/hhrutter/lzw v1.0.0 // indirect
+	github.com/hhrutter/pkcs7 v0.2.0 // indirect
+	github.com/hhrutter/tiff v1.0.2 // indirect
+	github.com/mattn/go-runewidth v0.0.19 // indirect
 	github.com/oxtoacart/bpool v0.0.0-20190530202638-03653db5a59c // indirect
-	golang.org/x/crypto v0.40.0 // indirect
-	golang.org/x/sys v0.34.0 // indirect
-	golang.org/x/term v0.33.0 // indirect
+	github.com/pkg/errors v0.9.1 // indirect
+	golang.org/x/crypto v0.43.0 // indirect
+	golang.org/x/sys v0.37.0 // indirect
+	golang.org/x/term v0.36.0 // indirect
+	gopkg.in/yaml.v2 v2.4.0 // indirect
 )
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// groupPartial は一部のジョブだけが失敗したジョブグループの状態です。
+const groupPartial = "partial"
+
+// jobGroup は1回のリクエストで受け付けた複数のドキュメントの印刷ジョブをまとめたものです。
+// ジョブは JobIDs の順番に1つずつ印刷します。
+type jobGroup struct {
+	ID        string
+	Printer   string
+	Preset    string
+	JobIDs    []string
+	CreatedAt time.Time
+}
+
+// jobGroupStatus は GET /job-groups/{id} が返すジョブグループの状態です。
+type jobGroupStatus struct {
+	ID        string     `json:"id"`
+	Printer   string     `json:"printer"`
+	Preset    string     `json:"preset,omitempty"`
+	Status    string     `json:"status"`
+	Total     int        `json:"total"`
+	Completed int        `json:"completed"`
+	Failed    int        `json:"failed"`
+	Jobs      []printJob `json:"jobs"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+// groupStore はジョブグループをメモリ上で管理します。
+type groupStore struct {
+	mu     sync.Mutex
+	groups map[string]*jobGroup
+	order  []string
+}
+
+// jobGroups はサービス全体で共有するジョブグループの一覧です。
+var jobGroups = &groupStore{groups: make(map[string]*jobGroup)}
+
+// create は新しいジョブグループを登録し、そのコピーを返します。
+func (s *groupStore) create(g jobGroup) jobGroup {
+	g.ID = newJobID()
+	g.CreatedAt = time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.groups[g.ID] = &g
+	s.order = append(s.order, g.ID)
+	for len(s.order) > maxStoredJobs {
+		delete(s.groups, s.order[0])
+		s.order = s.order[1:]
+	}
+	return g
+}
+
+// status はジョブグループと、各ジョブの現在の状態を返します。
+func (s *groupStore) status(id string) (jobGroupStatus, bool) {
+	s.mu.Lock()
+	g, ok := s.groups[id]
+	s.mu.Unlock()
+	if !ok {
+		return jobGroupStatus{}, false
+	}
+
+	st := jobGroupStatus{ID: g.ID, Printer: g.Printer, Preset: g.Preset, Total: len(g.JobIDs), CreatedAt: g.CreatedAt}
+	pending := 0
+	started := false
+	for _, jobID := range g.JobIDs {
+		job, ok := jobs.get(jobID)
+		if !ok {
+			// 古いジョブは削除されている場合があります。
+			continue
+		}
+		st.Jobs = append(st.Jobs, job)
+		switch job.Status {
+		case jobCompleted:
+			st.Completed++
+			started = true
+		case jobFailed:
+			st.Failed++
+			started = true
+		case jobPrinting, jobHeld:
+			pending++
+			started = true
+		default:
+			pending++
+		}
+	}
+	switch {
+	case pending > 0 && started:
+		st.Status = jobPrinting
+	case pending > 0:
+		st.Status = jobQueued
+	case st.Failed == 0:
+		st.Status = jobCompleted
+	case st.Completed == 0:
+		st.Status = jobFailed
+	default:
+		st.Status = groupPartial
+	}
+	return st, true
+}
+
+// groupedJob はジョブグループ内の1つの印刷ジョブと、その印刷に必要な情報です。
+type groupedJob struct {
+	JobID        string
+	DocumentPath string
+	Candidates   []printTarget
+}
+
+// runPrintGroup はジョブグループのジョブを順番に印刷します。
+// 途中のジョブが失敗しても、残りのジョブの印刷を続けます。
+func runPrintGroup(groupJobs []groupedJob) {
+	for _, j := range groupJobs {
+		runPrintJob(j.JobID, j.DocumentPath, j.Candidates)
+	}
+}
+
+// jobGroupHandler は GET /job-groups/{id} のリクエストを処理し、ジョブグループと各ドキュメントの状態をJSONで返します。
+func jobGroupHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	st, ok := jobGroups.status(id)
+	if !ok {
+		http.Error(w, fmt.Sprintf("ジョブグループ '%s' が見つかりません。", id), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, st)
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// プリンターの状態
+const (
+	healthOnline  = "online"
+	healthOffline = "offline"
+	healthError   = "error"
+	healthUnknown = "unknown"
+)
+
+// maxHealthHistory はプリンターごとに保持する状態変化の履歴の最大数です。
+const maxHealthHistory = 50
+
+// healthEvent はプリンターの状態が変化したときの記録です。
+type healthEvent struct {
+	Time    time.Time `json:"time"`
+	State   string    `json:"state"`
+	Reasons []string  `json:"reasons,omitempty"`
+}
+
+// printerHealth はデバイス1台分の最新の状態と履歴です。
+type printerHealth struct {
+	Backend   string        `json:"backend"`
+	Device    string        `json:"device"`
+	State     string        `json:"state"`
+	Reasons   []string      `json:"reasons,omitempty"`
+	CheckedAt time.Time     `json:"checked_at"`
+	History   []healthEvent `json:"history,omitempty"`
+	// Supplies はSNMPで取得した消耗品、トレイ、ページカウンターです (SNMPが設定されている場合のみ)。
+	Supplies *printerSupplies `json:"supplies,omitempty"`
+}
+
+// healthMonitor は設定されたプリンターを定期的に確認し、状態を記録します。
+type healthMonitor struct {
+	mu      sync.Mutex
+	devices map[string]*printerHealth
+}
+
+// printerHealthMonitor はサービス全体で共有するプリンターの状態です。
+var printerHealthMonitor = &healthMonitor{devices: make(map[string]*printerHealth)}
+
+// run は設定された間隔でプリンターの状態を確認し続けます。
+func (m *healthMonitor) run(cfg *Config) {
+	interval := time.Duration(cfg.Health.IntervalSeconds) * time.Second
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	log.Printf("プリンターの状態監視を %v 間隔で開始します。", interval)
+	for {
+		m.checkAll(cfg)
+		time.Sleep(interval)
+	}
+}
+
+// checkAll はすべてのプリンターの状態を1回確認します。
+func (m *healthMonitor) checkAll(cfg *Config) {
+	// スプーラーのプリンターは1回のPowerShell呼び出しでまとめて取得します。
+	spooler, err := spoolerPrinterStates()
+	if err != nil {
+		log.Printf("警告: %v", err)
+	}
+	for name, state := range spooler {
+		m.record(printTarget{Backend: "spooler", Device: name}, state.state, state.reasons)
+	}
+
+	var wg sync.WaitGroup
+	for _, t := range monitoredNetworkDevices(cfg) {
+		wg.Add(1)
+		go func(t printTarget) {
+			defer wg.Done()
+			state, reasons := probeNetworkDevice(cfg, t)
+			m.record(t, state, reasons)
+			if state != healthOffline {
+				m.checkSupplies(cfg, t)
+			}
+		}(t)
+	}
+	wg.Wait()
+}
+
+// monitoredNetworkDevices はネットワークプリンターと、論理プリンターが参照するネットワークデバイスを重複なく返します。
+func monitoredNetworkDevices(cfg *Config) []printTarget {
+	seen := make(map[string]bool)
+	var result []printTarget
+	add := func(t printTarget) {
+		if t.Backend == "spooler" || t.Device == "" || seen[t.key()] {
+			return
+		}
+		seen[t.key()] = true
+		result = append(result, t)
+	}
+	for _, p := range cfg.NetworkPrinters {
+		add(resolvePrinter(cfg, p.Name))
+	}
+	for name := range cfg.Printers {
+		for _, t := range resolveCandidates(cfg, name) {
+			add(t)
+		}
+	}
+	return result
+}
+
+// record はデバイスの最新の状態を記録し、状態が変化した場合は履歴に追加します。
+func (m *healthMonitor) record(t printTarget, state string, reasons []string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	h, ok := m.devices[t.key()]
+	if !ok {
+		h = &printerHealth{Backend: t.Backend, Device: t.Device}
+		m.devices[t.key()] = h
+	}
+	if !ok || h.State != state || strings.Join(h.Reasons, ",") != strings.Join(reasons, ",") {
+		h.History = append(h.History, healthEvent{Time: now, State: state, Reasons: reasons})
+		if len(h.History) > maxHealthHistory {
+			h.History = h.History[len(h.History)-maxHealthHistory:]
+		}
+		if ok {
+			log.Printf("プリンター '%s' の状態が %s から %s に変化しました %v", t.Device, h.State, state, reasons)
+		}
+	}
+	h.State = state
+	h.Reasons = reasons
+	h.CheckedAt = now
+}
+
+// checkSupplies はSNMPが設定されたデバイスの消耗品を取得して記録し、残量が少ないものを通知します。
+func (m *healthMonitor) checkSupplies(cfg *Config, t printTarget) {
+	community := snmpCommunity(cfg, t.Device)
+	if community == "" {
+		return
+	}
+	address, err := networkPrinterAddress(t.Device)
+	if err != nil {
+		return
+	}
+	supplies, err := snmpPrinterSupplies(address, community)
+	if err != nil {
+		log.Printf("警告: SNMPでプリンター '%s' の消耗品を取得できませんでした: %v", t.Device, err)
+		return
+	}
+
+	m.mu.Lock()
+	if h, ok := m.devices[t.key()]; ok {
+		h.Supplies = supplies
+	}
+	m.mu.Unlock()
+
+	supplyAlerts.check(cfg, t.Device, supplies)
+}
+
+// all はすべてのデバイスの状態のコピーをデバイス名順に返します。
+func (m *healthMonitor) all() []printerHealth {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	result := make([]printerHealth, 0, len(m.devices))
+	for _, h := range m.devices {
+		result = append(result, *h)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Device < result[j].Device })
+	return result
+}
+
+// get はデバイスの状態のコピーを返します。まだ確認していない場合は unknown を返します。
+func (m *healthMonitor) get(t printTarget) printerHealth {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	h, ok := m.devices[t.key()]
+	if !ok {
+		return printerHealth{Backend: t.Backend, Device: t.Device, State: healthUnknown}
+	}
+	c := *h
+	c.History = append([]healthEvent(nil), h.History...)
+	return c
+}
+
+// isDown はデバイスが停止中 (offline または error) と分かっているかどうかを返します。
+func (m *healthMonitor) isDown(key string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	h, ok := m.devices[key]
+	return ok && (h.State == healthOffline || h.State == healthError)
+}
+
+// spoolerState はスプーラーのプリンター1台分の状態です。
+type spoolerState struct {
+	state   string
+	reasons []string
+}
+
+// win32DetectedErrorStates は Win32_Printer.DetectedErrorState の値と理由の対応表です。
+// error が true のものは印刷できない状態を表します。
+var win32DetectedErrorStates = map[int]struct {
+	reason string
+	error  bool
+}{
+	3:  {"paper-low", false},
+	4:  {"paper-out", true},
+	5:  {"toner-low", false},
+	6:  {"toner-empty", true},
+	7:  {"door-open", true},
+	8:  {"paper-jam", true},
+	9:  {"offline", true},
+	10: {"service-requested", true},
+	11: {"output-bin-full", true},
+}
+
+// spoolerPrinterStates はスプーラーのプリンターの状態を取得します。
+func spoolerPrinterStates() (map[string]spoolerState, error) {
+	printers, err := querySpoolerPrinters()
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string]spoolerState, len(printers))
+	for _, p := range printers {
+		s := spoolerState{state: healthOnline}
+		if p.WorkOffline || p.PrinterStatus == win32PrinterStatusOffline {
+			s.state = healthOffline
+			s.reasons = append(s.reasons, "offline")
+		}
+		if e, ok := win32DetectedErrorStates[p.DetectedErrorState]; ok {
+			if e.error && s.state == healthOnline {
+				s.state = healthError
+			}
+			s.reasons = appendUnique(s.reasons, e.reason)
+		}
+		result[p.Name] = s
+	}
+	return result, nil
+}
+
+// probeNetworkDevice はネットワークデバイスの状態をTCP接続、IPP、SNMPの順に確認します。
+func probeNetworkDevice(cfg *Config, t printTarget) (string, []string) {
+	address := t.Device
+	if strings.Contains(address, "://") {
+		var err error
+		if address, err = networkPrinterAddress(address); err != nil {
+			return healthUnknown, []string{err.Error()}
+		}
+	}
+	if err := probeTCP(address, 3*time.Second); err != nil {
+		return healthOffline, []string{"unreachable"}
+	}
+
+	state, reasons := healthOnline, []string(nil)
+	if t.Backend == "ipp" {
+		if s, r, err := ippPrinterState(t.Device); err != nil {
+			log.Printf("警告: IPPでプリンター '%s' の状態を取得できませんでした: %v", t.Device, err)
+		} else {
+			state, reasons = s, r
+		}
+	}
+	if community := snmpCommunity(cfg, t.Device); community != "" {
+		if s, r, err := snmpPrinterState(address, community); err != nil {
+			log.Printf("警告: SNMPでプリンター '%s' の状態を取得できませんでした: %v", t.Device, err)
+		} else {
+			if state == healthOnline {
+				state = s
+			}
+			reasons = appendUnique(reasons, r...)
+		}
+	}
+	return state, reasons
+}
+
+// ippPrinterState はGet-Printer-Attributesでprinter-stateとprinter-state-reasonsを取得します。
+func ippPrinterState(printerURI string) (string, []string, error) {
+	req := newIPPRequest(ippOpGetPrinterAttributes, printerURI)
+	req.addAttr(ippTagOperation, ippAttr{
+		Name:   "requested-attributes",
+		Tag:    ippTagKeyword,
+		Values: []interface{}{"printer-state", "printer-state-reasons"},
+	})
+	res, err := sendIPP(printerURI, req, nil, 10*time.Second)
+	if err != nil {
+		return "", nil, err
+	}
+
+	state := healthOnline
+	if a, ok := res.attr("printer-state"); ok && len(a.Values) > 0 && a.Values[0] == 5 { // 5: stopped
+		state = healthError
+	}
+	var reasons []string
+	if a, ok := res.attr("printer-state-reasons"); ok {
+		for _, v := range a.Values {
+			reason := fmt.Sprint(v)
+			if reason == "none" {
+				continue
+			}
+			reasons = append(reasons, reason)
+			if strings.HasSuffix(reason, "-error") {
+				state = healthError
+			}
+			if reason == "offline" || reason == "offline-report" {
+				state = healthOffline
+			}
+		}
+	}
+	return state, reasons, nil
+}
+
+// appendUnique は重複しない値だけを追加します。
+func appendUnique(list []string, values ...string) []string {
+	for _, v := range values {
+		found := false
+		for _, l := range list {
+			if l == v {
+				found = true
+				break
+			}
+		}
+		if !found {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+// waitForHealthyPrinter は印刷前に候補のプリンターの状態を確認します。
+// すべての候補が停止中と分かっている場合、設定に応じてすぐに失敗させるか、復旧するまでジョブを保留します。
+func waitForHealthyPrinter(cfg *Config, jobID string, candidates []printTarget) error {
+	policy := cfg.Health.DownPolicy
+	if policy == "ignore" {
+		return nil
+	}
+	holdTimeout := time.Duration(cfg.Health.HoldTimeoutSeconds) * time.Second
+	if holdTimeout <= 0 {
+		holdTimeout = 10 * time.Minute
+	}
+
+	deadline := time.Now().Add(holdTimeout)
+	for {
+		var reasons []string
+		for _, c := range candidates {
+			if !printerHealthMonitor.isDown(c.key()) {
+				return nil
+			}
+			h := printerHealthMonitor.get(c)
+			reasons = append(reasons, fmt.Sprintf("%s: %s %v", c.Device, h.State, h.Reasons))
+		}
+		downErr := fmt.Errorf("プリンターが停止中です (%s)", strings.Join(reasons, "; "))
+		if policy != "hold" {
+			return downErr
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("保留時間 %v を過ぎてもプリンターが復旧しませんでした: %w", holdTimeout, downErr)
+		}
+		jobs.update(jobID, func(job *printJob) {
+			job.Status = jobHeld
+			job.Error = downErr.Error()
+		})
+		time.Sleep(5 * time.Second)
+	}
+}
+
+// printerStatusResponse は GET /printers/{name}/status のレスポンスです。
+type printerStatusResponse struct {
+	Name    string          `json:"name"`
+	State   string          `json:"state"`
+	Devices []printerHealth `json:"devices"`
+}
+
+// printerStatusHandler は GET /printers/{name}/status のリクエストを処理します。
+// プールの場合はメンバーごとの状態を返し、いずれかのメンバーがオンラインであれば全体をオンラインとします。
+// 設定にもスプーラーにもないプリンター名は、名前の誤りに気付けるよう 404 Not Found にします。
+func printerStatusHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if !requireKnownPrinter(w, name) {
+		return
+	}
+	candidates := resolveCandidates(appConfig, name)
+
+	res := printerStatusResponse{Name: name, State: healthUnknown}
+	for _, c := range candidates {
+		h := printerHealthMonitor.get(c)
+		res.Devices = append(res.Devices, h)
+		switch {
+		case h.State == healthOnline:
+			res.State = healthOnline
+		case res.State == healthUnknown && h.State != healthUnknown:
+			res.State = h.State
+		}
+	}
+	writeJSON(w, http.StatusOK, res)
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	_ "image/gif" // GIFのデコーダーを登録します (PNG、JPEG、TIFFは pdfcpu が登録しています)。
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/pdfcpu/pdfcpu/pkg/api"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/model"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/types"
+)
+
+// imageSignatures は画像の種類ごとのファイルの先頭のシグネチャです。
+var imageSignatures = []struct {
+	Format string
+	Magic  []byte
+}{
+	{"png", []byte("\x89PNG\r\n\x1a\n")},
+	{"jpeg", []byte("\xff\xd8\xff")},
+	{"gif", []byte("GIF8")},
+	{"tiff", []byte("II*\x00")},
+	{"tiff", []byte("MM\x00*")},
+}
+
+// imageFormat はファイルの先頭のシグネチャから画像の種類 (png, jpeg, gif, tiff) を返します。画像でない場合は空文字列を返します。
+func imageFormat(filePath string) string {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	head := make([]byte, 8)
+	n, _ := io.ReadFull(f, head)
+	for _, sig := range imageSignatures {
+		if bytes.HasPrefix(head[:n], sig.Magic) {
+			return sig.Format
+		}
+	}
+	return ""
+}
+
+// imageLayout は画像をPDFのページに配置する設定です。
+// 印刷オプションと同じく、リクエスト、プリセット、論理プリンターの options で指定します。
+type imageLayout struct {
+	pageLayout
+	Fit string // image_fit: fit (省略時), fill, stretch, none
+}
+
+// parseImageLayout は用紙と余白、image_fit のオプションを解析します。
+func parseImageLayout(options map[string]string) (imageLayout, error) {
+	page, err := parsePageLayout(options)
+	if err != nil {
+		return imageLayout{}, err
+	}
+	l := imageLayout{pageLayout: page, Fit: "fit"}
+	if v, ok := options["image_fit"]; ok {
+		switch strings.ToLower(v) {
+		case "fit", "fill", "stretch", "none":
+			l.Fit = strings.ToLower(v)
+		default:
+			return l, fmt.Errorf("image_fit '%s' は fit, fill, stretch, none のいずれかで指定してください", v)
+		}
+	}
+	return l, nil
+}
+
+// convertImageDocument は画像のドキュメントをPDFに変換し、変換後のドキュメントを返します。
+// 複数ページのTIFFは1ページずつPDFのページになります。
+func convertImageDocument(doc submittedDocument, format string, options map[string]string) (submittedDocument, error) {
+	layout, err := parseImageLayout(options)
+	if err != nil {
+		return doc, badRequest("印刷オプションが正しくありません: %v", err)
+	}
+	// 同じ名前で拡張子だけが異なる画像 (photo.png と photo.jpg など) を区別するため、元の拡張子を残します。
+	dst := doc.Path + ".pdf"
+	if err := writeImagePages(doc.Path, dst, layout); err != nil {
+		return doc, &submissionError{Status: http.StatusUnprocessableEntity, Err: fmt.Errorf("画像 '%s' をPDFに変換できませんでした: %w", doc.Name, err)}
+	}
+	os.Remove(doc.Path)
+	log.Printf("画像 '%s' (%s) をPDFに変換しました: %s", doc.Name, format, dst)
+	return submittedDocument{Name: doc.Name, Path: dst}, nil
+}
+
+// writeImagePages は画像の各フレームを layout の用紙に配置したPDFを作成します。
+func writeImagePages(src, dst string, layout imageLayout) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("画像を開けませんでした: %w", err)
+	}
+	defer f.Close()
+
+	conf := pdfConfig()
+	conf.Cmd = model.IMPORTIMAGES
+	ctx, err := pdfcpu.CreateContextWithXRefTable(conf, types.PaperSize["A4"])
+	if err != nil {
+		return err
+	}
+	pagesIndRef, err := ctx.Pages()
+	if err != nil {
+		return err
+	}
+	pagesDict, err := ctx.DereferenceDict(*pagesIndRef)
+	if err != nil {
+		return err
+	}
+
+	images, err := model.CreateImageResources(ctx.XRefTable, f, false, false)
+	if err != nil {
+		return fmt.Errorf("画像のデコードに失敗しました: %w", err)
+	}
+	for _, img := range images {
+		indRef, err := newImagePage(ctx, *pagesIndRef, img, layout)
+		if err != nil {
+			return err
+		}
+		if err := ctx.SetValid(*indRef); err != nil {
+			return err
+		}
+		if err := model.AppendPageTree(indRef, 1, pagesDict); err != nil {
+			return err
+		}
+		ctx.PageCount++
+	}
+
+	if err := api.WriteContextFile(ctx, dst); err != nil {
+		return fmt.Errorf("変換したPDFの保存に失敗しました: %w", err)
+	}
+	return nil
+}
+
+// newImagePage は画像を1つ配置したページを作成します。
+func newImagePage(ctx *model.Context, parent types.IndirectRef, img model.ImageResource, layout imageLayout) (*types.IndirectRef, error) {
+	// 用紙の向きは、指定がなければ画像の縦横に合わせます。
+	pw, ph := layout.pageSize(img.Width > img.Height)
+
+	// 余白の内側 (印刷領域) に画像を配置します。
+	margin := layout.Margin * pointsPerMM
+	aw, ah := pw-2*margin, ph-2*margin
+	iw, ih := float64(img.Width), float64(img.Height)
+	var w, h float64
+	switch layout.Fit {
+	case "fill":
+		scale := math.Max(aw/iw, ah/ih)
+		w, h = iw*scale, ih*scale
+	case "stretch":
+		w, h = aw, ah
+	case "none":
+		// 1ピクセルを1ポイント (72dpi) として原寸で配置します。
+		w, h = iw, ih
+	default:
+		scale := math.Min(aw/iw, ah/ih)
+		w, h = iw*scale, ih*scale
+	}
+
+	// 印刷領域からはみ出す部分は余白に描画しないよう切り取ります。
+	var content bytes.Buffer
+	fmt.Fprintf(&content, "q %.5f %.5f %.5f %.5f re W n ", margin, margin, aw, ah)
+	fmt.Fprintf(&content, "%.5f 0 0 %.5f %.5f %.5f cm /%s Do Q", w, h, (pw-w)/2, (ph-h)/2, img.Res.ID)
+
+	sd, err := ctx.NewStreamDictForBuf(content.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	if err := sd.Encode(); err != nil {
+		return nil, err
+	}
+	contents, err := ctx.IndRefForNewObject(*sd)
+	if err != nil {
+		return nil, err
+	}
+	resources := types.Dict(map[string]types.Object{
+		"ProcSet": types.NewNameArray("PDF", "ImageB", "ImageC", "ImageI"),
+		"XObject": types.Dict(map[string]types.Object{img.Res.ID: *img.Res.IndRef}),
+	})
+	page := types.Dict(map[string]types.Object{
+		"Type":      types.Name("Page"),
+		"Parent":    parent,
+		"MediaBox":  types.RectForDim(pw, ph).Array(),
+		"Resources": resources,
+		"Contents":  *contents,
+	})
+	return ctx.IndRefForNewObject(page)
+}
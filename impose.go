@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/pdfcpu/pdfcpu/pkg/api"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/model"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/types"
+)
+
+// ドライバーのN-up (割り付け) はプリンターの機種によって並び順や余白が異なるため、
+// 送信する前にPDF自体を面付けして、どのプリンターでも同じ結果になるようにします。
+
+// nupOrders は nup_order の値と pdfcpu の並び順の対応です。
+var nupOrders = map[string]string{
+	"right-down": "rd", // 左上から右へ、次の行へ (省略時)
+	"down-right": "dr", // 左上から下へ、次の列へ
+	"left-down":  "ld", // 右上から左へ、次の行へ
+	"down-left":  "dl", // 右上から下へ、次の列へ
+}
+
+// imposition は1枚の用紙に複数のページを並べる面付けの指定です。
+type imposition struct {
+	NUp     int    // nup: 1枚 (片面) に並べるページ数 (1 (省略時), 2, 4, 6, 9)
+	Order   string // nup_order: right-down (省略時), down-right, left-down, down-left
+	Border  bool   // nup_border: 各ページの周囲に枠線を引くかどうか (省略時は false)
+	Booklet bool   // booklet: 中綴じの冊子になるように、1枚 (片面) に2ページずつ並べ替えるかどうか (省略時は false)
+}
+
+// parseImposition は nup と booklet のオプションを解析します。どちらも指定されていない場合は ok が false です。
+func parseImposition(options map[string]string) (im imposition, ok bool, err error) {
+	im = imposition{NUp: 1, Order: "right-down"}
+	if v, ok := options["nup"]; ok {
+		n, err := strconv.Atoi(v)
+		if err != nil || (n != 1 && n != 2 && n != 4 && n != 6 && n != 9) {
+			return im, false, fmt.Errorf("nup '%s' は 1, 2, 4, 6, 9 のいずれかで指定してください", v)
+		}
+		im.NUp = n
+	}
+	if v, ok := options["nup_order"]; ok {
+		if _, known := nupOrders[strings.ToLower(v)]; !known {
+			return im, false, fmt.Errorf("nup_order '%s' は right-down, down-right, left-down, down-left のいずれかで指定してください", v)
+		}
+		im.Order = strings.ToLower(v)
+	}
+	if v, ok := options["nup_border"]; ok {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return im, false, fmt.Errorf("nup_border '%s' は true または false で指定してください", v)
+		}
+		im.Border = b
+	}
+	if v, ok := options["booklet"]; ok {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return im, false, fmt.Errorf("booklet '%s' は true または false で指定してください", v)
+		}
+		im.Booklet = b
+	}
+	if im.Booklet && im.NUp > 1 {
+		return im, false, fmt.Errorf("nup と booklet は同時に指定できません")
+	}
+	return im, im.NUp > 1 || im.Booklet, nil
+}
+
+// sheetCount は pageCount ページを面付けした後のページ数 (用紙の片面の数) を返します。
+// 冊子はページ数が4の倍数になるように白紙を追加します。
+func (im imposition) sheetCount(pageCount int) int {
+	if im.Booklet {
+		return (pageCount + 3) / 4 * 2
+	}
+	return (pageCount + im.NUp - 1) / im.NUp
+}
+
+// sheetSize は面付けする用紙の大きさ (ポイント) を返します。
+// media が指定されている場合はその用紙、そうでない場合は最初のページと同じ大きさの用紙に面付けします。
+// N-upの用紙の向きは、並べたページを回転せずに済む向きにします。
+func (im imposition) sheetSize(documentPath string, media string) (w, h float64, err error) {
+	if media != "" && !strings.EqualFold(media, mediaAuto) {
+		m, err := parseMediaSize(media)
+		if err != nil {
+			return 0, 0, err
+		}
+		w, h = m.Width*pointsPerMM, m.Height*pointsPerMM
+	} else {
+		ctx, err := api.ReadContextFile(documentPath)
+		if err != nil {
+			return 0, 0, fmt.Errorf("PDFの解析に失敗しました: %w", err)
+		}
+		dims, err := ctx.PageDims()
+		if err != nil || len(dims) == 0 {
+			return 0, 0, fmt.Errorf("ページの大きさを取得できませんでした: %v", err)
+		}
+		w, h = dims[0].Width, dims[0].Height
+		if w > h {
+			// ページが横向きの場合は、ページを縦向きにしたときの用紙を基準にします。
+			w, h = h, w
+		}
+	}
+	// 2面と6面は用紙を横向き (縦向きのページを左右に並べる) に、4面と9面は縦向きにします。
+	// 冊子は縦向きの用紙の上下に、90度回転したページを並べます (長辺とじの両面印刷で中綴じになります)。
+	if im.NUp == 2 || im.NUp == 6 {
+		w, h = h, w
+	}
+	return w, h, nil
+}
+
+// description は pdfcpu の面付けの指定 ("dimensions:595 842, orientation:rd, ..." の形式) を返します。
+func (im imposition) description(w, h float64) string {
+	parts := []string{fmt.Sprintf("dimensions:%.2f %.2f", w, h)}
+	if !im.Booklet {
+		parts = append(parts, "orientation:"+nupOrders[im.Order], "margin:0")
+	}
+	parts = append(parts, fmt.Sprintf("border:%t", im.Border))
+	return strings.Join(parts, ", ")
+}
+
+// applyImposition は面付けした新しいPDFを作成し、そのパスを返します。面付けが指定されていない場合は元のパスを返します。
+// ページ範囲は面付けする前のページに適用し、面付けしたPDFには含まれたページだけが残ります。
+func applyImposition(documentPath string, options map[string]string) (string, error) {
+	im, ok, err := parseImposition(options)
+	if err != nil || !ok {
+		return documentPath, err
+	}
+	opts, err := parsePrintOptions(options, 0)
+	if err != nil {
+		return "", err
+	}
+	w, h, err := im.sheetSize(documentPath, opts.Media)
+	if err != nil {
+		return "", err
+	}
+	conf := pdfConfig()
+	conf.Unit = types.POINTS
+	var pages []string
+	if opts.Pages != "" {
+		pages = strings.Split(opts.Pages, ",")
+	}
+
+	dst := derivedPath(documentPath, "imposed")
+	var nup *model.NUp
+	if im.Booklet {
+		if nup, err = api.PDFBookletConfig(2, im.description(w, h), conf); err != nil {
+			return "", fmt.Errorf("冊子の面付けの指定が正しくありません: %w", err)
+		}
+		err = api.BookletFile([]string{documentPath}, dst, pages, nup, conf)
+	} else {
+		if nup, err = api.PDFNUpConfig(im.NUp, im.description(w, h), conf); err != nil {
+			return "", fmt.Errorf("N-upの指定が正しくありません: %w", err)
+		}
+		err = api.NUpFile([]string{documentPath}, dst, pages, nup, conf)
+	}
+	if err != nil {
+		return "", fmt.Errorf("ページの面付けに失敗しました: %w", err)
+	}
+	return dst, nil
+}
+
+// imposedOptions は面付けしたPDFをバックエンドに渡すときの印刷オプションを返します。
+// ページ範囲は面付けで反映済みのため取り除き、冊子で両面の指定がない場合は長辺とじの両面印刷にします。
+func imposedOptions(options map[string]string) map[string]string {
+	im, ok, err := parseImposition(options)
+	if err != nil || !ok {
+		return options
+	}
+	imposed := mergeOptions(options, nil)
+	delete(imposed, "pages")
+	if _, set := imposed["duplex"]; im.Booklet && !set {
+		imposed["duplex"] = "long-edge"
+	}
+	return imposed
+}
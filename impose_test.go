@@ -0,0 +1,154 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseImposition(t *testing.T) {
+	tests := []struct {
+		name    string
+		options map[string]string
+		want    imposition
+		ok      bool
+		wantErr bool
+	}{
+		{"指定なし", map[string]string{"copies": "2"}, imposition{NUp: 1, Order: "right-down"}, false, false},
+		{"1面", map[string]string{"nup": "1"}, imposition{NUp: 1, Order: "right-down"}, false, false},
+		{"4面", map[string]string{"nup": "4"}, imposition{NUp: 4, Order: "right-down"}, true, false},
+		{"並び順と枠線", map[string]string{"nup": "6", "nup_order": "Down-Left", "nup_border": "true"}, imposition{NUp: 6, Order: "down-left", Border: true}, true, false},
+		{"冊子", map[string]string{"booklet": "true"}, imposition{NUp: 1, Order: "right-down", Booklet: true}, true, false},
+		{"冊子にしない", map[string]string{"booklet": "false"}, imposition{NUp: 1, Order: "right-down"}, false, false},
+		{"対応していない面数", map[string]string{"nup": "3"}, imposition{}, false, true},
+		{"数値でない面数", map[string]string{"nup": "two"}, imposition{}, false, true},
+		{"不明な並び順", map[string]string{"nup": "2", "nup_order": "up-right"}, imposition{}, false, true},
+		{"真偽値でない枠線", map[string]string{"nup": "2", "nup_border": "yes"}, imposition{}, false, true},
+		{"真偽値でない冊子", map[string]string{"booklet": "1x"}, imposition{}, false, true},
+		{"N-upと冊子", map[string]string{"nup": "2", "booklet": "true"}, imposition{}, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			im, ok, err := parseImposition(tt.options)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("parseImposition(%v) = %+v; want error", tt.options, im)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseImposition(%v): %v", tt.options, err)
+			}
+			if im != tt.want || ok != tt.ok {
+				t.Errorf("parseImposition(%v) = %+v, %t; want %+v, %t", tt.options, im, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func TestImpositionDescription(t *testing.T) {
+	nup := imposition{NUp: 4, Order: "down-right", Border: true}.description(595, 842)
+	if want := "dimensions:595.00 842.00, orientation:dr, margin:0, border:true"; nup != want {
+		t.Errorf("description() = %q; want %q", nup, want)
+	}
+	booklet := imposition{NUp: 1, Booklet: true}.description(595, 842)
+	if strings.Contains(booklet, "orientation") {
+		t.Errorf("description() = %q; booklets must not set orientation", booklet)
+	}
+}
+
+func TestImpositionSheetCount(t *testing.T) {
+	tests := []struct {
+		im        imposition
+		pageCount int
+		want      int
+	}{
+		{imposition{NUp: 2}, 1, 1},
+		{imposition{NUp: 2}, 5, 3},
+		{imposition{NUp: 4}, 8, 2},
+		{imposition{NUp: 9}, 10, 2},
+		{imposition{NUp: 1, Booklet: true}, 1, 2},
+		{imposition{NUp: 1, Booklet: true}, 4, 2},
+		{imposition{NUp: 1, Booklet: true}, 5, 4},
+		{imposition{NUp: 1, Booklet: true}, 12, 6},
+	}
+	for _, tt := range tests {
+		if got := tt.im.sheetCount(tt.pageCount); got != tt.want {
+			t.Errorf("%+v.sheetCount(%d) = %d; want %d", tt.im, tt.pageCount, got, tt.want)
+		}
+	}
+}
+
+func TestImposedOptions(t *testing.T) {
+	tests := []struct {
+		name    string
+		options map[string]string
+		want    map[string]string
+	}{
+		{"面付けなし", map[string]string{"pages": "1-2"}, map[string]string{"pages": "1-2"}},
+		{"N-upはページ範囲を取り除く", map[string]string{"nup": "2", "pages": "1-2"}, map[string]string{"nup": "2"}},
+		{"冊子は長辺とじの両面", map[string]string{"booklet": "true"}, map[string]string{"booklet": "true", "duplex": "long-edge"}},
+		{"冊子の両面の指定を優先", map[string]string{"booklet": "true", "duplex": "short-edge"}, map[string]string{"booklet": "true", "duplex": "short-edge"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := imposedOptions(tt.options); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("imposedOptions(%v) = %v; want %v", tt.options, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestImposedOptionsSpooler(t *testing.T) {
+	// スプーラーでも冊子は長辺とじの両面として SumatraPDF に渡します。
+	opts, err := parsePrintOptions(imposedOptions(map[string]string{"booklet": "true"}), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings, err := spoolerPrintSettings(opts)
+	if err != nil || !strings.Contains(settings, "duplexlong") {
+		t.Errorf("spoolerPrintSettings() = %q, %v; want duplexlong", settings, err)
+	}
+}
+
+func TestApplyImposition(t *testing.T) {
+	t.Run("指定なし", func(t *testing.T) {
+		src := writeTestPDF(t, "plain.pdf", 2)
+		got, err := applyImposition(src, map[string]string{"nup": "1"})
+		if err != nil || got != src {
+			t.Errorf("applyImposition() = %q, %v; want %q", got, err, src)
+		}
+	})
+
+	for _, tt := range []struct {
+		name      string
+		options   map[string]string
+		pageCount int
+		want      [][2]int // 面付けした後のページごとの幅と高さ (ポイント)
+	}{
+		{"2面は横向きの用紙", map[string]string{"nup": "2"}, 5, [][2]int{{842, 595}, {842, 595}, {842, 595}}},
+		{"4面は縦向きの用紙", map[string]string{"nup": "4"}, 5, [][2]int{{595, 842}, {595, 842}}},
+		{"ページ範囲を面付けする", map[string]string{"nup": "4", "pages": "2-5"}, 5, [][2]int{{595, 842}}},
+		{"用紙を指定した2面", map[string]string{"nup": "2", "media": "A5"}, 2, [][2]int{{595, 420}}},
+		{"冊子は4の倍数のページ", map[string]string{"booklet": "true"}, 5, [][2]int{{595, 842}, {595, 842}, {595, 842}, {595, 842}}},
+		{"4ページの冊子", map[string]string{"booklet": "true"}, 4, [][2]int{{595, 842}, {595, 842}}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			src := writeTestPDF(t, "invoice.pdf", tt.pageCount)
+			dst, err := applyImposition(src, tt.options)
+			if err != nil {
+				t.Fatalf("applyImposition: %v", err)
+			}
+			ctx := readTestPDF(t, dst)
+			if got := testPageSizes(t, ctx); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("page sizes = %v; want %v", got, tt.want)
+			}
+			// 面付けした各ページには、元のページをフォームとして並べます。
+			for pageNr := 1; pageNr <= ctx.PageCount; pageNr++ {
+				if content := testPageContent(t, ctx, pageNr); !strings.Contains(content, "Do") {
+					t.Errorf("%dページ目に元のページが配置されていません: %q", pageNr, content)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,412 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// IPP (RFC 8010/8011) のうち、このサービスで必要な最小限のエンコード・デコードを実装します。
+
+// IPPのオペレーションID
+const (
+	ippOpPrintJob             uint16 = 0x0002
+	ippOpGetPrinterAttributes uint16 = 0x000B
+)
+
+// IPPの区切りタグと値タグ
+const (
+	ippTagOperation     byte = 0x01
+	ippTagJob           byte = 0x02
+	ippTagEnd           byte = 0x03
+	ippTagPrinter       byte = 0x04
+	ippTagUnsupported   byte = 0x05
+	ippTagInteger       byte = 0x21
+	ippTagBoolean       byte = 0x22
+	ippTagEnum          byte = 0x23
+	ippTagOctetString   byte = 0x30
+	ippTagDateTime      byte = 0x31
+	ippTagResolution    byte = 0x32
+	ippTagRange         byte = 0x33
+	ippTagBegCollection byte = 0x34
+	ippTagEndCollection byte = 0x37
+	ippTagText          byte = 0x41
+	ippTagName          byte = 0x42
+	ippTagKeyword       byte = 0x44
+	ippTagURI           byte = 0x45
+	ippTagCharset       byte = 0x47
+	ippTagLanguage      byte = 0x48
+	ippTagMimeType      byte = 0x49
+	ippTagMemberName    byte = 0x4A
+)
+
+// ippRange は rangeOfInteger 型の値です。
+type ippRange struct {
+	Lower, Upper int
+}
+
+// ippResolution は resolution 型の値です。Units は 3 が dpi、4 が dpcm です。
+type ippResolution struct {
+	X, Y  int
+	Units byte
+}
+
+// ippAttr はIPPの属性1つを表します。
+// Values の要素は string, int, bool, ippRange, ippResolution, []ippAttr (collection) のいずれかです。
+type ippAttr struct {
+	Name   string
+	Tag    byte
+	Values []interface{}
+}
+
+// ippGroup は区切りタグで始まる属性グループです。
+type ippGroup struct {
+	Tag   byte
+	Attrs []ippAttr
+}
+
+// ippMessage はIPPのリクエストまたはレスポンスです。
+// リクエストでは Code がオペレーションID、レスポンスではステータスコードになります。
+type ippMessage struct {
+	Code      uint16
+	RequestID uint32
+	Groups    []ippGroup
+}
+
+// newIPPRequest は必須のオペレーション属性を設定したリクエストを作成します。
+func newIPPRequest(op uint16, printerURI string) *ippMessage {
+	return &ippMessage{
+		Code:      op,
+		RequestID: uint32(time.Now().UnixNano() & 0x7fffffff),
+		Groups: []ippGroup{{
+			Tag: ippTagOperation,
+			Attrs: []ippAttr{
+				{Name: "attributes-charset", Tag: ippTagCharset, Values: []interface{}{"utf-8"}},
+				{Name: "attributes-natural-language", Tag: ippTagLanguage, Values: []interface{}{"ja-jp"}},
+				{Name: "printer-uri", Tag: ippTagURI, Values: []interface{}{printerURI}},
+			},
+		}},
+	}
+}
+
+// addAttr は指定されたグループに属性を追加します。グループが存在しない場合は作成します。
+func (m *ippMessage) addAttr(groupTag byte, attr ippAttr) {
+	for i := range m.Groups {
+		if m.Groups[i].Tag == groupTag {
+			m.Groups[i].Attrs = append(m.Groups[i].Attrs, attr)
+			return
+		}
+	}
+	m.Groups = append(m.Groups, ippGroup{Tag: groupTag, Attrs: []ippAttr{attr}})
+}
+
+// attr はすべてのグループから指定された名前の属性を探します。
+func (m *ippMessage) attr(name string) (ippAttr, bool) {
+	for _, g := range m.Groups {
+		for _, a := range g.Attrs {
+			if a.Name == name {
+				return a, true
+			}
+		}
+	}
+	return ippAttr{}, false
+}
+
+// encode はメッセージをIPPのバイナリ形式に変換します。
+func (m *ippMessage) encode() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.Write([]byte{0x02, 0x00}) // IPP/2.0
+	binary.Write(&buf, binary.BigEndian, m.Code)
+	binary.Write(&buf, binary.BigEndian, m.RequestID)
+	for _, g := range m.Groups {
+		buf.WriteByte(g.Tag)
+		for _, a := range g.Attrs {
+			if err := encodeIPPAttr(&buf, a.Name, a); err != nil {
+				return nil, err
+			}
+		}
+	}
+	buf.WriteByte(ippTagEnd)
+	return buf.Bytes(), nil
+}
+
+// encodeIPPAttr は属性を書き込みます。2つ目以降の値は名前を空にして書き込みます。
+func encodeIPPAttr(buf *bytes.Buffer, name string, a ippAttr) error {
+	for i, v := range a.Values {
+		if i > 0 {
+			name = ""
+		}
+		if a.Tag == ippTagBegCollection {
+			members, ok := v.([]ippAttr)
+			if !ok {
+				return fmt.Errorf("IPP属性 '%s' の値がcollectionではありません", a.Name)
+			}
+			writeIPPValue(buf, ippTagBegCollection, name, nil)
+			for _, member := range members {
+				writeIPPValue(buf, ippTagMemberName, "", []byte(member.Name))
+				if err := encodeIPPAttr(buf, "", member); err != nil {
+					return err
+				}
+			}
+			writeIPPValue(buf, ippTagEndCollection, "", nil)
+			continue
+		}
+		data, err := encodeIPPValue(a.Tag, v)
+		if err != nil {
+			return fmt.Errorf("IPP属性 '%s' のエンコードに失敗しました: %w", a.Name, err)
+		}
+		writeIPPValue(buf, a.Tag, name, data)
+	}
+	return nil
+}
+
+func writeIPPValue(buf *bytes.Buffer, tag byte, name string, data []byte) {
+	buf.WriteByte(tag)
+	binary.Write(buf, binary.BigEndian, uint16(len(name)))
+	buf.WriteString(name)
+	binary.Write(buf, binary.BigEndian, uint16(len(data)))
+	buf.Write(data)
+}
+
+func encodeIPPValue(tag byte, v interface{}) ([]byte, error) {
+	switch val := v.(type) {
+	case string:
+		return []byte(val), nil
+	case int:
+		data := make([]byte, 4)
+		binary.BigEndian.PutUint32(data, uint32(int32(val)))
+		return data, nil
+	case bool:
+		if val {
+			return []byte{1}, nil
+		}
+		return []byte{0}, nil
+	case ippRange:
+		data := make([]byte, 8)
+		binary.BigEndian.PutUint32(data[0:], uint32(int32(val.Lower)))
+		binary.BigEndian.PutUint32(data[4:], uint32(int32(val.Upper)))
+		return data, nil
+	case ippResolution:
+		data := make([]byte, 9)
+		binary.BigEndian.PutUint32(data[0:], uint32(int32(val.X)))
+		binary.BigEndian.PutUint32(data[4:], uint32(int32(val.Y)))
+		data[8] = val.Units
+		return data, nil
+	}
+	return nil, fmt.Errorf("サポートされていない値の型です (tag 0x%02x): %T", tag, v)
+}
+
+// decodeIPPMessage はIPPのバイナリ形式を解析します。
+func decodeIPPMessage(data []byte) (*ippMessage, error) {
+	if len(data) < 8 {
+		return nil, errors.New("IPPメッセージが短すぎます")
+	}
+	m := &ippMessage{
+		Code:      binary.BigEndian.Uint16(data[2:4]),
+		RequestID: binary.BigEndian.Uint32(data[4:8]),
+	}
+	r := bytes.NewReader(data[8:])
+	var group *ippGroup
+	for {
+		tag, err := r.ReadByte()
+		if err != nil {
+			return nil, errors.New("IPPメッセージが途中で終了しています")
+		}
+		if tag == ippTagEnd {
+			return m, nil
+		}
+		if tag < 0x10 {
+			m.Groups = append(m.Groups, ippGroup{Tag: tag})
+			group = &m.Groups[len(m.Groups)-1]
+			continue
+		}
+		if group == nil {
+			return nil, errors.New("IPPメッセージに属性グループがありません")
+		}
+		name, value, err := readIPPValue(r, tag)
+		if err != nil {
+			return nil, err
+		}
+		if name == "" && len(group.Attrs) > 0 {
+			last := &group.Attrs[len(group.Attrs)-1]
+			last.Values = append(last.Values, value)
+			continue
+		}
+		group.Attrs = append(group.Attrs, ippAttr{Name: name, Tag: tag, Values: []interface{}{value}})
+	}
+}
+
+// readIPPValue はタグの後に続く名前と値を読み取ります。collectionの場合はメンバーを再帰的に読み取ります。
+func readIPPValue(r *bytes.Reader, tag byte) (string, interface{}, error) {
+	name, err := readIPPBytes(r)
+	if err != nil {
+		return "", nil, err
+	}
+	data, err := readIPPBytes(r)
+	if err != nil {
+		return "", nil, err
+	}
+	if tag == ippTagBegCollection {
+		members, err := readIPPCollection(r)
+		return string(name), members, err
+	}
+	return string(name), decodeIPPValue(tag, data), nil
+}
+
+func readIPPCollection(r *bytes.Reader) ([]ippAttr, error) {
+	var members []ippAttr
+	for {
+		tag, err := r.ReadByte()
+		if err != nil {
+			return nil, errors.New("IPPのcollectionが途中で終了しています")
+		}
+		_, value, err := readIPPValue(r, tag)
+		if err != nil {
+			return nil, err
+		}
+		switch tag {
+		case ippTagEndCollection:
+			return members, nil
+		case ippTagMemberName:
+			name, _ := value.(string)
+			members = append(members, ippAttr{Name: name})
+		default:
+			if len(members) == 0 {
+				return nil, errors.New("IPPのcollectionにメンバー名がありません")
+			}
+			last := &members[len(members)-1]
+			last.Tag = tag
+			last.Values = append(last.Values, value)
+		}
+	}
+}
+
+func readIPPBytes(r *bytes.Reader) ([]byte, error) {
+	var length uint16
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return nil, errors.New("IPPメッセージが途中で終了しています")
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, errors.New("IPPメッセージが途中で終了しています")
+	}
+	return data, nil
+}
+
+func decodeIPPValue(tag byte, data []byte) interface{} {
+	switch tag {
+	case ippTagInteger, ippTagEnum:
+		if len(data) == 4 {
+			return int(int32(binary.BigEndian.Uint32(data)))
+		}
+	case ippTagBoolean:
+		return len(data) == 1 && data[0] != 0
+	case ippTagRange:
+		if len(data) == 8 {
+			return ippRange{
+				Lower: int(int32(binary.BigEndian.Uint32(data[0:]))),
+				Upper: int(int32(binary.BigEndian.Uint32(data[4:]))),
+			}
+		}
+	case ippTagResolution:
+		if len(data) == 9 {
+			return ippResolution{
+				X:     int(int32(binary.BigEndian.Uint32(data[0:]))),
+				Y:     int(int32(binary.BigEndian.Uint32(data[4:]))),
+				Units: data[8],
+			}
+		}
+	}
+	return string(data)
+}
+
+// ippHTTPURL はプリンターURI (ipp://, ipps://) をHTTPのURLに変換します。
+func ippHTTPURL(printerURI string) (string, error) {
+	u, err := url.Parse(printerURI)
+	if err != nil {
+		return "", fmt.Errorf("プリンターURI '%s' のパースに失敗しました: %w", printerURI, err)
+	}
+	switch u.Scheme {
+	case "ipp":
+		u.Scheme = "http"
+		if u.Port() == "" {
+			u.Host += ":631"
+		}
+	case "ipps":
+		// IPPS の既定のポートはHTTPSの443ではなく631です (RFC 7472)。
+		u.Scheme = "https"
+		if u.Port() == "" {
+			u.Host += ":631"
+		}
+	case "http", "https":
+	default:
+		return "", fmt.Errorf("IPPでサポートされていないスキームです: %s", u.Scheme)
+	}
+	return u.String(), nil
+}
+
+// ippStatusOK はIPPのステータスコードが成功 (successful-ok 系) かどうかを返します。
+func ippStatusOK(code uint16) bool {
+	return code < 0x0100
+}
+
+// sendIPP はリクエストを送信し、レスポンスを返します。document が nil でない場合はリクエストの後ろに続けて送信します。
+func sendIPP(printerURI string, req *ippMessage, document io.Reader, timeout time.Duration) (*ippMessage, error) {
+	endpoint, err := ippHTTPURL(printerURI)
+	if err != nil {
+		return nil, err
+	}
+	header, err := req.encode()
+	if err != nil {
+		return nil, err
+	}
+	var body io.Reader = bytes.NewReader(header)
+	if document != nil {
+		body = io.MultiReader(body, document)
+	}
+
+	httpReq, err := http.NewRequest(http.MethodPost, endpoint, body)
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/ipp")
+
+	client := &http.Client{Timeout: timeout}
+	resp, err := client.Do(httpReq)
+	if err != nil {
+		err = fmt.Errorf("IPPリクエストの送信に失敗しました: %w", err)
+		// 接続できなかった場合は、プリンターに何も送信していません。
+		var opErr *net.OpError
+		if errors.As(err, &opErr) && opErr.Op == "dial" {
+			return nil, notSent(err)
+		}
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("IPPサーバーがHTTPステータス %d を返しました", resp.StatusCode)
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("IPPレスポンスの読み込みに失敗しました: %w", err)
+	}
+	res, err := decodeIPPMessage(data)
+	if err != nil {
+		return nil, err
+	}
+	if !ippStatusOK(res.Code) {
+		msg := ""
+		if a, ok := res.attr("status-message"); ok && len(a.Values) > 0 {
+			msg = fmt.Sprint(a.Values[0])
+		}
+		return res, fmt.Errorf("IPPエラー (status 0x%04x) %s", res.Code, strings.TrimSpace(msg))
+	}
+	return res, nil
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 印刷ジョブの状態
+const (
+	jobQueued    = "queued"
+	jobHeld      = "held"
+	jobPrinting  = "printing"
+	jobCompleted = "completed"
+	jobFailed    = "failed"
+)
+
+// maxStoredJobs はメモリに保持する印刷ジョブの最大数です。超えた場合は古いものから削除します。
+const maxStoredJobs = 1000
+
+// jobAttempt は1台のプリンターへの送信の試行結果です。
+type jobAttempt struct {
+	Backend string    `json:"backend"`
+	Device  string    `json:"device"`
+	Error   string    `json:"error,omitempty"`
+	Time    time.Time `json:"time"`
+}
+
+// printJob は /print-pdf で受け付けた印刷ジョブです。
+type printJob struct {
+	ID        string       `json:"id"`
+	Printer   string       `json:"printer"`
+	Preset    string       `json:"preset,omitempty"`
+	GroupID   string       `json:"group_id,omitempty"`
+	Document  string       `json:"document"`
+	Status    string       `json:"status"`
+	Backend   string       `json:"backend,omitempty"`
+	Device    string       `json:"device,omitempty"`
+	PageCount int          `json:"page_count"`
+	Info      documentInfo `json:"document_info"`
+	Options   printOptions `json:"options"`
+	Error     string       `json:"error,omitempty"`
+	Attempts  []jobAttempt `json:"attempts,omitempty"`
+	CreatedAt time.Time    `json:"created_at"`
+	UpdatedAt time.Time    `json:"updated_at"`
+}
+
+// jobStore は印刷ジョブをメモリ上で管理します。
+type jobStore struct {
+	mu    sync.Mutex
+	jobs  map[string]*printJob
+	order []string
+}
+
+// jobs はサービス全体で共有する印刷ジョブの一覧です。
+var jobs = &jobStore{jobs: make(map[string]*printJob)}
+
+// newJobID はランダムなジョブIDを生成します。
+func newJobID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+// create は新しい印刷ジョブを登録し、そのコピーを返します。
+// ID、状態、作成日時は自動的に設定します。
+func (s *jobStore) create(j printJob) printJob {
+	now := time.Now()
+	job := &j
+	job.ID = newJobID()
+	job.Status = jobQueued
+	job.CreatedAt = now
+	job.UpdatedAt = now
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.jobs[job.ID] = job
+	s.order = append(s.order, job.ID)
+	for len(s.order) > maxStoredJobs {
+		delete(s.jobs, s.order[0])
+		s.order = s.order[1:]
+	}
+	return *job
+}
+
+// get は印刷ジョブのコピーを返します。
+func (s *jobStore) get(id string) (printJob, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job, ok := s.jobs[id]
+	if !ok {
+		return printJob{}, false
+	}
+	c := *job
+	c.Attempts = append([]jobAttempt(nil), job.Attempts...)
+	return c, true
+}
+
+// update はロックを取得した状態で印刷ジョブを更新します。
+func (s *jobStore) update(id string, fn func(job *printJob)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if job, ok := s.jobs[id]; ok {
+		fn(job)
+		job.UpdatedAt = time.Now()
+	}
+}
+
+// preparedDocument は印刷先のオプションに合わせて加工したPDFと、送信に使用するオプションです。
+type preparedDocument struct {
+	Path    string
+	Options map[string]string
+}
+
+// prepareDocuments は候補ごとに送信するPDFを用意し、候補の key() をキーにして返します。
+// 加工は送信のたびに繰り返さず、バックエンドとオプションが同じ候補では1回だけ行います。
+// 作成したPDFのパスはエラーの場合も含めて files に追加するため、ジョブが終わったら削除してください。
+func prepareDocuments(jobID, documentPath string, candidates []printTarget, files *[]string) (map[string]preparedDocument, error) {
+	byOptions := make(map[string]preparedDocument)
+	documents := make(map[string]preparedDocument, len(candidates))
+	for _, target := range candidates {
+		optionsKey := target.Backend + "\n" + joinOptions(target.Options)
+		doc, ok := byOptions[optionsKey]
+		if !ok {
+			path, options, err := transformDocument(jobID, documentPath, target)
+			if err != nil {
+				return nil, err
+			}
+			if path != documentPath {
+				// 加工したPDFは同じ名前で作成されるため、別のオプションの加工で上書きされないよう名前を変えます。
+				renamed := derivedPath(documentPath, fmt.Sprintf("print%d", len(byOptions)+1))
+				if err := os.Rename(path, renamed); err != nil {
+					os.Remove(path)
+					return nil, fmt.Errorf("加工したPDFの保存に失敗しました: %w", err)
+				}
+				*files = append(*files, renamed)
+				path = renamed
+			}
+			doc = preparedDocument{Path: path, Options: options}
+			byOptions[optionsKey] = doc
+		}
+		documents[target.key()] = doc
+	}
+	return documents, nil
+}
+
+// joinOptions は印刷オプションをキーの順に並べた文字列にします。
+func joinOptions(options map[string]string) string {
+	keys := make([]string, 0, len(options))
+	for k := range options {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	for _, k := range keys {
+		fmt.Fprintf(&b, "%s=%q;", k, options[k])
+	}
+	return b.String()
+}
+
+// removeJobFiles は印刷ジョブのドキュメントと、ジョブのために作成したPDFを削除します。
+func removeJobFiles(files []string) {
+	for _, p := range files {
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			log.Printf("ファイル '%s' の削除に失敗しました: %v", p, err)
+		}
+	}
+}
+
+// runPrintJob は候補のプリンターの中から最も負荷の低い正常なものを選んで印刷します。
+// 失敗またはタイムアウトした場合は、まだ試していない別の候補に自動的に切り替えます。
+// ジョブが終わったら、documentPath と加工したPDFを削除します。
+func runPrintJob(jobID, documentPath string, candidates []printTarget) {
+	files := []string{documentPath}
+	defer func() { removeJobFiles(files) }()
+
+	// PDFの加工は送信する前に1回だけ行います。加工の失敗はプリンターの問題ではないため、プリンターの状態には記録しません。
+	documents, lastErr := prepareDocuments(jobID, documentPath, candidates, &files)
+	if lastErr == nil {
+		// 停止中と分かっているプリンターには送信せず、設定に応じて失敗させるか保留します。
+		lastErr = waitForHealthyPrinter(appConfig, jobID, candidates)
+	}
+	tried := make(map[string]bool)
+	var last error
+	for lastErr == nil {
+		target, ok := deviceLoads.acquire(candidates, tried)
+		if !ok {
+			break
+		}
+		key := target.key()
+		tried[key] = true
+
+		options, _ := parsePrintOptions(target.Options, 0)
+		jobs.update(jobID, func(job *printJob) {
+			job.Status = jobPrinting
+			job.Error = ""
+			job.Backend = target.Backend
+			job.Device = target.Device
+			job.Options = options
+		})
+
+		doc := documents[key]
+		sendTarget := target
+		sendTarget.Options = doc.Options
+		err := dispatchPrint(doc.Path, sendTarget)
+		deviceLoads.release(key, err)
+
+		attempt := jobAttempt{Backend: target.Backend, Device: target.Device, Time: time.Now()}
+		if err == nil {
+			jobs.update(jobID, func(job *printJob) {
+				job.Status = jobCompleted
+				job.Attempts = append(job.Attempts, attempt)
+			})
+			log.Printf("印刷ジョブ %s が '%s' で完了しました。", jobID, target.Device)
+			return
+		}
+
+		attempt.Error = err.Error()
+		jobs.update(jobID, func(job *printJob) { job.Attempts = append(job.Attempts, attempt) })
+		if !canFailOver(err) {
+			// 送信を始めた後の失敗は、二重に印刷されないよう別のプリンターには送り直しません。
+			log.Printf("印刷ジョブ %s の '%s' への送信が途中で失敗しました: %v", jobID, target.Device, err)
+			fmt.Printf("Print job %s failed on '%s' after sending started: %v\n", jobID, target.Device, err)
+			last = err
+			break
+		}
+		log.Printf("印刷ジョブ %s の '%s' への送信に失敗しました。別のプリンターを試します: %v", jobID, target.Device, err)
+		fmt.Printf("Print job %s failed on '%s': %v\n", jobID, target.Device, err)
+		last = err
+	}
+
+	if lastErr == nil {
+		lastErr = last
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("印刷先のプリンターがありません")
+	}
+	jobs.update(jobID, func(job *printJob) {
+		job.Status = jobFailed
+		job.Error = lastErr.Error()
+	})
+	log.Printf("印刷ジョブ %s が失敗しました: %v", jobID, lastErr)
+}
+
+// jobHandler は GET /jobs/{id} のリクエストを処理し、印刷ジョブの状態をJSONで返します。
+func jobHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	job, ok := jobs.get(id)
+	if !ok {
+		http.Error(w, fmt.Sprintf("印刷ジョブ '%s' が見つかりません。", id), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, job)
+}
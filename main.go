@@ -4,7 +4,6 @@ import (
 	"bufio"
 	"bytes"
 	"fmt"
-	"io"
 	"log"
 	"net/http"
 	"os"
@@ -13,6 +12,7 @@ import (
 	"runtime" // runtimeパッケージを追加
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/getlantern/systray" // systrayライブラリを追加
 )
@@ -32,6 +32,29 @@ func startHTTPServer() {
 	log.Println("/print-pdf ハンドラを追加しました。")   // ログ出力
 	fmt.Println("Added /print-pdf handler.") // デバッグ用ログ
 
+	// プリンター一覧用のハンドラを追加
+	http.HandleFunc("GET /printers", printersHandler)
+	log.Println("/printers ハンドラを追加しました。")
+
+	// 印刷ジョブの状態確認用のハンドラを追加
+	http.HandleFunc("GET /jobs/{id}", jobHandler)
+	http.HandleFunc("GET /job-groups/{id}", jobGroupHandler)
+	log.Println("/jobs/{id}, /job-groups/{id} ハンドラを追加しました。")
+
+	// プリンターの状態確認用のハンドラを追加し、状態監視をバックグラウンドで開始します。
+	http.HandleFunc("GET /printers/{name}/status", printerStatusHandler)
+	http.HandleFunc("GET /printers/{name}/capabilities", printerCapabilitiesHandler)
+	log.Println("/printers/{name}/status, /printers/{name}/capabilities ハンドラを追加しました。")
+	go printerHealthMonitor.run(appConfig)
+
+	// プリンターの状態と消耗品のメトリクス用のハンドラを追加
+	http.HandleFunc("GET /metrics", metricsHandler)
+	log.Println("/metrics ハンドラを追加しました。")
+
+	// 印刷プリセット一覧用のハンドラを追加
+	http.HandleFunc("GET /presets", presetsHandler)
+	log.Println("/presets ハンドラを追加しました。")
+
 	// HTTPサーバーがリッスンするポートを設定します。
 	port := ":8080"
 	log.Printf("HTTPサーバーをポート %s で開始しようとしています。\n", port)              // ログ出力
@@ -49,8 +72,20 @@ func startHTTPServer() {
 	}
 }
 
+// submitResponse は /print-pdf が返すレスポンスです。
+// 複数のドキュメントを受け付けた場合は group_id と、ドキュメントごとのジョブを jobs に返します。
+type submitResponse struct {
+	JobID    string           `json:"job_id,omitempty"`
+	GroupID  string           `json:"group_id,omitempty"`
+	Document string           `json:"document,omitempty"`
+	Info     *documentInfo    `json:"document_info,omitempty"`
+	Status   string           `json:"status"`
+	Message  string           `json:"message,omitempty"`
+	Jobs     []submitResponse `json:"jobs,omitempty"`
+}
+
 // printPDFHandler は /print-pdf エンドポイントのリクエストを処理します。
-// POST multipart/form-data のボディからPDFファイルとプリンター名を受け取り、PDFを印刷します。
+// POST multipart/form-data、application/pdf、application/json のボディからPDFファイルとプリンター名を受け取り、PDFを印刷します。
 func printPDFHandler(w http.ResponseWriter, r *http.Request) {
 	log.Println("Received request for /print-pdf.") // ログ出力
 	fmt.Println("Received request for /print-pdf.") // デバッグ用ログ
@@ -63,98 +98,173 @@ func printPDFHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// multipart/form-data をパースします。最大10MBのファイルを受け入れます。
-	err := r.ParseMultipartForm(10 << 20) // 10MB
+	// リクエストの形式に応じてドキュメントと印刷の指定を読み取り、ドキュメントをスプールディレクトリに保存します。
+	sub, err := readSubmission(w, r)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("マルチパートフォームのパースに失敗しました: %v", err), http.StatusBadRequest)
-		log.Printf("エラー: マルチパートフォームのパースに失敗しました: %v\n", err)            // ログ出力
-		fmt.Printf("Error: Failed to parse multipart form: %v\n", err) // デバッグ用ログ
+		http.Error(w, err.Error(), submissionStatus(err))
+		log.Printf("エラー: %v\n", err)                                 // ログ出力
+		fmt.Printf("Error: Failed to read print request: %v\n", err) // デバッグ用ログ
 		return
 	}
+	// 印刷ジョブを開始する前に拒否したリクエストのドキュメントは、スプールディレクトリに残しません。
+	// 印刷ジョブを開始した後は、ジョブが終わったときに runPrintJob が削除します。
+	started := false
+	defer func() {
+		if !started {
+			sub.removeDocuments()
+		}
+	}()
+
+	// プリセットが指定された場合は、プリセットのプリンターと印刷オプションを使用します。
+	var preset PresetConfig
+	if sub.Preset != "" {
+		if preset, err = lookupPreset(appConfig, sub.Preset); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			log.Printf("エラー: %v\n", err)
+			fmt.Printf("Error: Unknown preset '%s'.\n", sub.Preset)
+			return
+		}
+	}
 
-	// プリンター名を取得します。
-	printerName := r.FormValue("printer")
+	// プリンター名を取得します。リクエストで指定されなかった場合はプリセットのプリンターを使用します。
+	printerName := sub.Printer
 	if printerName == "" {
-		http.Error(w, "フォームデータに'printer'パラメータがありません。", http.StatusBadRequest)
+		printerName = preset.Printer
+	}
+	if printerName == "" {
+		http.Error(w, "リクエストに'printer'パラメータがありません。", http.StatusBadRequest)
 		log.Println("エラー: 'printer'パラメータがありません。")          // ログ出力
 		fmt.Println("Error: Missing 'printer' parameter.") // デバッグ用ログ
 		return
 	}
+	// ドキュメントの変換や結合には、論理プリンターのデフォルト < プリセット < リクエスト の順に優先したオプションを使用します。
+	documentOptions := mergeOptions(mergeOptions(resolvePrinter(appConfig, printerName).Options, preset.Options), sub.Options)
 
-	// アップロードされたPDFファイルを取得します。
-	file, handler, err := r.FormFile("document")
-	if err != nil {
-		http.Error(w, fmt.Sprintf("フォームデータに'document'ファイルがありません: %v", err), http.StatusBadRequest)
-		log.Printf("エラー: 'document'ファイルがありません: %v\n", err)      // ログ出力
-		fmt.Printf("Error: Missing 'document' file: %v\n", err) // デバッグ用ログ
-		return
+	// 画像 (PNG, JPEG, GIF, TIFF) やテキスト、CSV、Markdown、HTMLはPDFに変換してから印刷します。
+	for i, doc := range sub.Documents {
+		converted, err := convertDocument(doc, documentOptions)
+		if err != nil {
+			http.Error(w, err.Error(), submissionStatus(err))
+			log.Printf("エラー: %v\n", err)
+			fmt.Printf("Error: Failed to convert document: %v\n", err)
+			return
+		}
+		sub.Documents[i] = converted
 	}
-	defer file.Close() // 関数終了時にファイルを閉じます。
 
-	// 一時ファイルを作成し、アップロードされたPDFを書き込みます。
-	// tempDir := os.TempDir() // システムの一時ディレクトリを使用
-	//現在のディレクトリに一時ファイルを作成します。
-	// tempDir, err := os.Getwd() // 現在の作業ディレクトリを取得
-	//root ディレクトリ(c:\)に一時ファイルを作成します。
-	tempDir := "c:\\pdf"             // Windowsのルートディレクトリに一時ディレクトリを指定
-	err = os.MkdirAll(tempDir, 0755) // ディレクトリが存在しない場合は作成します。{
-
-	// := os.Mkdir("c:\\pdf", 0755) // c:\pdf ディレクトリを作成
-
-	if err != nil {
-		http.Error(w, fmt.Sprintf("一時ディレクトリの取得に失敗しました: %v", err), http.StatusInternalServerError)
-		log.Printf("エラー: 一時ディレクトリの取得に失敗しました: %v\n", err)                  // ログ出力
-		fmt.Printf("Error: Failed to get temporary directory: %v\n", err) // デバッグ用ログ
-		return
+	// 印刷ツールに渡す前に、暗号化されたPDFを復号し、PDFではないファイルや壊れたPDFを拒否します。
+	for i, doc := range sub.Documents {
+		decrypted, err := decryptDocument(doc, sub.Password)
+		if err != nil {
+			http.Error(w, err.Error(), submissionStatus(err))
+			log.Printf("エラー: %v\n", err)
+			fmt.Printf("Error: Failed to decrypt document: %v\n", err)
+			return
+		}
+		sub.Documents[i] = decrypted
+		if err := validateDocument(decrypted); err != nil {
+			http.Error(w, err.Error(), submissionStatus(err))
+			log.Printf("エラー: %v\n", err)
+			fmt.Printf("Error: Invalid document: %v\n", err)
+			return
+		}
 	}
-	tempFilePath := filepath.Join(tempDir, handler.Filename)
-	log.Printf("アップロードされたファイルを一時パスに保存しています: %s\n", tempFilePath)             // ログ出力
-	fmt.Printf("Saving uploaded file to temporary path: %s\n", tempFilePath) // デバッグ用ログ
 
-	tempFile, err := os.Create(tempFilePath)
-	if err != nil {
-		http.Error(w, fmt.Sprintf("一時ファイルの作成に失敗しました: %v", err), http.StatusInternalServerError)
-		log.Printf("エラー: 一時ファイルの作成に失敗しました: %v\n", err)                  // ログ出力
-		fmt.Printf("Error: Failed to create temporary file: %v\n", err) // デバッグ用ログ
-		return
+	// merge が指定された場合は、複数のドキュメントを1つのPDFに結合して1つのジョブとして印刷します。
+	// 結合したPDFは1つのジョブとして送信されるため、ステープルなどの後処理がまとめて行われ、他の印刷が間に入りません。
+	if len(sub.Documents) > 1 {
+		merge, err := parseDocumentMerge(documentOptions)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("印刷オプションが正しくありません: %v", err), http.StatusBadRequest)
+			log.Printf("エラー: 印刷オプションが正しくありません: %v\n", err)
+			fmt.Printf("Error: Invalid print options: %v\n", err)
+			return
+		}
+		if merge.Enabled {
+			merged, err := mergeDocuments(sub.Documents, merge)
+			if err != nil {
+				http.Error(w, err.Error(), submissionStatus(err))
+				log.Printf("エラー: %v\n", err)
+				fmt.Printf("Error: Failed to merge documents: %v\n", err)
+				return
+			}
+			// 結合したPDFだけを印刷するため、結合する前のドキュメントは削除します。
+			sub.removeDocuments()
+			sub.Documents = []submittedDocument{merged}
+		}
 	}
 
-	_, err = io.Copy(tempFile, file)
-	// io.Copy の後にファイルを明示的に閉じる必要があります。
-	// これにより、Acrobat.exeがファイルにアクセスできるようになります。
-	tempFile.Close()
-
-	if err != nil {
-		http.Error(w, fmt.Sprintf("アップロードされたファイルの保存に失敗しました: %v", err), http.StatusInternalServerError)
-		log.Printf("エラー: アップロードされたファイルの保存に失敗しました: %v\n", err)        // ログ出力
-		fmt.Printf("Error: Failed to save uploaded file: %v\n", err) // デバッグ用ログ
-		return
+	// 各ドキュメントのページ数と印刷オプションを検証します。1つでも問題があれば、どのジョブも開始しません。
+	prepared := make([]preparedJob, 0, len(sub.Documents))
+	for _, doc := range sub.Documents {
+		fmt.Printf("Attempting to print document '%s' to printer '%s'.\n", doc.Path, printerName) // デバッグ用ログ
+		p, err := preparePrintJob(printerName, preset.Options, sub.Options, doc)
+		if err != nil {
+			if len(sub.Documents) > 1 {
+				err = &submissionError{Status: submissionStatus(err), Err: fmt.Errorf("ドキュメント '%s': %w", doc.Name, err)}
+			}
+			http.Error(w, err.Error(), submissionStatus(err))
+			log.Printf("エラー: %v\n", err)
+			fmt.Printf("Error: Failed to prepare print job: %v\n", err)
+			return
+		}
+		prepared = append(prepared, p)
 	}
-	log.Printf("一時ファイルに正常に保存しました: %s", tempFilePath) // ログ出力
-
-	fmt.Printf("Attempting to print document '%s' to printer '%s'.\n", tempFilePath, printerName) // デバッグ用ログ
 
-	// PDF印刷を実行します。
-	err = printPDF(tempFilePath, printerName)
-	if err != nil {
-		http.Error(w, fmt.Sprintf("PDFの印刷に失敗しました: %v", err), http.StatusInternalServerError)
-		log.Printf("PDF印刷エラー: %v\n", err)           // ログ出力
-		fmt.Printf("Error printing PDF: %v\n", err) // デバッグ用ログ
+	// ドキュメントが1つの場合は、印刷ジョブをバックグラウンドで開始します。
+	if len(prepared) == 1 {
+		p := prepared[0]
+		job := jobs.create(printJob{Printer: printerName, Preset: sub.Preset, Document: p.Document.Name, PageCount: p.Info.PageCount, Info: p.Info, Options: p.Options})
+		started = true
+		go runPrintJob(job.ID, p.Document.Path, p.Candidates)
+
+		writeJSON(w, http.StatusAccepted, submitResponse{
+			JobID:   job.ID,
+			Info:    &job.Info,
+			Status:  job.Status,
+			Message: fmt.Sprintf("ドキュメント '%s' をプリンター '%s' の印刷ジョブとして受け付けました。", p.Document.Name, printerName),
+		})
+		log.Printf("PDF印刷リクエストを印刷ジョブ %s として受け付けました。", job.ID)         // ログ出力
+		fmt.Printf("PDF print request accepted as job %s.\n", job.ID) // デバッグ用ログ
+		// 注意: 印刷プロセスはバックグラウンドで実行されるため、このハンドラ内ではドキュメントを削除できません。
+		// ドキュメントと加工したPDFは、印刷ジョブが終わったときに runPrintJob が削除します。
 		return
 	}
 
-	fmt.Fprintf(w, "ドキュメント '%s' をプリンター '%s' に正常に送信しました。", handler.Filename, printerName)
-	log.Println("PDF印刷リクエストが正常に処理されました。")                    // ログ出力
-	fmt.Println("PDF print request processed successfully.") // デバッグ用ログ
-	// 注意: 印刷プロセスはバックグラウンドで実行されるため、このハンドラ内では一時ファイルを安全に削除できません。
-	// ファイルはOSの一時ディレクトリに残りますが、これは意図した動作です。
+	// 複数のドキュメントは1つのジョブグループとして、受け付けた順番に印刷します。
+	group := jobGroup{Printer: printerName, Preset: sub.Preset}
+	groupJobs := make([]groupedJob, 0, len(prepared))
+	accepted := make([]submitResponse, 0, len(prepared))
+	for _, p := range prepared {
+		job := jobs.create(printJob{Printer: printerName, Preset: sub.Preset, Document: p.Document.Name, PageCount: p.Info.PageCount, Info: p.Info, Options: p.Options})
+		group.JobIDs = append(group.JobIDs, job.ID)
+		groupJobs = append(groupJobs, groupedJob{JobID: job.ID, DocumentPath: p.Document.Path, Candidates: p.Candidates})
+		accepted = append(accepted, submitResponse{JobID: job.ID, Document: p.Document.Name, Info: &job.Info, Status: job.Status})
+	}
+	group = jobGroups.create(group)
+	for _, jobID := range group.JobIDs {
+		jobs.update(jobID, func(job *printJob) { job.GroupID = group.ID })
+	}
+	started = true
+	go runPrintGroup(groupJobs)
+
+	writeJSON(w, http.StatusAccepted, submitResponse{
+		GroupID: group.ID,
+		Status:  jobQueued,
+		Message: fmt.Sprintf("%d個のドキュメントをプリンター '%s' のジョブグループとして受け付けました。", len(prepared), printerName),
+		Jobs:    accepted,
+	})
+	log.Printf("PDF印刷リクエストをジョブグループ %s (%d件) として受け付けました。", group.ID, len(prepared))
+	fmt.Printf("PDF print request accepted as job group %s with %d jobs.\n", group.ID, len(prepared))
 }
 
 // printPDF は指定されたPDFファイルを指定されたプリンターに印刷します。
 // Adobe Acrobat Reader DC (AcroRd32.exe) を使用することを想定しています。
-func printPDF(documentPath, printerName string) error {
-	// 注意: この関数は印刷コマンドをバックグラウンドで開始し、完了を待ちません。
-	// これにより、HTTPハンドラがブロックされるのを防ぎます。
+// extraArgs には PDFtoPrinter に渡す追加の引数 (例: "copies=2", "pages=1-3") を指定します。
+func printPDF(documentPath, printerName string, extraArgs []string, timeout time.Duration) error {
+	// 注意: この関数は印刷コマンドの完了 (スプールの完了) まで待ちます。
+	// 印刷ジョブのゴルーチンから呼び出されるため、HTTPハンドラはブロックされません。
+	// timeout を過ぎてもコマンドが終了しない場合はプロセスを終了させ、エラーを返します。
 	// Adobe Acrobat Reader DC の実行可能ファイルのパス。
 	// 環境によって異なる場合があります。必要に応じて変更してください。
 	// 例: "C:\\Program Files (x86)\\Adobe\\Acrobat Reader DC\\Reader\\AcroRd32.exe"
@@ -176,7 +286,7 @@ func printPDF(documentPath, printerName string) error {
 		cmdPath, err := exec.LookPath("Acrobat.exe")
 		if err != nil {
 			log.Printf("Adobe Acrobat Reader (Acrobat.exe) が '%s' または PATH に見つかりませんでした: %v", adobeReaderPath, err)
-			return fmt.Errorf("Adobe Acrobat Reader (Acrobat.exe) が '%s' または PATH に見つかりませんでした: %w", adobeReaderPath, err)
+			return notSent(fmt.Errorf("Adobe Acrobat Reader (Acrobat.exe) が '%s' または PATH に見つかりませんでした: %w", adobeReaderPath, err))
 		}
 		adobeReaderPath = cmdPath // PATHで見つかったパスを使用
 	}
@@ -200,31 +310,47 @@ func printPDF(documentPath, printerName string) error {
 	// quotedDocumentPath := fmt.Sprintf(`"%s"`, documentPath)
 	// cmd := exec.Command(quotedAdobeReaderPath, "/t", quotedDocumentPath, quotedPrinterName) // すべて引用符付きの引数を渡す
 	// cmd := exec.Command(adobeReaderPath, "/t", documentPath, quotedPrinterName) // すべて引用符付きの引数を渡す
-	cmd := exec.Command(executablePath, documentPath, printerName) // すべて引用符付きの引数を渡す
+	args := append([]string{documentPath, printerName}, extraArgs...)
+	cmd := exec.Command(executablePath, args...) // すべて引用符付きの引数を渡す
 
-	log.Printf("印刷コマンドを構築しました: %s %s %s", cmd.Args[0], cmd.Args[1], cmd.Args[2])                           // ログ出力
+	log.Printf("印刷コマンドを構築しました: %s", strings.Join(cmd.Args, " "))                                           // ログ出力
 	log.Printf("印刷コマンドを実行しています: %s %s %s %s", adobeReaderPath, "/t", documentPath, printerName)            // ログ出力
 	fmt.Printf("Executing print command: %s %s %s %s\n", adobeReaderPath, "/t", documentPath, printerName) // デバッグ用ログ
 
-	// cmd.Run() はコマンドが完了するまでブロックし、GUIアプリケーションがハングするとレスポンスが返らなくなる原因になります。
-	// cmd.Start() はコマンドを非同期に開始し、すぐに処理を返すため、HTTPハンドラは即座にレスポンスを返すことができます。
-	err = cmd.Start()
+	return runPrintCommand(cmd, timeout)
+}
+
+// runPrintCommand は印刷コマンドを開始し、終了するまで待ちます。
+// timeout を過ぎてもコマンドが終了しない場合はプロセスを終了させ、エラーを返します。
+func runPrintCommand(cmd *exec.Cmd, timeout time.Duration) error {
+	// cmd.Run() はGUIアプリケーションがハングすると戻らなくなるため、cmd.Start() で開始してタイムアウト付きで待ちます。
+	err := cmd.Start()
 	if err != nil {
 		log.Printf("コマンドの開始に失敗しました: %v", err)
-		return fmt.Errorf("コマンドの開始に失敗しました: %w", err)
+		return notSent(fmt.Errorf("コマンドの開始に失敗しました: %w", err))
 	}
 
-	// プロセスが正常に開始されたことをログに記録します。コマンドの完了は待ちません。
+	// プロセスが正常に開始されたことをログに記録します。
 	log.Printf("印刷コマンドがバックグラウンドで正常に開始されました (PID: %d)", cmd.Process.Pid)
 	fmt.Printf("Print command started successfully in background (PID: %d).\n", cmd.Process.Pid)
 
-	// Goプログラムが子プロセスの終了を待たないように、プロセスを「解放」します。
-	// これにより、Acrobat.exeは完全に独立して実行され、Go側のHTTPハンドラがブロックされるリスクをさらに低減します。
-	err = cmd.Process.Release()
-	if err != nil {
-		// Releaseの失敗は致命的ではない可能性が高いため、警告ログに記録するに留めます。
-		log.Printf("警告: プロセスの解放に失敗しました (PID: %d): %v", cmd.Process.Pid, err)
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	select {
+	case err = <-done:
+		if err != nil {
+			log.Printf("印刷コマンドがエラーで終了しました (PID: %d): %v", cmd.Process.Pid, err)
+			return fmt.Errorf("印刷コマンドがエラーで終了しました: %w", err)
+		}
+	case <-time.After(timeout):
+		// ハングしたプロセスを終了させます。Killの失敗は警告ログに記録するに留めます。
+		if err := cmd.Process.Kill(); err != nil {
+			log.Printf("警告: プロセスの終了に失敗しました (PID: %d): %v", cmd.Process.Pid, err)
+		}
+		log.Printf("印刷コマンドがタイムアウトしました (PID: %d, %v)", cmd.Process.Pid, timeout)
+		return fmt.Errorf("印刷コマンドが %v 以内に終了しませんでした", timeout)
 	}
+	log.Printf("印刷コマンドが正常に終了しました (PID: %d)", cmd.Process.Pid)
 	return nil
 }
 
@@ -236,6 +362,14 @@ func main() {
 	// 多重起動をチェックし、古いプロセスを終了させる
 	handleMultipleInstances()
 
+	// 設定ファイルを読み込みます。読み込みに失敗してもデフォルト設定で起動を続けます。
+	cfg, err := loadConfig(configPath())
+	if err != nil {
+		log.Printf("警告: %v", err)
+	} else {
+		appConfig = cfg
+	}
+
 	// systrayを開始し、onReadyとonExit関数を登録します。
 	systray.Run(onReady, onExit)
 }
@@ -0,0 +1,772 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/pdfcpu/pdfcpu/pkg/font"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/extension"
+	goldmarkhtml "github.com/yuin/goldmark/renderer/html"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// markupExtensions はMarkdownまたはHTMLとしてPDFに変換するドキュメントの拡張子と、その種類です。
+var markupExtensions = map[string]string{
+	".md":       "markdown",
+	".markdown": "markdown",
+	".html":     "html",
+	".htm":      "html",
+}
+
+// markupFormat はドキュメントの拡張子からMarkdownかHTMLかを返します。対象でない場合は空文字列を返します。
+// テキストと同じく、中身がPDFの場合はPDFとして扱います。
+func markupFormat(name, filePath string) string {
+	format := markupExtensions[strings.ToLower(filepath.Ext(name))]
+	if format == "" || isPDFFile(filePath) {
+		return ""
+	}
+	return format
+}
+
+// convertMarkupDocument はMarkdownまたはHTMLのドキュメントをPDFに変換し、変換後のドキュメントを返します。
+// MarkdownはHTMLに変換してから、HTMLと同じ方法でPDFに描画します。
+func convertMarkupDocument(doc submittedDocument, format string, options map[string]string) (submittedDocument, error) {
+	layout, err := parseTextLayout(options)
+	if err != nil {
+		return doc, badRequest("印刷オプションが正しくありません: %v", err)
+	}
+	styles, err := lookupStylesheet(appConfig, options["stylesheet"])
+	if err != nil {
+		return doc, badRequest("印刷オプションが正しくありません: %v", err)
+	}
+	data, err := os.ReadFile(doc.Path)
+	if err != nil {
+		return doc, fmt.Errorf("ドキュメントを読み込めませんでした: %w", err)
+	}
+	text, err := decodeText(data, layout.Encoding)
+	if err != nil {
+		return doc, &submissionError{Status: http.StatusUnprocessableEntity, Err: fmt.Errorf("'%s' の文字コードを変換できませんでした: %w", doc.Name, err)}
+	}
+	if format == "markdown" {
+		var buf bytes.Buffer
+		md := goldmark.New(
+			goldmark.WithExtensions(extension.GFM),
+			// Markdownに書かれたHTMLもそのまま描画します (スクリプトは実行されません)。
+			goldmark.WithRendererOptions(goldmarkhtml.WithUnsafe()),
+		)
+		if err := md.Convert([]byte(text), &buf); err != nil {
+			return doc, &submissionError{Status: http.StatusUnprocessableEntity, Err: fmt.Errorf("'%s' をMarkdownとして読み込めませんでした: %w", doc.Name, err)}
+		}
+		text = buf.String()
+	}
+	root, err := html.Parse(strings.NewReader(text))
+	if err != nil {
+		return doc, &submissionError{Status: http.StatusUnprocessableEntity, Err: fmt.Errorf("'%s' をHTMLとして読み込めませんでした: %w", doc.Name, err)}
+	}
+
+	p, err := newTextPDF()
+	if err != nil {
+		return doc, err
+	}
+	renderHTML(p, root, layout, styles, doc.Name)
+	dst := doc.Path + ".pdf"
+	if err := p.writeFile(dst); err != nil {
+		return doc, &submissionError{Status: http.StatusUnprocessableEntity, Err: fmt.Errorf("'%s' をPDFに変換できませんでした: %w", doc.Name, err)}
+	}
+	os.Remove(doc.Path)
+	log.Printf("ドキュメント '%s' (%s) をPDFに変換しました: %s (%dページ)", doc.Name, format, dst, len(p.pages))
+	return submittedDocument{Name: doc.Name, Path: dst}, nil
+}
+
+// inlineState は太字や斜体など、入れ子になったインライン要素から引き継ぐ表示方法です。
+type inlineState struct {
+	bold, italic, code, link, strike bool
+}
+
+// inlinePiece は行の折り返しの単位 (英単語、空白、日本語の1文字、チェックボックス) です。
+type inlinePiece struct {
+	text     string
+	style    textStyle
+	width    float64
+	space    bool
+	link     bool
+	strike   bool
+	checkbox int // 0: なし, 1: 未チェック, 2: チェック済み
+}
+
+// htmlRenderer はHTMLの要素を上から順にページに描画します。
+type htmlRenderer struct {
+	p      *textPDF
+	l      textLayout
+	styles Stylesheet
+
+	left, right float64 // 本文の左端と右端
+	top, bottom float64 // 本文の上端と下端
+	y           float64 // 次の行の上端
+
+	pending []inlinePiece // 折り返し前のインライン要素
+	block   string        // 描画中のブロック要素の名前 (p, h1, li など)
+	indent  float64       // 字下げ
+	marker  string        // 次の行の先頭に付けるリストの記号
+	quotes  []float64     // 引用の左の線のX座標
+	quoted  int           // 引用の入れ子の深さ
+	gap     float64       // 次のブロック要素の前に空ける間隔
+}
+
+// renderHTML はHTMLのドキュメントをPDFのページに描画します。
+func renderHTML(p *textPDF, root *html.Node, l textLayout, styles Stylesheet, title string) {
+	p.Width, p.Height = l.pageSize(false)
+	margin := l.Margin * pointsPerMM
+	r := &htmlRenderer{p: p, l: l, styles: styles, left: margin, right: p.Width - margin, block: "p"}
+	r.top, r.bottom = l.bodyArea(p)
+	r.newPage()
+	r.children(root, inlineState{})
+	r.flush()
+
+	// 総ページ数が決まってから、各ページにページ番号を描画します。
+	for i := range p.pages {
+		p.selectPage(i + 1)
+		l.drawPageHeader(p, title, i+1, len(p.pages))
+	}
+}
+
+// newPage は新しいページを始めます。
+func (r *htmlRenderer) newPage() {
+	r.p.newPage()
+	r.y = r.top
+	r.gap = 0
+}
+
+// ensure は高さ h の内容を描画できるよう、必要であれば改ページします。
+// ページの先頭ではブロック要素の前の間隔を空けません。
+func (r *htmlRenderer) ensure(h float64) {
+	if r.y < r.top {
+		r.y -= r.gap
+	}
+	r.gap = 0
+	if r.y-h < r.bottom && r.y < r.top {
+		r.newPage()
+	}
+}
+
+// space はブロック要素の間隔を設定します。続く間隔は大きい方だけを使います。
+func (r *htmlRenderer) space(h float64) {
+	r.gap = math.Max(r.gap, h)
+}
+
+// style は要素名のスタイルを返します。
+func (r *htmlRenderer) style(name string) ElementStyle {
+	return r.styles[name]
+}
+
+// textStyle は現在のブロック要素とインラインの状態から文字の表示方法を決めます。
+func (r *htmlRenderer) textStyle(st inlineState) textStyle {
+	block := r.style(r.block)
+	scale := block.Scale
+	if scale <= 0 {
+		scale = 1
+	}
+	ts := textStyle{Size: r.l.FontSize * scale}
+	ts.Bold = (block.Bold != nil && *block.Bold) || st.bold
+	ts.Italic = (block.Italic != nil && *block.Italic) || st.italic
+	color := block.Color
+	if color == "" && r.quoted > 0 {
+		color = r.style("blockquote").Color
+	}
+	if st.code && r.block != "pre" {
+		color = firstNonEmpty(r.style("code").Color, color)
+	}
+	if st.link {
+		color = firstNonEmpty(r.style("a").Color, color)
+	}
+	if c, err := parseColor(color); err == nil {
+		ts.Color = c
+	}
+	return ts
+}
+
+// children は子要素を順番に描画します。
+func (r *htmlRenderer) children(n *html.Node, st inlineState) {
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		r.node(c, st)
+	}
+}
+
+// node は要素1つを描画します。
+func (r *htmlRenderer) node(n *html.Node, st inlineState) {
+	switch n.Type {
+	case html.TextNode:
+		r.addText(collapseSpace(n.Data), st)
+		return
+	case html.DocumentNode:
+		r.children(n, st)
+		return
+	case html.ElementNode:
+	default:
+		return
+	}
+
+	switch n.DataAtom {
+	case atom.Head, atom.Script, atom.Style, atom.Noscript, atom.Template:
+	case atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6, atom.P:
+		r.blockElement(n.Data, n, st)
+	case atom.Div, atom.Section, atom.Article, atom.Header, atom.Footer, atom.Main, atom.Nav, atom.Dl, atom.Dd, atom.Dt, atom.Figure, atom.Figcaption:
+		r.flush()
+		r.children(n, st)
+		r.flush()
+	case atom.Ul, atom.Ol:
+		r.list(n, st)
+	case atom.Li:
+		r.blockElement("li", n, st)
+	case atom.Blockquote:
+		r.blockquote(n, st)
+	case atom.Pre:
+		r.pre(n)
+	case atom.Table:
+		r.table(n)
+	case atom.Hr:
+		r.hr()
+	case atom.Img:
+		r.img(n)
+	case atom.Br:
+		r.flush()
+	case atom.Input:
+		if attr(n, "type") == "checkbox" {
+			box := inlinePiece{checkbox: 1, style: r.textStyle(st)}
+			if _, checked := lookupAttr(n, "checked"); checked {
+				box.checkbox = 2
+			}
+			box.width = box.style.Size * 1.2
+			r.pending = append(r.pending, box)
+		}
+	case atom.B, atom.Strong:
+		st.bold = true
+		r.children(n, st)
+	case atom.I, atom.Em, atom.Cite:
+		st.italic = true
+		r.children(n, st)
+	case atom.Code, atom.Kbd, atom.Samp, atom.Tt:
+		st.code = true
+		r.children(n, st)
+	case atom.A:
+		st.link = attr(n, "href") != ""
+		r.children(n, st)
+	case atom.Del, atom.S, atom.Strike:
+		st.strike = true
+		r.children(n, st)
+	default:
+		r.children(n, st)
+	}
+}
+
+// blockElement は見出し、段落、リストの項目を描画します。
+func (r *htmlRenderer) blockElement(name string, n *html.Node, st inlineState) {
+	r.flush()
+	style := r.style(name)
+	r.space(style.SpaceBefore)
+	prevBlock, prevIndent := r.block, r.indent
+	r.block = name
+	r.indent += style.Indent
+	r.children(n, st)
+	r.flush()
+	if style.Border != nil && *style.Border && strings.HasPrefix(name, "h") {
+		r.p.line(r.left+r.indent, r.y-2, r.right, r.y-2, 0.5)
+		r.y -= 4
+	}
+	r.block, r.indent = prevBlock, prevIndent
+	r.marker = ""
+	r.space(style.SpaceAfter)
+}
+
+// list は番号付き (ol) または記号付き (ul) のリストを描画します。
+func (r *htmlRenderer) list(n *html.Node, st inlineState) {
+	r.flush()
+	number := 1
+	if start, err := strconv.Atoi(attr(n, "start")); err == nil {
+		number = start
+	}
+	bullet := "-"
+	for _, b := range []rune{'•', '・'} {
+		if r.hasGlyph(b) {
+			bullet = string(b)
+			break
+		}
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type != html.ElementNode || c.DataAtom != atom.Li {
+			r.node(c, st)
+			continue
+		}
+		r.marker = bullet
+		if n.DataAtom == atom.Ol {
+			r.marker = fmt.Sprintf("%d.", number)
+			number++
+		}
+		r.blockElement("li", c, st)
+	}
+	r.space(r.style("p").SpaceAfter)
+}
+
+// blockquote は引用を字下げし、左に線を付けて描画します。
+func (r *htmlRenderer) blockquote(n *html.Node, st inlineState) {
+	r.flush()
+	style := r.style("blockquote")
+	if style.Border != nil && *style.Border {
+		r.quotes = append(r.quotes, r.left+r.indent+style.Indent/3)
+		defer func() { r.quotes = r.quotes[:len(r.quotes)-1] }()
+	}
+	r.quoted++
+	defer func() { r.quoted-- }()
+	r.blockElement("blockquote", n, st)
+}
+
+// hasGlyph は埋め込むフォントに文字 c があるかどうかを返します。
+func (r *htmlRenderer) hasGlyph(c rune) bool {
+	font.UserFontMetricsLock.RLock()
+	defer font.UserFontMetricsLock.RUnlock()
+	_, ok := font.UserFontMetrics[r.p.font].Chars[uint32(c)]
+	return ok
+}
+
+// addText はテキストを行の折り返しの単位に分けて追加します。
+// 英数字は単語単位で、日本語などの空白で区切られない文字は1文字ずつ折り返します。
+func (r *htmlRenderer) addText(s string, st inlineState) {
+	if s == "" {
+		return
+	}
+	ts := r.textStyle(st)
+	var word []rune
+	flushWord := func() {
+		if len(word) > 0 {
+			w := string(word)
+			r.pending = append(r.pending, inlinePiece{text: w, style: ts, width: r.p.textWidth(w, ts.Size), link: st.link, strike: st.strike})
+			word = nil
+		}
+	}
+	for _, c := range s {
+		switch {
+		case c == ' ':
+			flushWord()
+			r.pending = append(r.pending, inlinePiece{text: " ", style: ts, width: r.p.textWidth(" ", ts.Size), space: true, link: st.link, strike: st.strike})
+		case c < 0x2E80:
+			word = append(word, c)
+		default:
+			flushWord()
+			r.pending = append(r.pending, inlinePiece{text: string(c), style: ts, width: r.p.textWidth(string(c), ts.Size), link: st.link, strike: st.strike})
+		}
+	}
+	flushWord()
+}
+
+// flush は溜まっているインライン要素を、本文の幅で折り返して描画します。
+func (r *htmlRenderer) flush() {
+	pieces := r.pending
+	r.pending = nil
+	// 行頭と行末の空白は描画しません。
+	for len(pieces) > 0 && pieces[0].space {
+		pieces = pieces[1:]
+	}
+	if len(pieces) == 0 {
+		return
+	}
+	width := r.right - r.left - r.indent
+	var line []inlinePiece
+	lineWidth := 0.0
+	for len(pieces) > 0 {
+		piece := pieces[0]
+		pieces = pieces[1:]
+		if lineWidth+piece.width > width && len(line) > 0 {
+			if piece.space {
+				continue
+			}
+			r.drawLine(line)
+			line, lineWidth = nil, 0
+		}
+		if piece.space && len(line) == 0 {
+			continue
+		}
+		// 1行に収まらない長い単語は文字単位で分割します。
+		if piece.width > width && piece.checkbox == 0 && len([]rune(piece.text)) > 1 {
+			parts := r.p.wrapText(piece.text, piece.style.Size, width)
+			rest := make([]inlinePiece, 0, len(parts)+len(pieces))
+			for _, part := range parts {
+				pp := piece
+				pp.text, pp.width = part, r.p.textWidth(part, piece.style.Size)
+				rest = append(rest, pp)
+			}
+			pieces = append(rest, pieces...)
+			continue
+		}
+		line = append(line, piece)
+		lineWidth += piece.width
+	}
+	if len(line) > 0 {
+		r.drawLine(line)
+	}
+}
+
+// drawLine は折り返した1行を描画します。
+func (r *htmlRenderer) drawLine(line []inlinePiece) {
+	for len(line) > 0 && line[len(line)-1].space {
+		line = line[:len(line)-1]
+	}
+	size := 0.0
+	for _, piece := range line {
+		size = math.Max(size, piece.style.Size)
+	}
+	if size == 0 {
+		size = r.l.FontSize
+	}
+	lineHeight := size * lineSpacing
+	r.ensure(lineHeight)
+	baseline := r.y - size
+	x := r.left + r.indent
+	if r.marker != "" {
+		ts := r.textStyle(inlineState{})
+		r.p.styledText(x-r.p.textWidth(r.marker, ts.Size)-ts.Size*0.5, baseline, ts, r.marker)
+		r.marker = ""
+	}
+	for _, q := range r.quotes {
+		r.p.line(q, r.y, q, r.y-lineHeight, 1.5)
+	}
+	for _, piece := range line {
+		s := piece.style
+		switch {
+		case piece.checkbox > 0:
+			box := s.Size * 0.8
+			r.p.rect(x, baseline-s.Size*0.1, box, box, 0.7, -1)
+			if piece.checkbox == 2 {
+				r.p.line(x+box*0.2, baseline+box*0.45, x+box*0.4, baseline+box*0.2, 1.2)
+				r.p.line(x+box*0.4, baseline+box*0.2, x+box*0.85, baseline+box*0.8, 1.2)
+			}
+		case !piece.space:
+			r.p.styledText(x, baseline, s, piece.text)
+		}
+		if piece.link {
+			r.p.line(x, baseline-s.Size*0.12, x+piece.width, baseline-s.Size*0.12, 0.5)
+		}
+		if piece.strike {
+			r.p.line(x, baseline+s.Size*0.3, x+piece.width, baseline+s.Size*0.3, 0.5)
+		}
+		x += piece.width
+	}
+	r.y -= lineHeight
+}
+
+// pre はコードブロックを背景色付きで、空白と改行をそのまま描画します。長い行は文字単位で折り返します。
+func (r *htmlRenderer) pre(n *html.Node) {
+	r.flush()
+	style := r.style("pre")
+	r.space(style.SpaceBefore)
+	prevBlock := r.block
+	r.block = "pre"
+	defer func() { r.block = prevBlock }()
+
+	ts := r.textStyle(inlineState{code: true})
+	lineHeight := ts.Size * lineSpacing
+	pad := ts.Size * 0.5
+	x := r.left + r.indent
+	width := r.right - x
+	background, err := parseColor(style.Background)
+	hasBackground := style.Background != "" && err == nil
+
+	text := strings.TrimRight(textContent(n), "\n")
+	for _, line := range strings.Split(text, "\n") {
+		for _, part := range r.p.wrapText(expandTabs(line), ts.Size, width-2*pad) {
+			r.ensure(lineHeight)
+			if hasBackground {
+				r.p.fillRect(x, r.y-lineHeight, width, lineHeight, background)
+			}
+			r.p.styledText(x+pad, r.y-ts.Size, ts, part)
+			r.y -= lineHeight
+		}
+	}
+	r.space(style.SpaceAfter)
+}
+
+// hr は区切り線を描画します。
+func (r *htmlRenderer) hr() {
+	r.flush()
+	style := r.style("hr")
+	r.space(style.SpaceBefore)
+	r.ensure(1)
+	color, _ := parseColor(firstNonEmpty(style.Color, "#999999"))
+	r.p.fillRect(r.left+r.indent, r.y-0.5, r.right-r.left-r.indent, 0.8, color)
+	r.y -= 1
+	r.space(style.SpaceAfter)
+}
+
+// img は画像を本文の幅に収まるように描画します。
+// 画像は data: URL、または downloads.allowed_hosts で許可されたホストのURLから読み込みます。
+func (r *htmlRenderer) img(n *html.Node) {
+	r.flush()
+	src, alt := attr(n, "src"), attr(n, "alt")
+	data, err := loadImageSource(src)
+	var name string
+	var pw, ph int
+	if err == nil {
+		name, pw, ph, err = r.p.addImage(bytes.NewReader(data))
+	}
+	if err != nil {
+		log.Printf("警告: 画像 '%s' を読み込めませんでした: %v", src, err)
+		r.addText("[画像: "+firstNonEmpty(alt, src)+"]", inlineState{italic: true})
+		r.flush()
+		return
+	}
+
+	// HTMLのピクセル (1/96インチ) をポイントに換算し、width/height 属性があればそちらを優先します。
+	w, h := float64(pw)*0.75, float64(ph)*0.75
+	if v, err := strconv.ParseFloat(attr(n, "width"), 64); err == nil && v > 0 {
+		h, w = h*v*0.75/w, v*0.75
+	}
+	if v, err := strconv.ParseFloat(attr(n, "height"), 64); err == nil && v > 0 && attr(n, "width") == "" {
+		w, h = w*v*0.75/h, v*0.75
+	}
+	maxW, maxH := r.right-r.left-r.indent, r.top-r.bottom
+	scale := math.Min(1, math.Min(maxW/w, maxH/h))
+	w, h = w*scale, h*scale
+
+	r.ensure(h)
+	r.p.image(name, r.left+r.indent, r.y-h, w, h)
+	r.y -= h
+	r.space(r.style("p").SpaceAfter)
+}
+
+// loadImageSource は img 要素の src から画像のデータを読み込みます。
+func loadImageSource(src string) ([]byte, error) {
+	switch {
+	case strings.HasPrefix(src, "data:"):
+		i := strings.Index(src, ",")
+		if i < 0 || !strings.HasSuffix(src[:i], ";base64") {
+			return nil, fmt.Errorf("Base64のデータURLではありません")
+		}
+		return base64.StdEncoding.DecodeString(src[i+1:])
+	case strings.HasPrefix(src, "http://") || strings.HasPrefix(src, "https://"):
+		path, _, _, err := downloadDocument(appConfig.Downloads, src)
+		if err != nil {
+			return nil, err
+		}
+		defer os.Remove(path)
+		return os.ReadFile(path)
+	}
+	return nil, fmt.Errorf("data: またはURLで指定してください")
+}
+
+// tableCell は表のセル1つです。
+type tableCell struct {
+	text   string
+	header bool
+	align  string // left, center, right
+}
+
+// table は表を罫線付きで描画します。1行目がすべて見出し (th) の場合は、改ページした後にも繰り返します。
+func (r *htmlRenderer) table(n *html.Node) {
+	r.flush()
+	style := r.style("table")
+	r.space(style.SpaceBefore)
+	prevBlock := r.block
+	r.block = "table"
+	defer func() { r.block = prevBlock }()
+
+	var rows [][]tableCell
+	var collect func(*html.Node)
+	collect = func(n *html.Node) {
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			if c.Type != html.ElementNode {
+				continue
+			}
+			switch c.DataAtom {
+			case atom.Tr:
+				var row []tableCell
+				for cell := c.FirstChild; cell != nil; cell = cell.NextSibling {
+					if cell.Type == html.ElementNode && (cell.DataAtom == atom.Th || cell.DataAtom == atom.Td) {
+						row = append(row, tableCell{
+							text:   strings.TrimSpace(collapseSpace(textContent(cell))),
+							header: cell.DataAtom == atom.Th,
+							align:  cellAlign(cell),
+						})
+					}
+				}
+				rows = append(rows, row)
+			case atom.Thead, atom.Tbody, atom.Tfoot:
+				collect(c)
+			}
+		}
+	}
+	collect(n)
+	if len(rows) == 0 {
+		return
+	}
+
+	base := r.textStyle(inlineState{})
+	size := base.Size
+	pad := size * 0.3
+	lineHeight := size * lineSpacing
+	texts := make([][]string, len(rows))
+	for i, row := range rows {
+		for _, cell := range row {
+			texts[i] = append(texts[i], cell.text)
+		}
+	}
+	widths := r.p.tableColumnWidths(texts, size, pad)
+	fitColumnWidths(widths, r.right-r.left-r.indent)
+	border := style.Border != nil && *style.Border
+
+	drawRow := func(row []tableCell) {
+		wrapped := make([][]string, len(widths))
+		lines := 1
+		for i := range widths {
+			if i < len(row) {
+				wrapped[i] = r.p.wrapText(row[i].text, size, widths[i]-2*pad)
+			}
+			if len(wrapped[i]) > lines {
+				lines = len(wrapped[i])
+			}
+		}
+		h := float64(lines)*lineHeight + 2*pad
+		r.ensure(h)
+		x := r.left + r.indent
+		for i, w := range widths {
+			cellStyle := r.style("td")
+			var cell tableCell
+			if i < len(row) {
+				cell = row[i]
+			}
+			if cell.header {
+				cellStyle = r.style("th")
+			}
+			if c, err := parseColor(cellStyle.Background); err == nil && cellStyle.Background != "" {
+				r.p.fillRect(x, r.y-h, w, h, c)
+			}
+			if border {
+				r.p.rect(x, r.y-h, w, h, 0.5, -1)
+			}
+			ts := base
+			ts.Bold = base.Bold || (cellStyle.Bold != nil && *cellStyle.Bold)
+			if c, err := parseColor(cellStyle.Color); err == nil && cellStyle.Color != "" {
+				ts.Color = c
+			}
+			for j, s := range wrapped[i] {
+				tx := x + pad
+				switch {
+				case cell.align == "right" || (cell.align == "" && isNumeric(s)):
+					tx = x + w - pad - r.p.textWidth(s, size)
+				case cell.align == "center":
+					tx = x + (w-r.p.textWidth(s, size))/2
+				}
+				r.p.styledText(tx, r.y-pad-size-float64(j)*lineHeight, ts, s)
+			}
+			x += w
+		}
+		r.y -= h
+	}
+
+	var header []tableCell
+	if allHeaders(rows[0]) {
+		header = rows[0]
+	}
+	for i, row := range rows {
+		page := len(r.p.pages)
+		drawRow(row)
+		// 改ページした場合は、見出しの行を繰り返してから描画し直します。
+		if header != nil && i > 0 && len(r.p.pages) != page {
+			r.p.page().Reset()
+			r.y = r.top
+			drawRow(header)
+			drawRow(row)
+		}
+	}
+	r.space(style.SpaceAfter)
+}
+
+// allHeaders は行のセルがすべて見出し (th) かどうかを返します。
+func allHeaders(row []tableCell) bool {
+	for _, cell := range row {
+		if !cell.header {
+			return false
+		}
+	}
+	return len(row) > 0
+}
+
+// cellAlign はセルの align 属性または style の text-align から配置を返します。
+func cellAlign(n *html.Node) string {
+	if a := strings.ToLower(attr(n, "align")); a != "" {
+		return a
+	}
+	for _, decl := range strings.Split(attr(n, "style"), ";") {
+		if k, v, ok := strings.Cut(decl, ":"); ok && strings.TrimSpace(strings.ToLower(k)) == "text-align" {
+			return strings.TrimSpace(strings.ToLower(v))
+		}
+	}
+	return ""
+}
+
+// attr は要素の属性の値を返します。
+func attr(n *html.Node, key string) string {
+	v, _ := lookupAttr(n, key)
+	return v
+}
+
+// lookupAttr は要素の属性の値と、属性があるかどうかを返します。
+func lookupAttr(n *html.Node, key string) (string, bool) {
+	for _, a := range n.Attr {
+		if a.Key == key {
+			return a.Val, true
+		}
+	}
+	return "", false
+}
+
+// textContent は要素に含まれるテキストを連結して返します。br は改行にします。
+func textContent(n *html.Node) string {
+	var b strings.Builder
+	var walk func(*html.Node)
+	walk = func(n *html.Node) {
+		switch {
+		case n.Type == html.TextNode:
+			b.WriteString(n.Data)
+		case n.Type == html.ElementNode && n.DataAtom == atom.Br:
+			b.WriteString("\n")
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(n)
+	return b.String()
+}
+
+// collapseSpace はHTMLと同じく連続する空白と改行を1つの空白にまとめます。
+// 日本語の文章の途中の改行は、空白を入れずに詰めます。
+func collapseSpace(s string) string {
+	var b strings.Builder
+	runes := []rune(s)
+	for i := 0; i < len(runes); i++ {
+		if !unicode.IsSpace(runes[i]) {
+			b.WriteRune(runes[i])
+			continue
+		}
+		j, newline := i, false
+		for j < len(runes) && unicode.IsSpace(runes[j]) {
+			newline = newline || runes[j] == '\n'
+			j++
+		}
+		if !(newline && i > 0 && j < len(runes) && runes[i-1] >= 0x2E80 && runes[j] >= 0x2E80) {
+			b.WriteByte(' ')
+		}
+		i = j - 1
+	}
+	return b.String()
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/pdfcpu/pdfcpu/pkg/api"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/types"
+)
+
+// documentMerge は複数のドキュメントを1つのPDFに結合して印刷する設定です。
+// 印刷オプションと同じく、リクエスト、プリセット、論理プリンターの options で指定します。
+type documentMerge struct {
+	Enabled     bool // merge: ドキュメントを結合して1つのジョブとして印刷するかどうか
+	Separator   bool // separator=blank: ドキュメントの間に白紙を挟むかどうか
+	DuplexAlign bool // duplex_align: 各ドキュメントが用紙の表面から始まるように白紙のページを補うかどうか
+}
+
+// parseDocumentMerge は merge, separator, duplex_align のオプションを解析します。
+func parseDocumentMerge(options map[string]string) (documentMerge, error) {
+	var m documentMerge
+	if v, ok := options["merge"]; ok {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return m, fmt.Errorf("merge '%s' は true または false で指定してください", v)
+		}
+		m.Enabled = b
+	}
+	if v, ok := options["separator"]; ok {
+		switch strings.ToLower(v) {
+		case "blank":
+			m.Separator = true
+		case "none":
+		default:
+			return m, fmt.Errorf("separator '%s' は blank または none で指定してください", v)
+		}
+	}
+	if v, ok := options["duplex_align"]; ok {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return m, fmt.Errorf("duplex_align '%s' は true または false で指定してください", v)
+		}
+		m.DuplexAlign = b
+	}
+	return m, nil
+}
+
+// blankPagesAfter はページ数 pageCount のドキュメントの後ろに補う白紙のページ数を返します。
+// 両面の位置合わせをする場合、区切りの白紙は表裏1枚分 (2ページ) になります。
+func (m documentMerge) blankPagesAfter(pageCount int) int {
+	if !m.DuplexAlign {
+		if m.Separator {
+			return 1
+		}
+		return 0
+	}
+	blanks := pageCount % 2
+	if m.Separator {
+		blanks += 2
+	}
+	return blanks
+}
+
+// mergeDocuments は複数のドキュメントを順番どおりに1つのPDFに結合し、スプールディレクトリに保存します。
+// 区切りの白紙や両面の位置合わせの白紙は、最後のドキュメント以外の後ろに追加します。
+// 読み込めないドキュメントは 422 の submissionError を、それ以外の失敗はそのままのエラーを返します。
+func mergeDocuments(docs []submittedDocument, m documentMerge) (submittedDocument, error) {
+	paths := make([]string, len(docs))
+	var padded []string
+	defer func() {
+		for _, p := range padded {
+			os.Remove(p)
+		}
+	}()
+	for i, doc := range docs {
+		paths[i] = doc.Path
+		if i == len(docs)-1 {
+			break
+		}
+		pageCount, err := pdfPageCount(doc.Path)
+		if err != nil {
+			return submittedDocument{}, &submissionError{Status: http.StatusUnprocessableEntity, Err: fmt.Errorf("ドキュメント '%s': %w", doc.Name, err)}
+		}
+		blanks := m.blankPagesAfter(pageCount)
+		if blanks == 0 {
+			continue
+		}
+		dst := derivedPath(doc.Path, "padded")
+		if err := appendBlankPages(doc.Path, dst, blanks); err != nil {
+			return submittedDocument{}, fmt.Errorf("ドキュメント '%s': %w", doc.Name, err)
+		}
+		padded = append(padded, dst)
+		paths[i] = dst
+	}
+
+	name := fmt.Sprintf("%s (+%d)", docs[0].Name, len(docs)-1)
+	merged := derivedPath(docs[0].Path, "merged")
+	if err := api.MergeCreateFile(paths, merged, false, pdfConfig()); err != nil {
+		os.Remove(merged)
+		return submittedDocument{}, fmt.Errorf("ドキュメントの結合に失敗しました: %w", err)
+	}
+	log.Printf("%d個のドキュメントを結合しました: %s", len(docs), merged)
+	return submittedDocument{Name: name, Path: merged}, nil
+}
+
+// appendBlankPages は最後のページの後ろに、最後のページと同じ大きさの白紙のページを count ページ追加した新しいPDFを作成します。
+func appendBlankPages(src, dst string, count int) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("ドキュメントを開けませんでした: %w", err)
+	}
+	defer f.Close()
+	ctx, err := api.ReadValidateAndOptimize(f, pdfConfig())
+	if err != nil {
+		return fmt.Errorf("PDFの解析に失敗しました: %w", err)
+	}
+	for i := 0; i < count; i++ {
+		if err := ctx.InsertBlankPages(types.IntSet{ctx.PageCount: true}, nil, false); err != nil {
+			return fmt.Errorf("白紙のページの追加に失敗しました: %w", err)
+		}
+	}
+	if err := api.WriteContextFile(ctx, dst); err != nil {
+		return fmt.Errorf("白紙のページを追加したPDFの保存に失敗しました: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/pdfcpu/pdfcpu/pkg/api"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/model"
+)
+
+// mediaMatchTolerance は、ページの大きさを既知の用紙サイズとみなす誤差 (mm) です。
+const mediaMatchTolerance = 2.0
+
+// documentInfo は印刷するPDFから読み取ったページ数とメタデータです。ジョブに保存し、送信のレスポンスでも返します。
+type documentInfo struct {
+	PageCount  int            `json:"page_count"`
+	PageSizes  []pageSizeInfo `json:"page_sizes"`
+	Title      string         `json:"title,omitempty"`
+	Author     string         `json:"author,omitempty"`
+	Subject    string         `json:"subject,omitempty"`
+	Creator    string         `json:"creator,omitempty"`
+	Producer   string         `json:"producer,omitempty"`
+	PDFVersion string         `json:"pdf_version,omitempty"`
+	Encrypted  bool           `json:"encrypted"`
+}
+
+// pageSizeInfo は同じ大きさのページをまとめたものです。
+// 大きさは回転 (/Rotate) を反映した表示上の幅と高さで、既知の用紙サイズに一致する場合は media にその名前を設定します。
+type pageSizeInfo struct {
+	Media       string  `json:"media,omitempty"`
+	Width       float64 `json:"width_mm"`
+	Height      float64 `json:"height_mm"`
+	Orientation string  `json:"orientation"`
+	Pages       string  `json:"pages"` // この大きさのページ ("1-3,7" の形式)
+}
+
+// readDocumentInfo はPDFのページ数、ページの大きさ、文書情報 (タイトル、作成者など)、暗号化の有無を読み取ります。
+func readDocumentInfo(path string) (documentInfo, error) {
+	ctx, err := api.ReadContextFile(path)
+	if err != nil {
+		return documentInfo{}, fmt.Errorf("PDFの解析に失敗しました: %w", err)
+	}
+	info := documentInfo{
+		PageCount:  ctx.PageCount,
+		PDFVersion: ctx.XRefTable.Version().String(),
+		Encrypted:  ctx.Encrypt != nil,
+	}
+
+	dims, err := ctx.PageDims()
+	if err != nil {
+		return documentInfo{}, fmt.Errorf("ページの大きさを取得できませんでした: %w", err)
+	}
+	// 同じ大きさのページをまとめ、最初に現れた順に並べます。
+	index := map[[2]float64]int{}
+	var ranges [][]pageRange
+	for i, d := range dims {
+		// 0.1mm 単位に丸めて、わずかな誤差のあるページを同じ大きさとしてまとめます。
+		w := math.Round(d.Width/pointsPerMM*10) / 10
+		h := math.Round(d.Height/pointsPerMM*10) / 10
+		key := [2]float64{w, h}
+		n, ok := index[key]
+		if !ok {
+			n = len(info.PageSizes)
+			index[key] = n
+			s := pageSizeInfo{Media: matchMediaSize(w, h), Width: w, Height: h, Orientation: "portrait"}
+			if w > h {
+				s.Orientation = "landscape"
+			}
+			info.PageSizes = append(info.PageSizes, s)
+			ranges = append(ranges, nil)
+		}
+		pageNr := i + 1
+		if r := ranges[n]; len(r) > 0 && r[len(r)-1].To == pageNr-1 {
+			r[len(r)-1].To = pageNr
+		} else {
+			ranges[n] = append(r, pageRange{From: pageNr, To: pageNr})
+		}
+	}
+	for i := range info.PageSizes {
+		info.PageSizes[i].Pages = formatPageRanges(ranges[i])
+	}
+
+	if ctx.Info != nil {
+		if d, err := ctx.DereferenceDict(*ctx.Info); err == nil && d != nil {
+			for key, dst := range map[string]*string{"Title": &info.Title, "Author": &info.Author, "Subject": &info.Subject, "Creator": &info.Creator, "Producer": &info.Producer} {
+				if obj, ok := d.Find(key); ok {
+					if s, err := ctx.DereferenceStringOrHexLiteral(obj, model.V10, nil); err == nil {
+						*dst = strings.TrimSpace(s)
+					}
+				}
+			}
+		}
+	}
+	return info, nil
+}
+
+// matchMediaSize は幅と高さ (mm) が既知の用紙サイズ (向きは問いません) に一致する場合、その名前を返します。
+func matchMediaSize(w, h float64) string {
+	for _, m := range knownMediaSizes {
+		if (math.Abs(m.Width-w) <= mediaMatchTolerance && math.Abs(m.Height-h) <= mediaMatchTolerance) ||
+			(math.Abs(m.Width-h) <= mediaMatchTolerance && math.Abs(m.Height-w) <= mediaMatchTolerance) {
+			return m.Name
+		}
+	}
+	return ""
+}
+
+// autoMedia は media=auto のときに使用する用紙サイズを返します。
+// すべてのページが同じ用紙サイズ (向きは問いません) の場合は、その名前 (既知の用紙でなければ "100x150mm" の形式) を返します。
+// 大きさの異なるページがある場合は空文字列を返し、プリンターの既定の用紙を使用します。
+func (info documentInfo) autoMedia() string {
+	if len(info.PageSizes) == 0 {
+		return ""
+	}
+	s := info.PageSizes[0]
+	for _, other := range info.PageSizes[1:] {
+		if s.Media == "" || other.Media != s.Media {
+			return ""
+		}
+	}
+	if s.Media != "" {
+		return s.Media
+	}
+	// 任意サイズは縦向きの寸法で指定します。向きは orientation と auto_rotate で扱います。
+	return fmt.Sprintf("%gx%gmm", math.Min(s.Width, s.Height), math.Max(s.Width, s.Height))
+}
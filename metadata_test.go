@@ -0,0 +1,14 @@
+package main
+
+import "testing"
+
+func TestReadDocumentInfo(t *testing.T) {
+	p := writeTestPDF(t, "plain.pdf", 2)
+	info, err := readDocumentInfo(p)
+	if err != nil {
+		t.Fatalf("readDocumentInfo: %v", err)
+	}
+	if info.PageCount != 2 || info.Encrypted || len(info.PageSizes) != 1 || info.PageSizes[0].Media != "A4" || info.PageSizes[0].Pages != "1-2" {
+		t.Errorf("readDocumentInfo() = %+v; want 2 unencrypted A4 pages", info)
+	}
+}
@@ -0,0 +1,405 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// printOptionKeys はフォーム、JSON、論理プリンターの options で受け付ける印刷オプションの名前です。
+var printOptionKeys = []string{
+	"copies", "pages", "collate",
+	"duplex", "orientation", "media", "tray", "color",
+	"scale", "auto_rotate",
+	"merge", "separator", "duplex_align",
+	"margin", "image_fit",
+	"font_size", "wrap", "page_header", "csv_header", "encoding",
+	"stylesheet",
+	"stamp_text", "stamp_image", "stamp_position", "stamp_opacity", "stamp_rotation", "stamp_font_size", "stamp_color", "user",
+	"barcode", "barcode_type", "barcode_position", "barcode_size", "barcode_pages",
+	"nup", "nup_order", "nup_border", "booklet",
+	"rotate", "rotate_pages", "crop", "page_margin",
+}
+
+// printOptions は解析済みの印刷オプションです。
+type printOptions struct {
+	Copies  int    `json:"copies"`
+	Pages   string `json:"pages,omitempty"` // 例: "1-3,7"。空の場合はすべてのページ
+	Collate bool   `json:"collate"`         // 複数部数の場合に部単位で印刷するかどうか (省略時は true)
+
+	// 以下は空の場合、プリンターのデフォルト設定で印刷します。
+	Duplex      string `json:"duplex,omitempty"`      // "simplex", "long-edge", "short-edge"
+	Orientation string `json:"orientation,omitempty"` // "portrait", "landscape"
+	Media       string `json:"media,omitempty"`       // "A4", "Letter" などの名前、または "100x150mm" のような任意サイズ
+	Tray        string `json:"tray,omitempty"`        // 給紙トレイ名 (プリンターの機能情報の trays)
+	Color       string `json:"color,omitempty"`       // "color", "monochrome"
+
+	// Scale が空でない場合は、用紙 (Media、未指定の場合は元のページ) に合わせてPDF自体を拡大縮小してから送信します。
+	Scale      string `json:"scale,omitempty"`       // "none", "fit", "shrink", または "80%" のような倍率
+	AutoRotate *bool  `json:"auto_rotate,omitempty"` // ページと用紙の向きが異なる場合に90度回転するかどうか (省略時は true)
+}
+
+// mediaSize は用紙サイズの名前とIPP (PWG) のキーワード、寸法 (mm) です。
+type mediaSize struct {
+	Name    string
+	Keyword string
+	Width   float64
+	Height  float64
+}
+
+// mediaAuto は、ドキュメントのページの大きさに合わせた用紙を選ぶ media の値です。
+const mediaAuto = "auto"
+
+// knownMediaSizes は名前で指定できる用紙サイズです。キーは小文字の名前です。
+var knownMediaSizes = map[string]mediaSize{
+	"a3":     {"A3", "iso_a3_297x420mm", 297, 420},
+	"a4":     {"A4", "iso_a4_210x297mm", 210, 297},
+	"a5":     {"A5", "iso_a5_148x210mm", 148, 210},
+	"a6":     {"A6", "iso_a6_105x148mm", 105, 148},
+	"b4":     {"B4", "jis_b4_257x364mm", 257, 364},
+	"b5":     {"B5", "jis_b5_182x257mm", 182, 257},
+	"letter": {"Letter", "na_letter_8.5x11in", 215.9, 279.4},
+	"legal":  {"Legal", "na_legal_8.5x14in", 215.9, 355.6},
+}
+
+// parseMediaSize は用紙サイズ名、または "100x150mm"、"4x6in" のような任意サイズを解析します。
+func parseMediaSize(value string) (mediaSize, error) {
+	if m, ok := knownMediaSizes[strings.ToLower(value)]; ok {
+		return m, nil
+	}
+	v := strings.ToLower(strings.ReplaceAll(value, " ", ""))
+	unit := 1.0
+	switch {
+	case strings.HasSuffix(v, "mm"):
+		v = strings.TrimSuffix(v, "mm")
+	case strings.HasSuffix(v, "in"):
+		v = strings.TrimSuffix(v, "in")
+		unit = 25.4
+	default:
+		return mediaSize{}, fmt.Errorf("用紙サイズ '%s' が正しくありません (例: A4, Letter, 100x150mm)", value)
+	}
+	parts := strings.Split(v, "x")
+	if len(parts) != 2 {
+		return mediaSize{}, fmt.Errorf("用紙サイズ '%s' が正しくありません (例: A4, Letter, 100x150mm)", value)
+	}
+	w, err1 := strconv.ParseFloat(parts[0], 64)
+	h, err2 := strconv.ParseFloat(parts[1], 64)
+	if err1 != nil || err2 != nil || w <= 0 || h <= 0 {
+		return mediaSize{}, fmt.Errorf("用紙サイズ '%s' が正しくありません (例: A4, Letter, 100x150mm)", value)
+	}
+	return mediaSize{
+		Name:    value,
+		Keyword: fmt.Sprintf("custom_%s_%gx%gmm", strings.ReplaceAll(value, " ", ""), w*unit, h*unit),
+		Width:   w * unit,
+		Height:  h * unit,
+	}, nil
+}
+
+// pageRange はページ範囲 (両端を含む) です。
+type pageRange struct {
+	From, To int
+}
+
+// requestOptions はリクエストのフォームやクエリパラメータから印刷オプションを取り出します。指定されていないものは含みません。
+func requestOptions(values url.Values) map[string]string {
+	options := make(map[string]string)
+	for _, key := range printOptionKeys {
+		if v := strings.TrimSpace(values.Get(key)); v != "" {
+			options[key] = v
+		}
+	}
+	return options
+}
+
+// jsonOptions は application/json の options から印刷オプションを取り出します。
+// requestOptions と同じく printOptionKeys にないキーは無視し、null や空文字列は指定されていないものとして扱います。
+// 数値や真偽値 ("copies": 2, "collate": false) は文字列にし、オブジェクトや配列はエラーにします。
+func jsonOptions(values map[string]interface{}) (map[string]string, error) {
+	options := make(map[string]string)
+	for _, key := range printOptionKeys {
+		switch v := values[key].(type) {
+		case nil:
+		case string:
+			if v = strings.TrimSpace(v); v != "" {
+				options[key] = v
+			}
+		case float64:
+			options[key] = strconv.FormatFloat(v, 'f', -1, 64)
+		case bool:
+			options[key] = strconv.FormatBool(v)
+		default:
+			return nil, fmt.Errorf("options の '%s' は文字列、数値、真偽値のいずれかで指定してください", key)
+		}
+	}
+	return options, nil
+}
+
+// mergeOptions はデフォルトのオプションにリクエストのオプションを上書きした新しいマップを返します。
+func mergeOptions(defaults, overrides map[string]string) map[string]string {
+	merged := make(map[string]string, len(defaults)+len(overrides))
+	for k, v := range defaults {
+		merged[k] = v
+	}
+	for k, v := range overrides {
+		merged[k] = v
+	}
+	return merged
+}
+
+// parsePrintOptions は印刷オプションを解析して検証します。
+// pageCount が0より大きい場合は、ページ範囲がドキュメントのページ数に収まっているかも確認します。
+func parsePrintOptions(options map[string]string, pageCount int) (printOptions, error) {
+	opts := printOptions{Copies: 1, Collate: true}
+
+	if v, ok := options["copies"]; ok {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return opts, fmt.Errorf("copies '%s' は1以上の整数で指定してください", v)
+		}
+		opts.Copies = n
+	}
+
+	if v, ok := options["pages"]; ok {
+		ranges, err := parsePageRanges(v, pageCount)
+		if err != nil {
+			return opts, err
+		}
+		opts.Pages = formatPageRanges(ranges)
+	}
+
+	if v, ok := options["collate"]; ok {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return opts, fmt.Errorf("collate '%s' は true または false で指定してください", v)
+		}
+		opts.Collate = b
+	}
+
+	if v, ok := options["duplex"]; ok {
+		switch strings.ToLower(v) {
+		case "simplex", "one-sided", "none":
+			opts.Duplex = "simplex"
+		case "long-edge", "two-sided-long-edge", "duplex":
+			opts.Duplex = "long-edge"
+		case "short-edge", "two-sided-short-edge":
+			opts.Duplex = "short-edge"
+		default:
+			return opts, fmt.Errorf("duplex '%s' は simplex, long-edge, short-edge のいずれかで指定してください", v)
+		}
+	}
+
+	if v, ok := options["orientation"]; ok {
+		switch strings.ToLower(v) {
+		case "portrait", "landscape":
+			opts.Orientation = strings.ToLower(v)
+		default:
+			return opts, fmt.Errorf("orientation '%s' は portrait または landscape で指定してください", v)
+		}
+	}
+
+	if v, ok := options["media"]; ok {
+		// "auto" はドキュメントのページの大きさに置き換えるまで、値をそのまま保持します (preparePrintJob)。
+		if !strings.EqualFold(v, mediaAuto) {
+			if _, err := parseMediaSize(v); err != nil {
+				return opts, err
+			}
+		}
+		opts.Media = v
+	}
+
+	if v, ok := options["tray"]; ok {
+		opts.Tray = v
+	}
+
+	if v, ok := options["color"]; ok {
+		switch strings.ToLower(v) {
+		case "color", "colour":
+			opts.Color = "color"
+		case "monochrome", "mono", "grayscale", "black":
+			opts.Color = "monochrome"
+		default:
+			return opts, fmt.Errorf("color '%s' は color または monochrome で指定してください", v)
+		}
+	}
+
+	if v, ok := options["scale"]; ok {
+		switch strings.ToLower(v) {
+		case "none", "actual", "100%":
+			opts.Scale = "none"
+		case "fit", "fit-to-page":
+			opts.Scale = "fit"
+		case "shrink", "shrink-to-fit":
+			opts.Scale = "shrink"
+		default:
+			p, err := strconv.ParseFloat(strings.TrimSuffix(v, "%"), 64)
+			if err != nil || p <= 0 || p > 1000 {
+				return opts, fmt.Errorf("scale '%s' は none, fit, shrink、または 1%%〜1000%% の倍率で指定してください", v)
+			}
+			opts.Scale = strconv.FormatFloat(p, 'f', -1, 64) + "%"
+		}
+	}
+
+	if v, ok := options["auto_rotate"]; ok {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return opts, fmt.Errorf("auto_rotate '%s' は true または false で指定してください", v)
+		}
+		opts.AutoRotate = &b
+		if opts.Scale == "" {
+			// 回転だけが指定された場合は、用紙に収まらないページのみ縮小します。
+			opts.Scale = "shrink"
+		}
+	}
+	return opts, nil
+}
+
+// hasDeviceSettings は用紙や両面などプリンター側の設定が必要なオプションが指定されているかを返します。
+func (o printOptions) hasDeviceSettings() bool {
+	return o.Duplex != "" || o.Orientation != "" || o.Media != "" || o.Tray != "" || o.Color != ""
+}
+
+// parsePageRanges は "1-3,7,10-" のようなページ範囲を解析します。
+// "10-" は10ページ目から最後までを表すため、pageCount が0の場合は使用できません。
+func parsePageRanges(spec string, pageCount int) ([]pageRange, error) {
+	var ranges []pageRange
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		from, to := part, part
+		if i := strings.Index(part, "-"); i >= 0 {
+			from, to = part[:i], part[i+1:]
+			if to == "" {
+				if pageCount <= 0 {
+					return nil, fmt.Errorf("ページ範囲 '%s' の終わりが指定されていません", part)
+				}
+				to = strconv.Itoa(pageCount)
+			}
+		}
+		f, err1 := strconv.Atoi(strings.TrimSpace(from))
+		t, err2 := strconv.Atoi(strings.TrimSpace(to))
+		if err1 != nil || err2 != nil || f < 1 || t < f {
+			return nil, fmt.Errorf("ページ範囲 '%s' が正しくありません (例: 1-3,7)", part)
+		}
+		if pageCount > 0 && t > pageCount {
+			return nil, fmt.Errorf("ページ範囲 '%s' がドキュメントのページ数 %d を超えています", part, pageCount)
+		}
+		ranges = append(ranges, pageRange{From: f, To: t})
+	}
+	if len(ranges) == 0 {
+		return nil, fmt.Errorf("ページ範囲 '%s' にページが含まれていません", spec)
+	}
+	return ranges, nil
+}
+
+// selectedPageCount は pageCount ページのドキュメントのうち、ページ範囲で選択されたページの数を返します。
+func selectedPageCount(opts printOptions, pageCount int) int {
+	if opts.Pages == "" {
+		return pageCount
+	}
+	ranges, err := parsePageRanges(opts.Pages, pageCount)
+	if err != nil {
+		return pageCount
+	}
+	n := 0
+	for _, r := range ranges {
+		n += r.To - r.From + 1
+	}
+	return n
+}
+
+// formatPageRanges はページ範囲を "1-3,7" の形式に戻します。"10-" のような終わりのない範囲は解決済みの形式になります。
+func formatPageRanges(ranges []pageRange) string {
+	parts := make([]string, len(ranges))
+	for i, r := range ranges {
+		if r.From == r.To {
+			parts[i] = strconv.Itoa(r.From)
+		} else {
+			parts[i] = fmt.Sprintf("%d-%d", r.From, r.To)
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+// scaleFactor は Scale の倍率と、倍率指定かどうかを返します。
+func (o printOptions) scaleFactor() (float64, bool) {
+	if !strings.HasSuffix(o.Scale, "%") {
+		return 0, false
+	}
+	p, err := strconv.ParseFloat(strings.TrimSuffix(o.Scale, "%"), 64)
+	if err != nil {
+		return 0, false
+	}
+	return p / 100, true
+}
+
+// pageSequence は印刷するページを印刷順に並べた一覧を返します。
+// 部単位 (collate) の場合は 1,2,3,1,2,3、そうでない場合は 1,1,2,2,3,3 の順になります。
+func pageSequence(opts printOptions, pageCount int) ([]int, error) {
+	ranges := []pageRange{{From: 1, To: pageCount}}
+	if opts.Pages != "" {
+		var err error
+		if ranges, err = parsePageRanges(opts.Pages, pageCount); err != nil {
+			return nil, err
+		}
+	}
+	var pages []int
+	for _, r := range ranges {
+		for p := r.From; p <= r.To; p++ {
+			pages = append(pages, p)
+		}
+	}
+	if opts.Copies <= 1 {
+		return pages, nil
+	}
+
+	sequence := make([]int, 0, len(pages)*opts.Copies)
+	if opts.Collate {
+		for c := 0; c < opts.Copies; c++ {
+			sequence = append(sequence, pages...)
+		}
+		return sequence, nil
+	}
+	for _, p := range pages {
+		for c := 0; c < opts.Copies; c++ {
+			sequence = append(sequence, p)
+		}
+	}
+	return sequence, nil
+}
+
+// applyPageSequence は部数とページ範囲をPDF自体に反映した新しいPDFを作成し、そのパスを返します。
+// オプションを渡せないバックエンド (socket) や、ドライバーに任せられない部単位でない印刷に使用します。
+func applyPageSequence(documentPath string, opts printOptions) (string, error) {
+	if opts.Copies <= 1 && opts.Pages == "" {
+		return documentPath, nil
+	}
+	pageCount, err := pdfPageCount(documentPath)
+	if err != nil {
+		return "", err
+	}
+	sequence, err := pageSequence(opts, pageCount)
+	if err != nil {
+		return "", err
+	}
+	dst := derivedPath(documentPath, "pages")
+	if err := writePageSequence(documentPath, dst, sequence); err != nil {
+		return "", err
+	}
+	return dst, nil
+}
+
+// applyScaling は拡大縮小と自動回転をPDF自体に反映した新しいPDFを作成し、そのパスを返します。
+// ドライバーの既定の「用紙に合わせる」設定に左右されないよう、すべてのバックエンドで送信前に使用します。
+func applyScaling(documentPath string, opts printOptions) (string, error) {
+	if opts.Scale == "" {
+		return documentPath, nil
+	}
+	dst := derivedPath(documentPath, "scaled")
+	if err := writeScaledPages(documentPath, dst, opts); err != nil {
+		return "", err
+	}
+	return dst, nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParsePageRanges(t *testing.T) {
+	tests := []struct {
+		spec      string
+		pageCount int
+		want      []pageRange
+		wantErr   bool
+	}{
+		{"1", 0, []pageRange{{1, 1}}, false},
+		{"1-3,7", 0, []pageRange{{1, 3}, {7, 7}}, false},
+		{" 2 - 4 , 6 ", 10, []pageRange{{2, 4}, {6, 6}}, false},
+		{"1,,3", 0, []pageRange{{1, 1}, {3, 3}}, false},
+		{"8-", 10, []pageRange{{8, 10}}, false},
+		{"8-", 0, nil, true},
+		{"", 0, nil, true},
+		{",", 0, nil, true},
+		{"0", 0, nil, true},
+		{"3-1", 0, nil, true},
+		{"a-b", 0, nil, true},
+		{"1-11", 10, nil, true},
+		{"11", 10, nil, true},
+	}
+	for _, tt := range tests {
+		got, err := parsePageRanges(tt.spec, tt.pageCount)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parsePageRanges(%q, %d) error = %v; want error %t", tt.spec, tt.pageCount, err, tt.wantErr)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parsePageRanges(%q, %d) = %v; want %v", tt.spec, tt.pageCount, got, tt.want)
+		}
+	}
+}
+
+func TestFormatPageRanges(t *testing.T) {
+	got := formatPageRanges([]pageRange{{1, 3}, {7, 7}, {9, 10}})
+	if want := "1-3,7,9-10"; got != want {
+		t.Errorf("formatPageRanges() = %q; want %q", got, want)
+	}
+}
+
+func TestPageSequence(t *testing.T) {
+	tests := []struct {
+		name      string
+		opts      printOptions
+		pageCount int
+		want      []int
+	}{
+		{"すべてのページ", printOptions{Copies: 1}, 3, []int{1, 2, 3}},
+		{"ページ範囲", printOptions{Copies: 1, Pages: "3,1"}, 3, []int{3, 1}},
+		{"部単位", printOptions{Copies: 2, Collate: true, Pages: "1-2"}, 3, []int{1, 2, 1, 2}},
+		{"部単位でない", printOptions{Copies: 2, Pages: "1-2"}, 3, []int{1, 1, 2, 2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := pageSequence(tt.opts, tt.pageCount)
+			if err != nil {
+				t.Fatalf("pageSequence(%+v, %d): %v", tt.opts, tt.pageCount, err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("pageSequence(%+v, %d) = %v; want %v", tt.opts, tt.pageCount, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestJSONOptions(t *testing.T) {
+	got, err := jsonOptions(map[string]interface{}{
+		"copies":     float64(2),
+		"scale":      1.5,
+		"collate":    false,
+		"duplex":     " long-edge ",
+		"media":      nil,
+		"tray":       "",
+		"unknown":    "ignored",
+		"stamp_text": "COPY",
+	})
+	if err != nil {
+		t.Fatalf("jsonOptions: %v", err)
+	}
+	want := map[string]string{"copies": "2", "scale": "1.5", "collate": "false", "duplex": "long-edge", "stamp_text": "COPY"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("jsonOptions() = %v; want %v", got, want)
+	}
+
+	for _, v := range []interface{}{
+		map[string]interface{}{"value": 2},
+		[]interface{}{"A4"},
+	} {
+		if got, err := jsonOptions(map[string]interface{}{"media": v}); err == nil {
+			t.Errorf("jsonOptions(media=%v) = %v; want error", v, got)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pdfcpu/pdfcpu/pkg/api"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/model"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/types"
+)
+
+func init() {
+	// pdfcpu はデフォルトでユーザーの設定ディレクトリに設定ファイルを作成し、失敗するとプロセスを終了させます。
+	// サービスとして動作させるため、設定ディレクトリを使用せず組み込みのデフォルト設定を使います。
+	api.DisableConfigDir()
+}
+
+// pdfConfig は pdfcpu の処理に使用する設定を返します。
+func pdfConfig() *model.Configuration {
+	return model.NewDefaultConfiguration()
+}
+
+// pdfPageCount はPDFファイルのページ数を返します。
+func pdfPageCount(path string) (int, error) {
+	ctx, err := api.ReadContextFile(path)
+	if err != nil {
+		return 0, fmt.Errorf("PDFの解析に失敗しました: %w", err)
+	}
+	return ctx.PageCount, nil
+}
+
+// derivedPath は加工したPDFの保存先として、元のファイルと同じディレクトリのパスを返します。
+// 例: c:\pdf\invoice.pdf と "pages" から c:\pdf\invoice.pages.pdf を返します。
+func derivedPath(path, suffix string) string {
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + "." + suffix + ".pdf"
+}
+
+// writePageSequence は pages の順番 (重複可) でページを並べた新しいPDFを作成します。
+func writePageSequence(src, dst string, pages []int) error {
+	selection := make([]string, len(pages))
+	for i, p := range pages {
+		selection[i] = strconv.Itoa(p)
+	}
+	if err := api.CollectFile(src, dst, selection, pdfConfig()); err != nil {
+		return fmt.Errorf("ページの並べ替えに失敗しました: %w", err)
+	}
+	return nil
+}
+
+// pointsPerMM は1mmあたりのPDFのポイント数です。
+const pointsPerMM = 72 / 25.4
+
+// writeScaledPages は各ページを opts の用紙サイズと向きに合わせて拡大縮小し、中央に配置した新しいPDFを作成します。
+// 用紙サイズが指定されていない場合は元のページの大きさのまま、倍率だけを反映します。
+func writeScaledPages(src, dst string, opts printOptions) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("ドキュメントを開けませんでした: %w", err)
+	}
+	defer f.Close()
+
+	conf := pdfConfig()
+	conf.Cmd = model.RESIZE
+	ctx, err := api.ReadValidateAndOptimize(f, conf)
+	if err != nil {
+		return fmt.Errorf("PDFの解析に失敗しました: %w", err)
+	}
+
+	var media *mediaSize
+	if opts.Media != "" {
+		m, err := parseMediaSize(opts.Media)
+		if err != nil {
+			return err
+		}
+		media = &m
+	}
+	for pageNr := 1; pageNr <= ctx.PageCount; pageNr++ {
+		if err := scalePage(ctx, pageNr, media, opts); err != nil {
+			return fmt.Errorf("%dページ目の拡大縮小に失敗しました: %w", pageNr, err)
+		}
+	}
+	ctx.EnsureVersionForWriting()
+
+	if err := api.WriteContextFile(ctx, dst); err != nil {
+		return fmt.Errorf("拡大縮小したPDFの保存に失敗しました: %w", err)
+	}
+	return nil
+}
+
+// scalePage は1ページのコンテンツを変換行列で囲み、用紙の大きさのページに置き換えます。
+func scalePage(ctx *model.Context, pageNr int, media *mediaSize, opts printOptions) error {
+	d, _, inh, err := ctx.PageDict(pageNr, false)
+	if err != nil {
+		return err
+	}
+	box := inh.MediaBox
+	if inh.CropBox != nil {
+		box = inh.CropBox
+	}
+
+	// /Rotate が設定されたページは、表示される向きを基準にします。
+	w, h := box.Width(), box.Height()
+	pageRotated := inh.Rotate%180 != 0
+	if pageRotated {
+		w, h = h, w
+	}
+
+	tw, th := w, h
+	if media != nil {
+		tw, th = media.Width*pointsPerMM, media.Height*pointsPerMM
+	}
+	if (opts.Orientation == "landscape" && tw < th) || (opts.Orientation == "portrait" && tw > th) {
+		tw, th = th, tw
+	}
+
+	rotate := (opts.AutoRotate == nil || *opts.AutoRotate) && w != h && tw != th && (w > h) != (tw > th)
+	sw, sh := w, h
+	if rotate {
+		sw, sh = h, w
+	}
+	fit := math.Min(tw/sw, th/sh)
+	scale := 1.0
+	switch opts.Scale {
+	case "fit":
+		scale = fit
+	case "shrink":
+		scale = math.Min(1, fit)
+	default:
+		if f, ok := opts.scaleFactor(); ok {
+			scale = f
+		}
+	}
+
+	// 中央に配置します。回転する場合は反時計回りに90度回転します。
+	var content bytes.Buffer
+	if rotate {
+		fmt.Fprintf(&content, "q 0 %.5f %.5f 0 %.5f %.5f cm ", scale, -scale, (tw+scale*h)/2, (th-scale*w)/2)
+	} else {
+		fmt.Fprintf(&content, "q %.5f 0 0 %.5f %.5f %.5f cm ", scale, scale, (tw-scale*w)/2, (th-scale*h)/2)
+	}
+	if pageRotated {
+		content.Write(model.ContentBytesForPageRotation(inh.Rotate, w, h))
+	}
+	fmt.Fprintf(&content, "1 0 0 1 %.5f %.5f cm ", -box.LL.X, -box.LL.Y)
+
+	bb, err := ctx.PageContent(d, pageNr)
+	if err != nil && err != model.ErrNoContent {
+		return err
+	}
+	content.Write(bb)
+	content.WriteString(" Q")
+
+	sd, err := ctx.NewStreamDictForBuf(content.Bytes())
+	if err != nil {
+		return err
+	}
+	if err := sd.Encode(); err != nil {
+		return err
+	}
+	ir, err := ctx.IndRefForNewObject(*sd)
+	if err != nil {
+		return err
+	}
+	d["Contents"] = *ir
+
+	d.Update("MediaBox", types.RectForDim(tw, th).Array())
+	for _, key := range []string{"CropBox", "BleedBox", "TrimBox", "ArtBox"} {
+		d.Delete(key)
+	}
+	// /Rotate は親のページツリーから継承されている場合もあるため、削除せず0を設定します。
+	d.Update("Rotate", types.Integer(0))
+	return nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pdfcpu/pdfcpu/pkg/api"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/model"
+)
+
+// writeTestPDF はA4の縦向きのページを pageCount ページ含むPDFを作成します。
+// 各ページには、ページ番号と同じ数の小さな四角形を描きます。
+func writeTestPDF(t *testing.T, name string, pageCount int) string {
+	t.Helper()
+	objects := []string{"<< /Type /Catalog /Pages 2 0 R >>", ""}
+	var kids []string
+	for i := 1; i <= pageCount; i++ {
+		var content strings.Builder
+		for j := 0; j < i; j++ {
+			fmt.Fprintf(&content, "%d 400 10 10 re f\n", 100+20*j)
+		}
+		kids = append(kids, fmt.Sprintf("%d 0 R", len(objects)+1))
+		objects = append(objects,
+			fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 595 842] /Contents %d 0 R >>", len(objects)+2),
+			fmt.Sprintf("<< /Length %d >>\nstream\n%sendstream", content.Len(), content.String()),
+		)
+	}
+	objects[1] = fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), pageCount)
+
+	var b bytes.Buffer
+	b.WriteString("%PDF-1.7\n")
+	offsets := make([]int, len(objects))
+	for i, obj := range objects {
+		offsets[i] = b.Len()
+		fmt.Fprintf(&b, "%d 0 obj\n%s\nendobj\n", i+1, obj)
+	}
+	xref := b.Len()
+	fmt.Fprintf(&b, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, off := range offsets {
+		fmt.Fprintf(&b, "%010d 00000 n \n", off)
+	}
+	fmt.Fprintf(&b, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, xref)
+
+	p := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(p, b.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// readTestPDF は加工したPDFを読み込みます。
+func readTestPDF(t *testing.T, path string) *model.Context {
+	t.Helper()
+	ctx, err := api.ReadContextFile(path)
+	if err != nil {
+		t.Fatalf("%s を読み込めませんでした: %v", path, err)
+	}
+	return ctx
+}
+
+// testPageContent はページのコンテンツストリームを返します。
+func testPageContent(t *testing.T, ctx *model.Context, pageNr int) string {
+	t.Helper()
+	r, err := pdfcpu.ExtractPageContent(ctx, pageNr)
+	if err != nil {
+		t.Fatalf("%dページ目のコンテンツを取得できませんでした: %v", pageNr, err)
+	}
+	b, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+// testPageSizes はページごとの表示上の幅と高さ (ポイント、小数点以下を四捨五入) を返します。
+func testPageSizes(t *testing.T, ctx *model.Context) [][2]int {
+	t.Helper()
+	dims, err := ctx.PageDims()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sizes := make([][2]int, len(dims))
+	for i, d := range dims {
+		sizes[i] = [2]int{int(d.Width + 0.5), int(d.Height + 0.5)}
+	}
+	return sizes
+}
+
+func TestDerivedPath(t *testing.T) {
+	if got, want := derivedPath(filepath.Join("pdf", "invoice.pdf"), "pages"), filepath.Join("pdf", "invoice.pages.pdf"); got != want {
+		t.Errorf("derivedPath() = %q; want %q", got, want)
+	}
+}
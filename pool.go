@@ -0,0 +1,121 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// failedDeviceCooldown は送信に失敗したプリンターを、プールの選択対象から外しておく時間です。
+const failedDeviceCooldown = time.Minute
+
+// deviceLoadTracker はプリンター (デバイス) ごとの処理中ジョブ数と直近の失敗を記録します。
+type deviceLoadTracker struct {
+	mu          sync.Mutex
+	active      map[string]int
+	failedUntil map[string]time.Time
+}
+
+// deviceLoads はサービス全体で共有するデバイスの負荷情報です。
+var deviceLoads = &deviceLoadTracker{
+	active:      make(map[string]int),
+	failedUntil: make(map[string]time.Time),
+}
+
+// resolveCandidates はクライアントが指定したプリンター名から印刷先の候補を返します。
+// プール (members を持つ論理プリンター) の場合はメンバー全員、それ以外は1台だけを返します。
+func resolveCandidates(cfg *Config, name string) []printTarget {
+	pool, ok := cfg.Printers[name]
+	if !ok || len(pool.Members) == 0 {
+		return []printTarget{resolvePrinter(cfg, name)}
+	}
+
+	candidates := make([]printTarget, 0, len(pool.Members))
+	for _, member := range pool.Members {
+		target := resolvePrinter(cfg, member)
+		// プールに設定されたオプションを、メンバー個別のオプションより優先します。
+		options := make(map[string]string)
+		for k, v := range target.Options {
+			options[k] = v
+		}
+		for k, v := range pool.Options {
+			options[k] = v
+		}
+		target.Name = name
+		target.Options = options
+		if pool.TimeoutSeconds > 0 {
+			target.Timeout = time.Duration(pool.TimeoutSeconds) * time.Second
+		}
+		candidates = append(candidates, target)
+	}
+	return candidates
+}
+
+// acquire はまだ試していない候補のうち、正常で処理中のジョブが最も少ないものを選び、その処理中ジョブ数を1つ増やします。
+// 同時に実行されるジョブが同じデバイスを選ばないよう、選択と加算は1つのロックの中で行います。
+// 直近に送信に失敗したもの、または状態監視で停止中と分かっているものは正常でないとみなします。
+// 正常な候補が残っていない場合は、直近に失敗した候補も最後の手段として選びます。
+func (d *deviceLoadTracker) acquire(candidates []printTarget, tried map[string]bool) (printTarget, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now()
+	best := -1
+	bestHealthy := false
+	for i, c := range candidates {
+		key := c.key()
+		if tried[key] {
+			continue
+		}
+		healthy := now.After(d.failedUntil[key]) && !printerHealthMonitor.isDown(key)
+		switch {
+		case best < 0,
+			healthy && !bestHealthy,
+			healthy == bestHealthy && d.active[key] < d.active[candidates[best].key()]:
+			best = i
+			bestHealthy = healthy
+		}
+	}
+	if best < 0 {
+		return printTarget{}, false
+	}
+	d.active[candidates[best].key()]++
+	return candidates[best], true
+}
+
+// release はデバイスの処理中ジョブ数を1つ減らし、送信結果に応じて正常・異常を記録します。
+func (d *deviceLoadTracker) release(key string, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.active[key]--
+	if err != nil {
+		d.failedUntil[key] = time.Now().Add(failedDeviceCooldown)
+		log.Printf("デバイス '%s' を %v の間プールの選択対象から外します。", key, failedDeviceCooldown)
+		return
+	}
+	delete(d.failedUntil, key)
+}
+
+// notSentError は、プリンターにドキュメントを1バイトも送信する前に失敗したことを表します。
+// 送信を始めた後の失敗は、プリンターがジョブを受け付けている場合もあり、別のプリンターに送り直すと二重に印刷されるおそれがあります。
+type notSentError struct {
+	err error
+}
+
+func (e *notSentError) Error() string { return e.err.Error() }
+func (e *notSentError) Unwrap() error { return e.err }
+
+// notSent は err を送信前の失敗として返します。err が nil の場合は nil を返します。
+func notSent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &notSentError{err: err}
+}
+
+// canFailOver は失敗したジョブを、プールの別のプリンターに送り直してもよいかどうかを返します。
+func canFailOver(err error) bool {
+	var e *notSentError
+	return errors.As(err, &e)
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+)
+
+// presetInfo は GET /presets が返すプリセット1つ分の情報です。
+type presetInfo struct {
+	Name        string            `json:"name"`
+	Printer     string            `json:"printer,omitempty"`
+	Options     map[string]string `json:"options,omitempty"`
+	Description string            `json:"description,omitempty"`
+}
+
+// lookupPreset は名前からプリセットを探します。
+func lookupPreset(cfg *Config, name string) (PresetConfig, error) {
+	p, ok := cfg.Presets[name]
+	if !ok {
+		return PresetConfig{}, fmt.Errorf("プリセット '%s' は設定されていません", name)
+	}
+	return p, nil
+}
+
+// presetsHandler は GET /presets のリクエストを処理し、設定されているプリセットの一覧をJSONで返します。
+func presetsHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("Received request for /presets.")
+
+	presets := make([]presetInfo, 0, len(appConfig.Presets))
+	for name, p := range appConfig.Presets {
+		presets = append(presets, presetInfo{Name: name, Printer: p.Printer, Options: p.Options, Description: p.Description})
+	}
+	sort.Slice(presets, func(i, j int) bool { return presets[i].Name < presets[j].Name })
+
+	writeJSON(w, http.StatusOK, presets)
+}
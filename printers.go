@@ -0,0 +1,261 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// printerInfo は GET /printers が返すプリンター1台分の情報です。
+type printerInfo struct {
+	Name     string `json:"name"`
+	Source   string `json:"source"` // "spooler", "network", "logical" のいずれか
+	Driver   string `json:"driver,omitempty"`
+	Location string `json:"location,omitempty"`
+	Default  bool   `json:"default"`
+	Online   bool   `json:"online"`
+	Backend  string `json:"backend,omitempty"` // 論理プリンターの場合のみ
+	Device   string `json:"device,omitempty"`  // 論理プリンターの場合のみ
+}
+
+// win32Printer は Win32_Printer をJSONに変換したときのフィールドです。
+type win32Printer struct {
+	Name               string
+	DriverName         string
+	Location           string
+	Default            bool
+	WorkOffline        bool
+	PrinterStatus      int
+	DetectedErrorState int
+}
+
+// win32PrinterStatusOffline は Win32_Printer.PrinterStatus のオフラインを表す値です。
+const win32PrinterStatusOffline = 7
+
+// querySpoolerPrinters はWindowsのスプーラーに登録されているプリンターの情報をPowerShellで取得します。
+func querySpoolerPrinters() ([]win32Printer, error) {
+	if runtime.GOOS != "windows" {
+		return nil, nil
+	}
+
+	// 日本語のプリンター名が文字化けしないよう、出力エンコーディングをUTF-8に設定します。
+	// 1台だけの場合も配列になるように @() で囲みます。
+	script := `[Console]::OutputEncoding = [Text.Encoding]::UTF8; ` +
+		`ConvertTo-Json -Compress -InputObject @(Get-CimInstance Win32_Printer | ` +
+		`Select-Object Name,DriverName,Location,Default,WorkOffline,PrinterStatus,DetectedErrorState)`
+	output, err := exec.Command("powershell", "-NoProfile", "-NonInteractive", "-Command", script).Output()
+	if err != nil {
+		return nil, fmt.Errorf("スプーラーのプリンター一覧の取得に失敗しました: %w", err)
+	}
+
+	var printers []win32Printer
+	if err := json.Unmarshal(output, &printers); err != nil {
+		return nil, fmt.Errorf("スプーラーのプリンター一覧のパースに失敗しました: %w", err)
+	}
+	return printers, nil
+}
+
+// printerKnown は name が論理プリンター (プールを含む)、ネットワークプリンター、スプーラーのプリンターのいずれかとして存在するかを返します。
+// スプーラーのプリンター名は、Windowsと同じく大文字と小文字を区別しません。
+func printerKnown(cfg *Config, name string) (bool, error) {
+	if _, ok := cfg.Printers[name]; ok {
+		return true, nil
+	}
+	for _, p := range cfg.NetworkPrinters {
+		if p.Name == name {
+			return true, nil
+		}
+	}
+	printers, err := querySpoolerPrinters()
+	if err != nil {
+		return false, err
+	}
+	for _, p := range printers {
+		if strings.EqualFold(p.Name, name) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// listSpoolerPrinters はWindowsのスプーラーに登録されているプリンターを取得します。
+func listSpoolerPrinters() ([]printerInfo, error) {
+	printers, err := querySpoolerPrinters()
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]printerInfo, 0, len(printers))
+	for _, p := range printers {
+		result = append(result, printerInfo{
+			Name:     p.Name,
+			Source:   "spooler",
+			Driver:   p.DriverName,
+			Location: p.Location,
+			Default:  p.Default,
+			Online:   !p.WorkOffline && p.PrinterStatus != win32PrinterStatusOffline,
+		})
+	}
+	return result, nil
+}
+
+// networkPrinterAddress はネットワークプリンターのURIから接続先の host:port を求めます。
+func networkPrinterAddress(uri string) (string, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "", fmt.Errorf("プリンターURI '%s' のパースに失敗しました: %w", uri, err)
+	}
+	if u.Port() != "" {
+		return u.Host, nil
+	}
+	switch u.Scheme {
+	case "ipp", "ipps":
+		// IPPS も既定のポートはIPPと同じ631です (RFC 7472)。
+		return net.JoinHostPort(u.Hostname(), "631"), nil
+	case "https":
+		return net.JoinHostPort(u.Hostname(), "443"), nil
+	case "http":
+		return net.JoinHostPort(u.Hostname(), "80"), nil
+	case "socket":
+		return net.JoinHostPort(u.Hostname(), "9100"), nil
+	}
+	return "", fmt.Errorf("サポートされていないプリンターURIのスキームです: %s", u.Scheme)
+}
+
+// probeTCP は指定されたアドレスにTCP接続できるかを確認します。
+func probeTCP(address string, timeout time.Duration) error {
+	conn, err := net.DialTimeout("tcp", address, timeout)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// listNetworkPrinters は設定ファイルに登録されたネットワークプリンターを返します。
+// オンライン状態はTCP接続できるかどうかで判定し、各プリンターを並行して確認します。
+func listNetworkPrinters(cfg *Config) []printerInfo {
+	result := make([]printerInfo, len(cfg.NetworkPrinters))
+	var wg sync.WaitGroup
+	for i, p := range cfg.NetworkPrinters {
+		result[i] = printerInfo{
+			Name:     p.Name,
+			Source:   "network",
+			Driver:   p.Driver,
+			Location: p.Location,
+		}
+		wg.Add(1)
+		go func(i int, uri string) {
+			defer wg.Done()
+			address, err := networkPrinterAddress(uri)
+			if err != nil {
+				log.Printf("警告: %v", err)
+				return
+			}
+			result[i].Online = probeTCP(address, 2*time.Second) == nil
+		}(i, p.URI)
+	}
+	wg.Wait()
+	return result
+}
+
+// listLogicalPrinters は設定ファイルの論理プリンターを返します。
+// オンライン状態は解決先のデバイスの状態を使用します。known にはスプーラーのプリンター一覧を渡します。
+func listLogicalPrinters(cfg *Config, known []printerInfo) []printerInfo {
+	result := make([]printerInfo, 0, len(cfg.Printers))
+	for name, p := range cfg.Printers {
+		info := printerInfo{
+			Name:     name,
+			Source:   "logical",
+			Location: p.Description,
+			Backend:  p.Backend,
+			Device:   p.Device,
+		}
+		if len(p.Members) > 0 {
+			// プールは、いずれかのメンバーがオンラインであればオンラインとします。
+			info.Backend = "pool"
+			info.Device = strings.Join(p.Members, ",")
+			for _, member := range p.Members {
+				if online, _ := targetOnline(resolvePrinter(cfg, member), known); online {
+					info.Online = true
+					break
+				}
+			}
+		} else {
+			info.Online, info.Driver = targetOnline(resolvePrinter(cfg, name), known)
+		}
+		result = append(result, info)
+	}
+	return result
+}
+
+// targetOnline は印刷先のデバイスがオンラインかどうかと、分かればドライバー名を返します。
+// スプーラーのプリンターは known の一覧から、ネットワークのデバイスはTCP接続で判定します。
+func targetOnline(t printTarget, known []printerInfo) (bool, string) {
+	if t.Backend == "spooler" {
+		for _, k := range known {
+			if k.Source == "spooler" && strings.EqualFold(k.Name, t.Device) {
+				return k.Online, k.Driver
+			}
+		}
+		return false, ""
+	}
+	address := t.Device
+	if strings.Contains(address, "://") {
+		var err error
+		if address, err = networkPrinterAddress(address); err != nil {
+			return false, ""
+		}
+	}
+	return probeTCP(address, 2*time.Second) == nil, ""
+}
+
+// printersHandler は GET /printers のリクエストを処理し、利用可能なプリンターの一覧をJSONで返します。
+func printersHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("Received request for /printers.")
+
+	printers, err := listSpoolerPrinters()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("プリンター一覧の取得に失敗しました: %v", err), http.StatusInternalServerError)
+		log.Printf("エラー: %v\n", err)
+		fmt.Printf("Error: Failed to list spooler printers: %v\n", err)
+		return
+	}
+	printers = append(printers, listNetworkPrinters(appConfig)...)
+	printers = append(printers, listLogicalPrinters(appConfig, printers)...)
+	sort.SliceStable(printers, func(i, j int) bool { return printers[i].Name < printers[j].Name })
+
+	writeJSON(w, http.StatusOK, printers)
+}
+
+// writeJSON は値をJSONとしてレスポンスに書き込みます。
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("警告: JSONレスポンスの書き込みに失敗しました: %v", err)
+	}
+}
+
+// requireKnownPrinter は name が存在するプリンターかどうかを返します。
+// 存在しない場合は 404 Not Found、スプーラーのプリンター一覧を取得できない場合は 502 Bad Gateway をレスポンスに書き込みます。
+func requireKnownPrinter(w http.ResponseWriter, name string) bool {
+	known, err := printerKnown(appConfig, name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return false
+	}
+	if !known {
+		http.Error(w, fmt.Sprintf("プリンター '%s' が見つかりません。", name), http.StatusNotFound)
+		return false
+	}
+	return true
+}
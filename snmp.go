@@ -0,0 +1,414 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gosnmp/gosnmp"
+)
+
+// Printer-MIB (RFC 3805) のテーブルの列
+const (
+	oidPrtMarkerSuppliesDescription = ".1.3.6.1.2.1.43.11.1.1.6"
+	oidPrtMarkerSuppliesMaxCapacity = ".1.3.6.1.2.1.43.11.1.1.8"
+	oidPrtMarkerSuppliesLevel       = ".1.3.6.1.2.1.43.11.1.1.9"
+	oidPrtInputMaxCapacity          = ".1.3.6.1.2.1.43.8.2.1.9"
+	oidPrtInputCurrentLevel         = ".1.3.6.1.2.1.43.8.2.1.10"
+	oidPrtInputName                 = ".1.3.6.1.2.1.43.8.2.1.13"
+	oidPrtMarkerLifeCount           = ".1.3.6.1.2.1.43.10.2.1.4"
+)
+
+// snmpCommunity はデバイスに対応するネットワークプリンターのSNMPコミュニティ名を返します。
+// SNMPが設定されていない場合は空文字を返します。
+func snmpCommunity(cfg *Config, device string) string {
+	for _, p := range cfg.NetworkPrinters {
+		if p.URI == device {
+			return p.SNMPCommunity
+		}
+	}
+	return ""
+}
+
+// Host Resources MIB の hrDeviceType と hrPrinterDetectedErrorState の列
+// hrPrinterTable は hrDeviceTable と同じ hrDeviceIndex で参照します。
+const (
+	oidHrDeviceType                = ".1.3.6.1.2.1.25.3.2.1.2"
+	oidHrDevicePrinter             = ".1.3.6.1.2.1.25.3.1.5"
+	oidHrPrinterDetectedErrorState = ".1.3.6.1.2.1.25.3.5.1.2"
+)
+
+// hrPrinterErrorBits は hrPrinterDetectedErrorState のビットと理由の対応表です (先頭バイトの最上位ビットから順)。
+var hrPrinterErrorBits = []struct {
+	reason string
+	error  bool
+}{
+	{"paper-low", false},
+	{"paper-out", true},
+	{"toner-low", false},
+	{"toner-empty", true},
+	{"door-open", true},
+	{"paper-jam", true},
+	{"offline", true},
+	{"service-requested", true},
+	{"input-tray-missing", true},
+	{"output-tray-missing", true},
+	{"marker-supply-missing", true},
+	{"output-near-full", false},
+	{"output-bin-full", true},
+	{"input-tray-empty", true},
+	{"overdue-maintenance", false},
+}
+
+// snmpPort はプリンターのSNMPエージェントのUDPポートです。
+var snmpPort uint16 = 161
+
+// newSNMPClient はプリンターのアドレスとコミュニティ名からSNMPv2cのクライアントを作成します。
+func newSNMPClient(address, community string) *gosnmp.GoSNMP {
+	host := address
+	if i := strings.LastIndex(address, ":"); i >= 0 {
+		host = strings.Trim(address[:i], "[]")
+	}
+	return &gosnmp.GoSNMP{
+		Target:    host,
+		Port:      snmpPort,
+		Community: community,
+		Version:   gosnmp.Version2c,
+		Timeout:   3 * time.Second,
+		Retries:   1,
+	}
+}
+
+// snmpPrinterState はSNMPで hrDeviceTable からプリンターのデバイスを探し、その hrPrinterDetectedErrorState から状態を求めます。
+func snmpPrinterState(address, community string) (string, []string, error) {
+	client := newSNMPClient(address, community)
+	if err := client.Connect(); err != nil {
+		return "", nil, err
+	}
+	defer client.Conn.Close()
+
+	deviceTypes, err := snmpTable(client, oidHrDeviceType)
+	if err != nil {
+		return "", nil, fmt.Errorf("hrDeviceTable の取得に失敗しました: %w", err)
+	}
+	index, ok := printerDeviceIndex(deviceTypes)
+	if !ok {
+		return "", nil, fmt.Errorf("hrDeviceTable にプリンターのデバイスがありません")
+	}
+	errorStateOID := oidHrPrinterDetectedErrorState + "." + index
+	res, err := client.Get([]string{errorStateOID})
+	if err != nil {
+		return "", nil, err
+	}
+
+	var bits []byte
+	for _, v := range res.Variables {
+		if v.Name == errorStateOID {
+			bits, _ = v.Value.([]byte)
+		}
+	}
+	state, reasons := printerStateFromErrorBits(bits)
+	return state, reasons, nil
+}
+
+// printerDeviceIndex は hrDeviceType の列から、種類が hrDevicePrinter の最初のデバイスのインデックスを返します。
+// 複合機などでは、プリンターのほかにネットワークカードやディスクなど複数のデバイスがあります。
+func printerDeviceIndex(deviceTypes map[string]gosnmp.SnmpPDU) (string, bool) {
+	for _, index := range sortedKeys(deviceTypes) {
+		if v, ok := deviceTypes[index].Value.(string); ok && "."+strings.TrimPrefix(v, ".") == oidHrDevicePrinter {
+			return index, true
+		}
+	}
+	return "", false
+}
+
+// printerStateFromErrorBits は hrPrinterDetectedErrorState のビットから状態と理由を求めます。
+// hrPrinterStatus はスリープや待機中にも other(1) になり、エラーの有無はこのビットで報告されるため (RFC 3805)、状態の判定には使いません。
+func printerStateFromErrorBits(bits []byte) (string, []string) {
+	state := healthOnline
+	var reasons []string
+	for i, b := range hrPrinterErrorBits {
+		if i/8 < len(bits) && bits[i/8]&(0x80>>(i%8)) != 0 {
+			reasons = append(reasons, b.reason)
+			if b.error {
+				state = healthError
+			}
+		}
+	}
+	return state, reasons
+}
+
+// supplyLevel はトナー・インクなどの消耗品1つ分の残量です。
+// Percent は残量が分からない場合 -1 になります。
+type supplyLevel struct {
+	Name        string `json:"name"`
+	Level       int    `json:"level"`
+	MaxCapacity int    `json:"max_capacity"`
+	Percent     int    `json:"percent"`
+}
+
+// trayState は給紙トレイ1つ分の状態です。
+// Level は Printer-MIB の値で、-2 は不明、-3 は「用紙あり」を表します。
+type trayState struct {
+	Name        string `json:"name"`
+	Level       int    `json:"level"`
+	MaxCapacity int    `json:"max_capacity"`
+	Empty       bool   `json:"empty"`
+}
+
+// printerSupplies はSNMPで取得した消耗品、トレイ、ページカウンターです。
+type printerSupplies struct {
+	Supplies  []supplyLevel `json:"supplies,omitempty"`
+	Trays     []trayState   `json:"trays,omitempty"`
+	PageCount int64         `json:"page_count"`
+	CheckedAt time.Time     `json:"checked_at"`
+}
+
+// snmpTable は指定された列をBulkWalkし、インデックス (列OIDより後ろの部分) ごとの値を返します。
+func snmpTable(client *gosnmp.GoSNMP, column string) (map[string]gosnmp.SnmpPDU, error) {
+	pdus, err := client.BulkWalkAll(column)
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string]gosnmp.SnmpPDU, len(pdus))
+	for _, pdu := range pdus {
+		result[strings.TrimPrefix(pdu.Name, column+".")] = pdu
+	}
+	return result, nil
+}
+
+// snmpString はOCTET STRINGの値を文字列に変換します。
+func snmpString(pdu gosnmp.SnmpPDU) string {
+	if b, ok := pdu.Value.([]byte); ok {
+		return strings.TrimRight(string(b), "\x00 ")
+	}
+	return fmt.Sprint(pdu.Value)
+}
+
+// snmpInt は数値の値をintに変換します。
+func snmpInt(pdu gosnmp.SnmpPDU) int {
+	return int(gosnmp.ToBigInt(pdu.Value).Int64())
+}
+
+// sortedKeys はテーブルのインデックスを、OIDの順 ("1.2" が "1.10" より前) に並べ替えて返します。
+func sortedKeys(m map[string]gosnmp.SnmpPDU) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return compareOIDs(keys[i], keys[j]) < 0 })
+	return keys
+}
+
+// compareOIDs は "1.10.3" のようなOIDを、サブ識別子ごとに数値として比較します。
+func compareOIDs(a, b string) int {
+	as := strings.Split(strings.Trim(a, "."), ".")
+	bs := strings.Split(strings.Trim(b, "."), ".")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		x, errX := strconv.ParseUint(as[i], 10, 64)
+		y, errY := strconv.ParseUint(bs[i], 10, 64)
+		if errX != nil || errY != nil {
+			// 数値でないサブ識別子は文字列として比較します。
+			if c := strings.Compare(as[i], bs[i]); c != 0 {
+				return c
+			}
+			continue
+		}
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	return len(as) - len(bs)
+}
+
+// parseSupplies は prtMarkerSuppliesTable の列から、インデックスの順に消耗品の残量を求めます。
+// 残量や最大容量が不明 (-1, -2) や「残りあり」(-3) の場合、Percent は -1 になります。
+func parseSupplies(descriptions, maxCapacities, levels map[string]gosnmp.SnmpPDU) []supplyLevel {
+	var supplies []supplyLevel
+	for _, index := range sortedKeys(descriptions) {
+		s := supplyLevel{
+			Name:        snmpString(descriptions[index]),
+			Level:       snmpInt(levels[index]),
+			MaxCapacity: snmpInt(maxCapacities[index]),
+			Percent:     -1,
+		}
+		if s.MaxCapacity > 0 && s.Level >= 0 {
+			s.Percent = s.Level * 100 / s.MaxCapacity
+		}
+		supplies = append(supplies, s)
+	}
+	return supplies
+}
+
+// snmpPrinterSupplies はPrinter-MIBから消耗品の残量、トレイの状態、累計ページ数を取得します。
+func snmpPrinterSupplies(address, community string) (*printerSupplies, error) {
+	client := newSNMPClient(address, community)
+	if err := client.Connect(); err != nil {
+		return nil, err
+	}
+	defer client.Conn.Close()
+
+	result := &printerSupplies{CheckedAt: time.Now()}
+
+	descriptions, err := snmpTable(client, oidPrtMarkerSuppliesDescription)
+	if err != nil {
+		return nil, fmt.Errorf("消耗品の一覧の取得に失敗しました: %w", err)
+	}
+	maxCapacities, _ := snmpTable(client, oidPrtMarkerSuppliesMaxCapacity)
+	levels, _ := snmpTable(client, oidPrtMarkerSuppliesLevel)
+	result.Supplies = parseSupplies(descriptions, maxCapacities, levels)
+
+	names, err := snmpTable(client, oidPrtInputName)
+	if err != nil {
+		log.Printf("警告: 給紙トレイの一覧の取得に失敗しました (%s): %v", address, err)
+	}
+	trayMax, _ := snmpTable(client, oidPrtInputMaxCapacity)
+	trayLevels, _ := snmpTable(client, oidPrtInputCurrentLevel)
+	for _, index := range sortedKeys(names) {
+		t := trayState{
+			Name:        snmpString(names[index]),
+			Level:       snmpInt(trayLevels[index]),
+			MaxCapacity: snmpInt(trayMax[index]),
+		}
+		t.Empty = t.Level == 0
+		result.Trays = append(result.Trays, t)
+	}
+
+	counters, err := snmpTable(client, oidPrtMarkerLifeCount)
+	if err != nil {
+		log.Printf("警告: ページカウンターの取得に失敗しました (%s): %v", address, err)
+	}
+	for _, pdu := range counters {
+		result.PageCount += gosnmp.ToBigInt(pdu.Value).Int64()
+	}
+	return result, nil
+}
+
+// supplyAlerter は消耗品の残量がしきい値を下回ったときに通知します。
+// 同じ消耗品については、しきい値を上回るまで (交換されるまで) 再通知しません。
+type supplyAlerter struct {
+	mu      sync.Mutex
+	alerted map[string]bool
+}
+
+var supplyAlerts = &supplyAlerter{alerted: make(map[string]bool)}
+
+// supplyAlert はWebhookに送信する通知の内容です。
+type supplyAlert struct {
+	Device    string    `json:"device"`
+	Supply    string    `json:"supply"`
+	Percent   int       `json:"percent"`
+	Threshold int       `json:"threshold"`
+	Time      time.Time `json:"time"`
+}
+
+// check は消耗品の残量を確認し、しきい値を下回ったものを通知します。
+func (a *supplyAlerter) check(cfg *Config, device string, supplies *printerSupplies) {
+	threshold := cfg.Health.SupplyThresholdPercent
+	if threshold <= 0 {
+		threshold = 10
+	}
+
+	var alerts []supplyAlert
+	a.mu.Lock()
+	for _, s := range supplies.Supplies {
+		if s.Percent < 0 {
+			continue
+		}
+		key := device + "|" + s.Name
+		low := s.Percent < threshold
+		if low && !a.alerted[key] {
+			alerts = append(alerts, supplyAlert{Device: device, Supply: s.Name, Percent: s.Percent, Threshold: threshold, Time: time.Now()})
+		}
+		a.alerted[key] = low
+	}
+	a.mu.Unlock()
+
+	for _, alert := range alerts {
+		log.Printf("警告: プリンター '%s' の '%s' の残量が %d%% です (しきい値 %d%%)。", alert.Device, alert.Supply, alert.Percent, alert.Threshold)
+		fmt.Printf("Supply alert: '%s' on '%s' is at %d%%.\n", alert.Supply, alert.Device, alert.Percent)
+		if cfg.Health.AlertWebhookURL != "" {
+			if err := postAlert(cfg.Health.AlertWebhookURL, alert); err != nil {
+				log.Printf("警告: 消耗品アラートの送信に失敗しました: %v", err)
+			}
+		}
+	}
+}
+
+// postAlert は通知をJSONでWebhookに送信します。
+func postAlert(webhookURL string, alert supplyAlert) error {
+	body, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Post(webhookURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("Webhookがステータス %d を返しました", resp.StatusCode)
+	}
+	return nil
+}
+
+// metricsHandler は GET /metrics のリクエストを処理し、プリンターの状態と消耗品をPrometheusのテキスト形式で返します。
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	var b strings.Builder
+	b.WriteString("# HELP print_service_printer_up プリンターがオンラインなら1、それ以外は0。\n")
+	b.WriteString("# TYPE print_service_printer_up gauge\n")
+	devices := printerHealthMonitor.all()
+	for _, h := range devices {
+		up := 0
+		if h.State == healthOnline {
+			up = 1
+		}
+		fmt.Fprintf(&b, "print_service_printer_up{device=%q} %d\n", h.Device, up)
+	}
+
+	b.WriteString("# HELP print_service_supply_level_percent 消耗品の残量 (%)。\n")
+	b.WriteString("# TYPE print_service_supply_level_percent gauge\n")
+	for _, h := range devices {
+		if h.Supplies == nil {
+			continue
+		}
+		for _, s := range h.Supplies.Supplies {
+			if s.Percent >= 0 {
+				fmt.Fprintf(&b, "print_service_supply_level_percent{device=%q,supply=%q} %d\n", h.Device, s.Name, s.Percent)
+			}
+		}
+	}
+
+	b.WriteString("# HELP print_service_tray_level 給紙トレイの用紙の量 (Printer-MIBの値)。\n")
+	b.WriteString("# TYPE print_service_tray_level gauge\n")
+	for _, h := range devices {
+		if h.Supplies == nil {
+			continue
+		}
+		for _, t := range h.Supplies.Trays {
+			fmt.Fprintf(&b, "print_service_tray_level{device=%q,tray=%q} %d\n", h.Device, t.Name, t.Level)
+		}
+	}
+
+	b.WriteString("# HELP print_service_page_count_total プリンターの累計印刷ページ数。\n")
+	b.WriteString("# TYPE print_service_page_count_total counter\n")
+	for _, h := range devices {
+		if h.Supplies != nil {
+			fmt.Fprintf(&b, "print_service_page_count_total{device=%q} %d\n", h.Device, h.Supplies.PageCount)
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	fmt.Fprint(w, b.String())
+}
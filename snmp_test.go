@@ -0,0 +1,320 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gosnmp/gosnmp"
+)
+
+func TestPrinterStateFromErrorBits(t *testing.T) {
+	tests := []struct {
+		name    string
+		bits    []byte
+		state   string
+		reasons []string
+	}{
+		{"ビットなし", nil, healthOnline, nil},
+		{"すべて0", []byte{0x00, 0x00}, healthOnline, nil},
+		{"用紙少ない (警告のみ)", []byte{0x80}, healthOnline, []string{"paper-low"}},
+		{"用紙切れ", []byte{0x40}, healthError, []string{"paper-out"}},
+		{"トナー少ないと紙詰まり", []byte{0x24}, healthError, []string{"toner-low", "paper-jam"}},
+		{"2バイト目の排紙トレイ満杯", []byte{0x00, 0x08}, healthError, []string{"output-bin-full"}},
+		{"2バイト目のメンテナンス期限 (警告のみ)", []byte{0x00, 0x02}, healthOnline, []string{"overdue-maintenance"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state, reasons := printerStateFromErrorBits(tt.bits)
+			if state != tt.state || !reflect.DeepEqual(reasons, tt.reasons) {
+				t.Errorf("printerStateFromErrorBits(%x) = %s, %v; want %s, %v", tt.bits, state, reasons, tt.state, tt.reasons)
+			}
+		})
+	}
+}
+
+func TestPrinterDeviceIndex(t *testing.T) {
+	tests := []struct {
+		name  string
+		types map[string]gosnmp.SnmpPDU
+		index string
+		ok    bool
+	}{
+		{"プリンターだけ", map[string]gosnmp.SnmpPDU{
+			"1": {Value: ".1.3.6.1.2.1.25.3.1.5"},
+		}, "1", true},
+		{"複数のデバイス", map[string]gosnmp.SnmpPDU{
+			"1":     {Value: ".1.3.6.1.2.1.25.3.1.4"}, // hrDeviceNetwork
+			"2":     {Value: ".1.3.6.1.2.1.25.3.1.6"}, // hrDeviceDiskStorage
+			"10":    {Value: ".1.3.6.1.2.1.25.3.1.5"},
+			"11":    {Value: ".1.3.6.1.2.1.25.3.1.5"},
+			"25001": {Value: ".1.3.6.1.2.1.25.3.1.3"},
+		}, "10", true},
+		{"先頭のドットなし", map[string]gosnmp.SnmpPDU{
+			"3": {Value: "1.3.6.1.2.1.25.3.1.5"},
+		}, "3", true},
+		{"プリンターなし", map[string]gosnmp.SnmpPDU{
+			"1": {Value: ".1.3.6.1.2.1.25.3.1.4"},
+		}, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			index, ok := printerDeviceIndex(tt.types)
+			if index != tt.index || ok != tt.ok {
+				t.Errorf("printerDeviceIndex() = %q, %t; want %q, %t", index, ok, tt.index, tt.ok)
+			}
+		})
+	}
+}
+
+func TestSortedKeys(t *testing.T) {
+	m := map[string]gosnmp.SnmpPDU{"1.10": {}, "1.2": {}, "1.1": {}, "2.1": {}, "1.2.1": {}}
+	want := []string{"1.1", "1.2", "1.2.1", "1.10", "2.1"}
+	if got := sortedKeys(m); !reflect.DeepEqual(got, want) {
+		t.Errorf("sortedKeys() = %v; want %v", got, want)
+	}
+}
+
+func TestParseSupplies(t *testing.T) {
+	descriptions := map[string]gosnmp.SnmpPDU{
+		"1.1":  {Value: []byte("Black Toner\x00")},
+		"1.2":  {Value: []byte("Cyan Toner")},
+		"1.10": {Value: []byte("Waste Toner Box ")},
+		"1.3":  {Value: []byte("Drum")},
+	}
+	maxCapacities := map[string]gosnmp.SnmpPDU{
+		"1.1":  {Value: 1000},
+		"1.2":  {Value: 200},
+		"1.10": {Value: -2},
+		"1.3":  {Value: 100},
+	}
+	levels := map[string]gosnmp.SnmpPDU{
+		"1.1":  {Value: 250},
+		"1.2":  {Value: 0},
+		"1.10": {Value: -3},
+		"1.3":  {Value: -2},
+	}
+	want := []supplyLevel{
+		{Name: "Black Toner", Level: 250, MaxCapacity: 1000, Percent: 25},
+		{Name: "Cyan Toner", Level: 0, MaxCapacity: 200, Percent: 0},
+		{Name: "Drum", Level: -2, MaxCapacity: 100, Percent: -1},
+		{Name: "Waste Toner Box", Level: -3, MaxCapacity: -2, Percent: -1},
+	}
+	if got := parseSupplies(descriptions, maxCapacities, levels); !reflect.DeepEqual(got, want) {
+		t.Errorf("parseSupplies() = %+v; want %+v", got, want)
+	}
+}
+
+// startTestSNMPAgent は127.0.0.1でSNMPv2cのGet、GetNext、GetBulkに応答するエージェントを起動し、ポートを返します。
+// objects はOIDから応答する値への対応表です。
+func startTestSNMPAgent(t *testing.T, community string, objects map[string]gosnmp.SnmpPDU) uint16 {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	oids := make([]string, 0, len(objects))
+	for oid := range objects {
+		oids = append(oids, oid)
+	}
+	sort.Slice(oids, func(i, j int) bool { return compareOIDs(oids[i], oids[j]) < 0 })
+	// next は oid より後ろの最初のオブジェクトを返します。
+	next := func(oid string) gosnmp.SnmpPDU {
+		for _, o := range oids {
+			if compareOIDs(o, oid) > 0 {
+				pdu := objects[o]
+				pdu.Name = o
+				return pdu
+			}
+		}
+		return gosnmp.SnmpPDU{Name: oid, Type: gosnmp.EndOfMibView}
+	}
+
+	go func() {
+		decoder := &gosnmp.GoSNMP{Version: gosnmp.Version2c, Community: community}
+		buf := make([]byte, 65535)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			req, err := decoder.SnmpDecodePacket(buf[:n])
+			if err != nil || req.Community != community {
+				continue
+			}
+			var vars []gosnmp.SnmpPDU
+			for _, v := range req.Variables {
+				switch req.PDUType {
+				case gosnmp.GetRequest:
+					pdu, ok := objects[v.Name]
+					if !ok {
+						pdu = gosnmp.SnmpPDU{Type: gosnmp.NoSuchObject}
+					}
+					pdu.Name = v.Name
+					vars = append(vars, pdu)
+				case gosnmp.GetNextRequest:
+					vars = append(vars, next(v.Name))
+				case gosnmp.GetBulkRequest:
+					oid := v.Name
+					for i := uint32(0); i < req.MaxRepetitions; i++ {
+						pdu := next(oid)
+						vars = append(vars, pdu)
+						if pdu.Type == gosnmp.EndOfMibView {
+							break
+						}
+						oid = pdu.Name
+					}
+				}
+			}
+			res := &gosnmp.SnmpPacket{
+				Version:   gosnmp.Version2c,
+				Community: community,
+				PDUType:   gosnmp.GetResponse,
+				RequestID: req.RequestID,
+				Variables: vars,
+			}
+			if b, err := res.MarshalMsg(); err == nil {
+				conn.WriteTo(b, addr)
+			}
+		}
+	}()
+	return uint16(conn.LocalAddr().(*net.UDPAddr).Port)
+}
+
+func TestSNMPHealthCheck(t *testing.T) {
+	agentPort := startTestSNMPAgent(t, "public", map[string]gosnmp.SnmpPDU{
+		// hrDeviceTable: 1 はネットワークカード、2 がプリンターです。
+		oidHrDeviceType + ".1": {Type: gosnmp.ObjectIdentifier, Value: ".1.3.6.1.2.1.25.3.1.4"},
+		oidHrDeviceType + ".2": {Type: gosnmp.ObjectIdentifier, Value: oidHrDevicePrinter},
+		// プリンターのデバイスは用紙少ないとトナー少ない (警告のみ)、他のインデックスの値は使いません。
+		oidHrPrinterDetectedErrorState + ".1": {Type: gosnmp.OctetString, Value: []byte{0x40}},
+		oidHrPrinterDetectedErrorState + ".2": {Type: gosnmp.OctetString, Value: []byte{0xa0}},
+
+		oidPrtMarkerSuppliesDescription + ".1.1":  {Type: gosnmp.OctetString, Value: []byte("Black Toner")},
+		oidPrtMarkerSuppliesDescription + ".1.2":  {Type: gosnmp.OctetString, Value: []byte("Cyan Toner")},
+		oidPrtMarkerSuppliesDescription + ".1.10": {Type: gosnmp.OctetString, Value: []byte("Waste Toner Box")},
+		oidPrtMarkerSuppliesMaxCapacity + ".1.1":  {Type: gosnmp.Integer, Value: 1000},
+		oidPrtMarkerSuppliesMaxCapacity + ".1.2":  {Type: gosnmp.Integer, Value: 200},
+		oidPrtMarkerSuppliesMaxCapacity + ".1.10": {Type: gosnmp.Integer, Value: -2},
+		oidPrtMarkerSuppliesLevel + ".1.1":        {Type: gosnmp.Integer, Value: 50},
+		oidPrtMarkerSuppliesLevel + ".1.2":        {Type: gosnmp.Integer, Value: 100},
+		oidPrtMarkerSuppliesLevel + ".1.10":       {Type: gosnmp.Integer, Value: -3},
+
+		oidPrtInputName + ".1.1":         {Type: gosnmp.OctetString, Value: []byte("Tray 1")},
+		oidPrtInputName + ".1.2":         {Type: gosnmp.OctetString, Value: []byte("Tray 2")},
+		oidPrtInputMaxCapacity + ".1.1":  {Type: gosnmp.Integer, Value: 500},
+		oidPrtInputMaxCapacity + ".1.2":  {Type: gosnmp.Integer, Value: 500},
+		oidPrtInputCurrentLevel + ".1.1": {Type: gosnmp.Integer, Value: 0},
+		oidPrtInputCurrentLevel + ".1.2": {Type: gosnmp.Integer, Value: 250},
+
+		oidPrtMarkerLifeCount + ".1.1": {Type: gosnmp.Counter32, Value: uint32(12345)},
+	})
+
+	// RAWポートの代わりに、TCPの接続確認に応答するだけのリスナーを使います。
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+
+	alerts := make(chan supplyAlert, 10)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var a supplyAlert
+		if err := json.NewDecoder(r.Body).Decode(&a); err != nil {
+			t.Errorf("Webhookの本文: %v", err)
+		}
+		alerts <- a
+	}))
+	defer webhook.Close()
+
+	savedPort, savedMonitor, savedAlerts := snmpPort, printerHealthMonitor, supplyAlerts
+	snmpPort = agentPort
+	printerHealthMonitor = &healthMonitor{devices: make(map[string]*printerHealth)}
+	supplyAlerts = &supplyAlerter{alerted: make(map[string]bool)}
+	defer func() { snmpPort, printerHealthMonitor, supplyAlerts = savedPort, savedMonitor, savedAlerts }()
+
+	device := fmt.Sprintf("socket://%s", ln.Addr())
+	cfg := &Config{
+		NetworkPrinters: []NetworkPrinterConfig{{Name: "label", URI: device, SNMPCommunity: "public"}},
+		Health:          HealthConfig{SupplyThresholdPercent: 20, AlertWebhookURL: webhook.URL},
+	}
+	// 2回確認しても、しきい値を下回ったままの消耗品は1回だけ通知します。
+	printerHealthMonitor.checkAll(cfg)
+	printerHealthMonitor.checkAll(cfg)
+
+	h := printerHealthMonitor.get(printTarget{Backend: "socket", Device: device})
+	if h.State != healthOnline || !reflect.DeepEqual(h.Reasons, []string{"paper-low", "toner-low"}) {
+		t.Errorf("状態 = %s %v; want online [paper-low toner-low]", h.State, h.Reasons)
+	}
+	if h.Supplies == nil {
+		t.Fatal("消耗品を取得していません")
+	}
+	wantSupplies := []supplyLevel{
+		{Name: "Black Toner", Level: 50, MaxCapacity: 1000, Percent: 5},
+		{Name: "Cyan Toner", Level: 100, MaxCapacity: 200, Percent: 50},
+		{Name: "Waste Toner Box", Level: -3, MaxCapacity: -2, Percent: -1},
+	}
+	if !reflect.DeepEqual(h.Supplies.Supplies, wantSupplies) {
+		t.Errorf("消耗品 = %+v; want %+v", h.Supplies.Supplies, wantSupplies)
+	}
+	wantTrays := []trayState{
+		{Name: "Tray 1", Level: 0, MaxCapacity: 500, Empty: true},
+		{Name: "Tray 2", Level: 250, MaxCapacity: 500},
+	}
+	if !reflect.DeepEqual(h.Supplies.Trays, wantTrays) {
+		t.Errorf("トレイ = %+v; want %+v", h.Supplies.Trays, wantTrays)
+	}
+	if h.Supplies.PageCount != 12345 {
+		t.Errorf("ページ数 = %d; want 12345", h.Supplies.PageCount)
+	}
+
+	select {
+	case a := <-alerts:
+		if a.Device != device || a.Supply != "Black Toner" || a.Percent != 5 || a.Threshold != 20 {
+			t.Errorf("通知 = %+v; want Black Toner 5%% (しきい値 20%%)", a)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Webhookに通知が届きませんでした")
+	}
+	select {
+	case a := <-alerts:
+		t.Errorf("余分な通知 = %+v", a)
+	default:
+	}
+
+	rec := httptest.NewRecorder()
+	metricsHandler(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	metrics := rec.Body.String()
+	for _, line := range []string{
+		fmt.Sprintf("print_service_printer_up{device=%q} 1", device),
+		fmt.Sprintf("print_service_supply_level_percent{device=%q,supply=\"Black Toner\"} 5", device),
+		fmt.Sprintf("print_service_supply_level_percent{device=%q,supply=\"Cyan Toner\"} 50", device),
+		fmt.Sprintf("print_service_tray_level{device=%q,tray=\"Tray 1\"} 0", device),
+		fmt.Sprintf("print_service_page_count_total{device=%q} 12345", device),
+	} {
+		if !strings.Contains(metrics, line+"\n") {
+			t.Errorf("メトリクスに %q がありません:\n%s", line, metrics)
+		}
+	}
+	if strings.Contains(metrics, "Waste Toner Box") {
+		t.Errorf("残量が不明な消耗品はメトリクスに含めません:\n%s", metrics)
+	}
+}
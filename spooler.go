@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// PDFtoPrinter は両面、向き、用紙サイズ、トレイ、カラーなどの設定を引数で受け付けません。
+// プリンターの既定の印刷設定 (PrintTicket) を書き換えると、同じプリンターを使う他のユーザーやアプリケーションのジョブにも反映されるため、
+// これらのオプションが指定されたジョブは SumatraPDF の -print-settings で、そのジョブの DEVMODE にだけ反映して印刷します。
+
+// sumatraPaperNames は SumatraPDF の paper= で名前を指定できる用紙サイズです。キーは knownMediaSizes のキーです。
+var sumatraPaperNames = map[string]string{
+	"a3":     "A3",
+	"a4":     "A4",
+	"a5":     "A5",
+	"a6":     "A6",
+	"letter": "letter",
+	"legal":  "legal",
+}
+
+// sumatraPaperKinds は SumatraPDF の paper= で名前を指定できない用紙サイズの、paperkind= に指定する番号 (DMPAPER_*) です。
+var sumatraPaperKinds = map[string]int{
+	"b4": 12, // DMPAPER_B4 (JIS B4)
+	"b5": 13, // DMPAPER_B5 (JIS B5)
+}
+
+// checkSpoolerOptions はスプーラーのバックエンドでジョブごとに反映できないオプションが指定されている場合にエラーを返します。
+func checkSpoolerOptions(options map[string]string) error {
+	opts, err := parsePrintOptions(options, 0)
+	if err != nil {
+		return err
+	}
+	_, err = spoolerPrintSettings(opts)
+	return err
+}
+
+// spoolerPaper は用紙サイズを SumatraPDF の -print-settings の指定に変換します。名前で指定できない任意サイズの場合は false を返します。
+func spoolerPaper(media string) (string, bool) {
+	key := strings.ToLower(media)
+	if name, ok := sumatraPaperNames[key]; ok {
+		return "paper=" + name, true
+	}
+	if kind, ok := sumatraPaperKinds[key]; ok {
+		return fmt.Sprintf("paperkind=%d", kind), true
+	}
+	return "", false
+}
+
+// spoolerPrintSettings は印刷オプションを SumatraPDF の -print-settings に指定する値に変換します。
+// 拡大縮小は送信する前にPDFへ反映しているため、SumatraPDF では拡大縮小しません (noscale)。
+func spoolerPrintSettings(opts printOptions) (string, error) {
+	settings := []string{"noscale"}
+	if opts.Pages != "" {
+		settings = append(settings, opts.Pages)
+	}
+	if opts.Copies > 1 {
+		settings = append(settings, fmt.Sprintf("%dx", opts.Copies))
+	}
+	switch opts.Duplex {
+	case "simplex":
+		settings = append(settings, "simplex")
+	case "long-edge":
+		settings = append(settings, "duplexlong")
+	case "short-edge":
+		settings = append(settings, "duplexshort")
+	}
+	if opts.Orientation != "" {
+		settings = append(settings, opts.Orientation)
+	}
+	if opts.Color != "" {
+		settings = append(settings, opts.Color)
+	}
+	if opts.Media != "" && !strings.EqualFold(opts.Media, mediaAuto) {
+		paper, ok := spoolerPaper(opts.Media)
+		if !ok {
+			return "", fmt.Errorf("スプーラーのプリンターには任意サイズの用紙 '%s' をジョブごとに指定できません (ipp または socket のバックエンドを使用してください)", opts.Media)
+		}
+		settings = append(settings, paper)
+	}
+	if opts.Tray != "" {
+		// -print-settings はカンマ区切りのため、カンマを含むトレイ名は指定できません。
+		if strings.Contains(opts.Tray, ",") {
+			return "", fmt.Errorf("スプーラーのプリンターにはカンマを含むトレイ名 '%s' を指定できません", opts.Tray)
+		}
+		settings = append(settings, "bin="+opts.Tray)
+	}
+	return strings.Join(settings, ","), nil
+}
+
+// sumatraPrint は SumatraPDF を使って、印刷設定をジョブごとに指定してPDFを印刷します。
+// SumatraPDF の実行ファイルは環境変数 SUMATRA_PDF_PATH、未設定の場合は現在のディレクトリの SumatraPDF.exe を使用します。
+func sumatraPrint(documentPath, printerName, settings string, timeout time.Duration) error {
+	executablePath := os.Getenv("SUMATRA_PDF_PATH")
+	if executablePath == "" {
+		currentDir, err := os.Getwd()
+		if err != nil {
+			return notSent(fmt.Errorf("現在のディレクトリの取得に失敗しました: %w", err))
+		}
+		executablePath = filepath.Join(currentDir, "SumatraPDF.exe")
+	}
+	if _, err := os.Stat(executablePath); err != nil {
+		return notSent(fmt.Errorf("SumatraPDF が '%s' に見つかりませんでした: %w", executablePath, err))
+	}
+
+	cmd := exec.Command(executablePath, "-print-to", printerName, "-print-settings", settings, "-silent", "-exit-when-done", documentPath)
+	log.Printf("印刷コマンドを実行しています: %s", strings.Join(cmd.Args, " "))
+	fmt.Printf("Executing print command: %s\n", strings.Join(cmd.Args, " ")) // デバッグ用ログ
+	return runPrintCommand(cmd, timeout)
+}
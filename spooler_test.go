@@ -0,0 +1,40 @@
+package main
+
+import "testing"
+
+func TestSpoolerPrintSettings(t *testing.T) {
+	tests := []struct {
+		name    string
+		options map[string]string
+		want    string
+		wantErr bool
+	}{
+		{"指定なし", map[string]string{}, "noscale", false},
+		{"部数とページ範囲", map[string]string{"copies": "3", "pages": "1-3, 7"}, "noscale,1-3,7,3x", false},
+		{"両面と向き", map[string]string{"duplex": "long-edge", "orientation": "Landscape"}, "noscale,duplexlong,landscape", false},
+		{"短辺とじと白黒", map[string]string{"duplex": "short-edge", "color": "mono"}, "noscale,duplexshort,monochrome", false},
+		{"片面とカラー", map[string]string{"duplex": "simplex", "color": "color"}, "noscale,simplex,color", false},
+		{"名前で指定する用紙とトレイ", map[string]string{"media": "a4", "tray": "Tray 2"}, "noscale,paper=A4,bin=Tray 2", false},
+		{"番号で指定する用紙", map[string]string{"media": "B5"}, "noscale,paperkind=13", false},
+		{"任意サイズの用紙", map[string]string{"media": "100x150mm"}, "", true},
+		{"カンマを含むトレイ名", map[string]string{"tray": "Tray 1,2"}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts, err := parsePrintOptions(tt.options, 0)
+			if err != nil {
+				t.Fatalf("parsePrintOptions(%v): %v", tt.options, err)
+			}
+			got, err := spoolerPrintSettings(opts)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("spoolerPrintSettings(%v) = %q; want error", tt.options, got)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("spoolerPrintSettings(%v) = %q, %v; want %q", tt.options, got, err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pdfcpu/pdfcpu/pkg/api"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/model"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/types"
+)
+
+// 再印刷の「COPY」や「社外秘」、印刷したユーザーや日時などを、送信する直前にPDFの各ページへ重ねて印刷します。
+// 各クライアントで付ける必要がないよう、印刷オプション (プリセットや論理プリンターの options を含む) で指定します。
+
+// stampMargin はページの端に配置するスタンプの、用紙の端からの距離 (mm) です。
+const stampMargin = 10.0
+
+// stampPositions は stamp_position の値と pdfcpu の配置の対応です。
+var stampPositions = map[string]string{
+	"center":       "c",
+	"top-left":     "tl",
+	"top":          "tc",
+	"top-right":    "tr",
+	"left":         "l",
+	"right":        "r",
+	"bottom-left":  "bl",
+	"bottom":       "bc",
+	"bottom-right": "br",
+}
+
+// stamp はページに重ねて印刷するテキストまたは画像のスタンプです。
+type stamp struct {
+	Text     string  // stamp_text: 印刷する文字列 ({job_id} などのプレースホルダーを含みます)
+	Image    string  // stamp_image: 設定ファイルの stamp_images の名前
+	Position string  // stamp_position: center (省略時), top-left, top, top-right, left, right, bottom-left, bottom, bottom-right
+	Opacity  float64 // stamp_opacity: 不透明度 (0より大きく1以下、省略時は0.5)
+	Rotation float64 // stamp_rotation: 反時計回りの回転角度 (度、省略時は0)
+	FontSize float64 // stamp_font_size: 文字の大きさ (ポイント、省略時は中央が48、それ以外が12)
+	Color    string  // stamp_color: 文字の色 ("#RRGGBB"、省略時は "#808080")
+}
+
+// parseStamp は stamp_ で始まるオプションを解析します。stamp_text と stamp_image のどちらもない場合は ok が false です。
+func parseStamp(cfg *Config, options map[string]string) (s stamp, ok bool, err error) {
+	s = stamp{Text: options["stamp_text"], Image: options["stamp_image"], Position: "center", Opacity: 0.5, Color: "#808080"}
+	if v, ok := options["stamp_position"]; ok {
+		if _, known := stampPositions[strings.ToLower(v)]; !known {
+			return s, false, fmt.Errorf("stamp_position '%s' は center, top-left, top, top-right, left, right, bottom-left, bottom, bottom-right のいずれかで指定してください", v)
+		}
+		s.Position = strings.ToLower(v)
+	}
+	s.FontSize = 12
+	if s.Position == "center" {
+		s.FontSize = 48
+	}
+	if v, ok := options["stamp_opacity"]; ok {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || f <= 0 || f > 1 {
+			return s, false, fmt.Errorf("stamp_opacity '%s' は0より大きく1以下の数値で指定してください", v)
+		}
+		s.Opacity = f
+	}
+	if v, ok := options["stamp_rotation"]; ok {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || f < -180 || f > 180 {
+			return s, false, fmt.Errorf("stamp_rotation '%s' は-180から180までの角度で指定してください", v)
+		}
+		s.Rotation = f
+	}
+	if v, ok := options["stamp_font_size"]; ok {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || f < 4 || f > 300 {
+			return s, false, fmt.Errorf("stamp_font_size '%s' は4から300までの数値 (ポイント) で指定してください", v)
+		}
+		s.FontSize = f
+	}
+	if v, ok := options["stamp_color"]; ok {
+		if _, err := parseColor(v); err != nil {
+			return s, false, fmt.Errorf("stamp_color: %w", err)
+		}
+		s.Color = v
+	}
+	if s.Image != "" {
+		if _, known := cfg.StampImages[s.Image]; !known {
+			return s, false, fmt.Errorf("stamp_image '%s' は設定ファイルの stamp_images にありません", s.Image)
+		}
+	}
+	return s, s.Text != "" || s.Image != "", nil
+}
+
+// stampAnchor は stamp_position などの位置から、pdfcpu の配置と位置のずれ ("position:tr, offset:-28.35 -28.35") を返します。
+// 端に配置する場合は、プリンターの印刷できない範囲に掛からないよう内側にずらします。
+func stampAnchor(position string) string {
+	pos := stampPositions[position]
+	dx, dy := 0.0, 0.0
+	margin := stampMargin * pointsPerMM
+	if strings.Contains(pos, "l") {
+		dx = margin
+	} else if strings.Contains(pos, "r") {
+		dx = -margin
+	}
+	if strings.HasPrefix(pos, "t") {
+		dy = -margin
+	} else if strings.HasPrefix(pos, "b") {
+		dy = margin
+	}
+	return fmt.Sprintf("position:%s, offset:%.2f %.2f", pos, dx, dy)
+}
+
+// description は pdfcpu のスタンプの指定 ("position:c, rotation:45, ..." の形式) を返します。
+func (s stamp) description(text bool) string {
+	parts := []string{
+		stampAnchor(s.Position),
+		fmt.Sprintf("rotation:%g", s.Rotation),
+		fmt.Sprintf("opacity:%g", s.Opacity),
+	}
+	if text {
+		parts = append(parts,
+			"fontname:"+documentFont(),
+			fmt.Sprintf("points:%g", s.FontSize),
+			"scalefactor:1 abs",
+			"fillcolor:"+s.Color,
+		)
+	} else {
+		// 画像は元の大きさ (1ピクセルを1ポイント) で配置します。
+		parts = append(parts, "scalefactor:1 abs")
+	}
+	return strings.Join(parts, ", ")
+}
+
+// stampValues はスタンプの文字列のプレースホルダーに埋め込むジョブの情報です。
+type stampValues struct {
+	JobID    string
+	Printer  string
+	Document string
+	User     string
+	Time     time.Time
+}
+
+// expandJobPlaceholders は {job_id}, {printer}, {document}, {user}, {date}, {time}, {datetime} をジョブの情報に置き換えます。
+func expandJobPlaceholders(text string, v stampValues) string {
+	return strings.NewReplacer(
+		"{job_id}", v.JobID,
+		"{printer}", v.Printer,
+		"{document}", v.Document,
+		"{user}", v.User,
+		"{date}", v.Time.Format("2006-01-02"),
+		"{time}", v.Time.Format("15:04"),
+		"{datetime}", v.Time.Format("2006-01-02 15:04"),
+	).Replace(text)
+}
+
+// expandStampText はジョブの情報に加えて、{page} と {pages} (ページ番号と総ページ数) を置き換えます。
+// {page} と {pages} は pdfcpu がページごとに置き換えます。
+func expandStampText(text string, v stampValues) string {
+	return strings.NewReplacer("{page}", "%p", "{pages}", "%P").Replace(expandJobPlaceholders(text, v))
+}
+
+// applyStamp はスタンプを各ページに重ねた新しいPDFを作成し、そのパスを返します。スタンプが指定されていない場合は元のパスを返します。
+// 画像とテキストの両方が指定された場合は、画像の上にテキストを重ねます。
+func applyStamp(documentPath string, options map[string]string, values stampValues) (string, error) {
+	s, ok, err := parseStamp(appConfig, options)
+	if err != nil || !ok {
+		return documentPath, err
+	}
+	dst := derivedPath(documentPath, "stamped")
+	src := documentPath
+	if s.Image != "" {
+		wm, err := api.ImageWatermark(appConfig.StampImages[s.Image], s.description(false), true, false, types.POINTS)
+		if err != nil {
+			return "", fmt.Errorf("スタンプの画像 '%s' を読み込めませんでした: %w", s.Image, err)
+		}
+		if err := addStamp(src, dst, nil, wm); err != nil {
+			return "", err
+		}
+		src = dst
+	}
+	if s.Text != "" {
+		wm, err := api.TextWatermark(expandStampText(s.Text, values), s.description(true), true, false, types.POINTS)
+		if err != nil {
+			return "", fmt.Errorf("スタンプの文字列を作成できませんでした: %w", err)
+		}
+		if err := addStamp(src, dst, nil, wm); err != nil {
+			return "", err
+		}
+	}
+	return dst, nil
+}
+
+// addStamp は src のページ (pages が nil の場合は全ページ) にスタンプを重ねて dst に保存します。src と dst は同じパスでも構いません。
+func addStamp(src, dst string, pages []string, wm *model.Watermark) error {
+	if err := api.AddWatermarksFile(src, dst, pages, wm, pdfConfig()); err != nil {
+		return fmt.Errorf("スタンプの追加に失敗しました: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/draw"
+	"image/png"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pdfcpu/pdfcpu/pkg/api"
+)
+
+func TestParseStamp(t *testing.T) {
+	cfg := &Config{StampImages: map[string]string{"approved": `C:\stamps\approved.png`}}
+	tests := []struct {
+		name    string
+		options map[string]string
+		want    stamp
+		ok      bool
+		wantErr bool
+	}{
+		{"指定なし", map[string]string{"copies": "2"}, stamp{Position: "center", Opacity: 0.5, FontSize: 48, Color: "#808080"}, false, false},
+		{"テキストだけ", map[string]string{"stamp_text": "COPY"}, stamp{Text: "COPY", Position: "center", Opacity: 0.5, FontSize: 48, Color: "#808080"}, true, false},
+		{"端の位置は小さい文字", map[string]string{"stamp_text": "{user}", "stamp_position": "Top-Right"}, stamp{Text: "{user}", Position: "top-right", Opacity: 0.5, FontSize: 12, Color: "#808080"}, true, false},
+		{"すべて指定", map[string]string{
+			"stamp_text": "社外秘", "stamp_position": "bottom", "stamp_opacity": "1", "stamp_rotation": "-45",
+			"stamp_font_size": "20", "stamp_color": "#FF0000",
+		}, stamp{Text: "社外秘", Position: "bottom", Opacity: 1, Rotation: -45, FontSize: 20, Color: "#FF0000"}, true, false},
+		{"設定ファイルの画像", map[string]string{"stamp_image": "approved"}, stamp{Image: "approved", Position: "center", Opacity: 0.5, FontSize: 48, Color: "#808080"}, true, false},
+		{"設定ファイルにない画像", map[string]string{"stamp_image": "rejected"}, stamp{}, false, true},
+		{"不明な位置", map[string]string{"stamp_text": "COPY", "stamp_position": "middle"}, stamp{}, false, true},
+		{"不透明度0", map[string]string{"stamp_text": "COPY", "stamp_opacity": "0"}, stamp{}, false, true},
+		{"不透明度が1を超える", map[string]string{"stamp_text": "COPY", "stamp_opacity": "1.5"}, stamp{}, false, true},
+		{"回転が範囲外", map[string]string{"stamp_text": "COPY", "stamp_rotation": "270"}, stamp{}, false, true},
+		{"文字が小さすぎる", map[string]string{"stamp_text": "COPY", "stamp_font_size": "3"}, stamp{}, false, true},
+		{"色の形式が正しくない", map[string]string{"stamp_text": "COPY", "stamp_color": "red"}, stamp{}, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, ok, err := parseStamp(cfg, tt.options)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("parseStamp(%v) = %+v; want error", tt.options, s)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseStamp(%v): %v", tt.options, err)
+			}
+			if s != tt.want || ok != tt.ok {
+				t.Errorf("parseStamp(%v) = %+v, %t; want %+v, %t", tt.options, s, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func TestExpandStampText(t *testing.T) {
+	values := stampValues{
+		JobID:    "0123456789abcdef",
+		Printer:  "2F-color",
+		Document: "invoice.pdf",
+		User:     "tanaka",
+		Time:     time.Date(2026, 3, 31, 9, 5, 0, 0, time.Local),
+	}
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"COPY", "COPY"},
+		{"{job_id} {printer} {document}", "0123456789abcdef 2F-color invoice.pdf"},
+		{"{user} {date} {time}", "tanaka 2026-03-31 09:05"},
+		{"{datetime}", "2026-03-31 09:05"},
+		{"{page}/{pages}", "%p/%P"},
+		{"{unknown}", "{unknown}"},
+	}
+	for _, tt := range tests {
+		if got := expandStampText(tt.text, values); got != tt.want {
+			t.Errorf("expandStampText(%q) = %q; want %q", tt.text, got, tt.want)
+		}
+	}
+}
+
+// writeTestPNG はスタンプに使用する小さな画像を作成します。
+func writeTestPNG(t *testing.T) string {
+	t.Helper()
+	img := image.NewGray(image.Rect(0, 0, 40, 20))
+	draw.Draw(img, img.Bounds(), image.Black, image.Point{}, draw.Src)
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	p := filepath.Join(t.TempDir(), "approved.png")
+	if err := os.WriteFile(p, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestApplyStamp(t *testing.T) {
+	saved := appConfig
+	appConfig = &Config{StampImages: map[string]string{"approved": writeTestPNG(t)}}
+	t.Cleanup(func() { appConfig = saved })
+	values := stampValues{JobID: "0123456789abcdef", User: "tanaka", Time: time.Now()}
+
+	t.Run("指定なし", func(t *testing.T) {
+		src := writeTestPDF(t, "plain.pdf", 1)
+		got, err := applyStamp(src, map[string]string{"copies": "2"}, values)
+		if err != nil || got != src {
+			t.Errorf("applyStamp() = %q, %v; want %q", got, err, src)
+		}
+	})
+
+	for _, tt := range []struct {
+		name    string
+		options map[string]string
+	}{
+		{"テキスト", map[string]string{"stamp_text": "COPY {job_id} {page}/{pages}", "stamp_position": "bottom-right"}},
+		{"画像", map[string]string{"stamp_image": "approved", "stamp_position": "top-left"}},
+		{"画像とテキスト", map[string]string{"stamp_image": "approved", "stamp_text": "{user}"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			src := writeTestPDF(t, "invoice.pdf", 3)
+			dst, err := applyStamp(src, tt.options, values)
+			if err != nil {
+				t.Fatalf("applyStamp: %v", err)
+			}
+			if dst == src {
+				t.Fatalf("applyStamp() returned the source path")
+			}
+			ctx := readTestPDF(t, dst)
+			if ctx.PageCount != 3 {
+				t.Errorf("PageCount = %d; want 3", ctx.PageCount)
+			}
+			if want := [][2]int{{595, 842}, {595, 842}, {595, 842}}; !reflect.DeepEqual(testPageSizes(t, ctx), want) {
+				t.Errorf("page sizes = %v; want %v", testPageSizes(t, ctx), want)
+			}
+			if ok, err := api.HasWatermarksFile(dst, pdfConfig()); err != nil || !ok {
+				t.Errorf("HasWatermarksFile() = %t, %v; want true", ok, err)
+			}
+			// 元のページの内容を残したまま、すべてのページにスタンプを重ねます。
+			for pageNr := 1; pageNr <= ctx.PageCount; pageNr++ {
+				content := testPageContent(t, ctx, pageNr)
+				if !strings.Contains(content, "re f") || !strings.Contains(content, "Do") {
+					t.Errorf("%dページ目のコンテンツにページの内容とスタンプがありません: %q", pageNr, content)
+				}
+			}
+		})
+	}
+}
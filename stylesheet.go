@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ElementStyle はMarkdownとHTMLを変換するときの要素ごとの表示方法です。
+// 省略した項目は組み込みのスタイルシートの値を使用します。
+type ElementStyle struct {
+	Scale       float64 `json:"scale"`        // 本文の文字の大きさ (font_size) に対する倍率
+	Bold        *bool   `json:"bold"`         // 太字にするかどうか
+	Italic      *bool   `json:"italic"`       // 斜体にするかどうか
+	Color       string  `json:"color"`        // 文字の色 ("#RRGGBB")
+	Background  string  `json:"background"`   // 背景の色 ("#RRGGBB")。コードブロックと表の見出しで使用します
+	SpaceBefore float64 `json:"space_before"` // 要素の前の間隔 (ポイント)
+	SpaceAfter  float64 `json:"space_after"`  // 要素の後の間隔 (ポイント)
+	Indent      float64 `json:"indent"`       // 左の字下げ (ポイント)
+	Border      *bool   `json:"border"`       // 見出しの下線、引用の左の線、表の罫線を描画するかどうか
+}
+
+// Stylesheet は要素名 (h1〜h6, p, li, pre, code, blockquote, table, th, td, a, hr) からスタイルへの対応表です。
+type Stylesheet map[string]ElementStyle
+
+// defaultStylesheet は組み込みのスタイルシートです。
+var defaultStylesheet = Stylesheet{
+	"h1":         {Scale: 2.0, Bold: boolPtr(true), SpaceBefore: 12, SpaceAfter: 8, Border: boolPtr(true)},
+	"h2":         {Scale: 1.6, Bold: boolPtr(true), SpaceBefore: 12, SpaceAfter: 6, Border: boolPtr(true)},
+	"h3":         {Scale: 1.3, Bold: boolPtr(true), SpaceBefore: 10, SpaceAfter: 4},
+	"h4":         {Scale: 1.15, Bold: boolPtr(true), SpaceBefore: 8, SpaceAfter: 4},
+	"h5":         {Scale: 1.0, Bold: boolPtr(true), SpaceBefore: 6, SpaceAfter: 2},
+	"h6":         {Scale: 0.9, Bold: boolPtr(true), Color: "#555555", SpaceBefore: 6, SpaceAfter: 2},
+	"p":          {Scale: 1.0, SpaceAfter: 6},
+	"li":         {Scale: 1.0, SpaceAfter: 2, Indent: 16},
+	"pre":        {Scale: 0.9, Background: "#F2F2F2", SpaceBefore: 2, SpaceAfter: 8},
+	"code":       {Scale: 1.0, Color: "#A0303A"},
+	"blockquote": {Scale: 1.0, Color: "#555555", SpaceAfter: 6, Indent: 14, Border: boolPtr(true)},
+	"table":      {Scale: 0.95, SpaceBefore: 2, SpaceAfter: 8, Border: boolPtr(true)},
+	"th":         {Bold: boolPtr(true), Background: "#E6E6E6"},
+	"td":         {},
+	"a":          {Color: "#1A4FB4"},
+	"hr":         {SpaceBefore: 6, SpaceAfter: 6, Color: "#999999"},
+}
+
+// boolPtr は b へのポインターを返します。
+func boolPtr(b bool) *bool { return &b }
+
+// mergeStylesheet は組み込みのスタイルシートに、設定ファイルのスタイルシートで指定された項目を上書きしたものを返します。
+func mergeStylesheet(custom Stylesheet) Stylesheet {
+	merged := make(Stylesheet, len(defaultStylesheet))
+	for name, s := range defaultStylesheet {
+		merged[name] = s
+	}
+	for name, c := range custom {
+		s := merged[name]
+		if c.Scale > 0 {
+			s.Scale = c.Scale
+		}
+		if c.Bold != nil {
+			s.Bold = c.Bold
+		}
+		if c.Italic != nil {
+			s.Italic = c.Italic
+		}
+		if c.Color != "" {
+			s.Color = c.Color
+		}
+		if c.Background != "" {
+			s.Background = c.Background
+		}
+		if c.SpaceBefore > 0 {
+			s.SpaceBefore = c.SpaceBefore
+		}
+		if c.SpaceAfter > 0 {
+			s.SpaceAfter = c.SpaceAfter
+		}
+		if c.Indent > 0 {
+			s.Indent = c.Indent
+		}
+		if c.Border != nil {
+			s.Border = c.Border
+		}
+		merged[name] = s
+	}
+	return merged
+}
+
+// validate はスタイルシートの要素名と色を検証します。
+func (s Stylesheet) validate() error {
+	for name, style := range s {
+		if _, ok := defaultStylesheet[name]; !ok {
+			return fmt.Errorf("要素 '%s' はサポートされていません", name)
+		}
+		for _, c := range []string{style.Color, style.Background} {
+			if c == "" {
+				continue
+			}
+			if _, err := parseColor(c); err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// lookupStylesheet は stylesheet オプションで指定されたスタイルシートを返します。
+// 名前が空の場合は、設定ファイルの "default" (なければ組み込みのスタイルシート) を使用します。
+func lookupStylesheet(cfg *Config, name string) (Stylesheet, error) {
+	custom, ok := cfg.Stylesheets[name]
+	if name == "" {
+		custom = cfg.Stylesheets["default"]
+	} else if !ok {
+		return nil, fmt.Errorf("スタイルシート '%s' は設定ファイルにありません", name)
+	}
+	return mergeStylesheet(custom), nil
+}
+
+// parseColor は "#RRGGBB" (または "#RGB") 形式の色を解析します。
+func parseColor(s string) (rgbColor, error) {
+	hex := strings.TrimPrefix(s, "#")
+	if len(hex) == 3 {
+		hex = string([]byte{hex[0], hex[0], hex[1], hex[1], hex[2], hex[2]})
+	}
+	v, err := strconv.ParseUint(hex, 16, 32)
+	if err != nil || len(hex) != 6 || !strings.HasPrefix(s, "#") {
+		return rgbColor{}, fmt.Errorf("色 '%s' は #RRGGBB の形式で指定してください", s)
+	}
+	return rgbColor{R: float64(v>>16&0xff) / 255, G: float64(v>>8&0xff) / 255, B: float64(v&0xff) / 255}, nil
+}
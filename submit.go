@@ -0,0 +1,539 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// defaultUploadMaxSize はドキュメントの最大サイズが設定されていない場合の値です。
+const defaultUploadMaxSize = 500 << 20 // 500MB
+
+// maxFormFieldSize は multipart/form-data のドキュメント以外のフィールド1つの最大サイズです。
+const maxFormFieldSize = 64 << 10
+
+// uploadMaxSize は受け付けるドキュメントの最大サイズ (バイト) を返します。
+func uploadMaxSize(cfg UploadConfig) int64 {
+	if cfg.MaxSizeMB > 0 {
+		return int64(cfg.MaxSizeMB) << 20
+	}
+	return defaultUploadMaxSize
+}
+
+// documentTooLarge はドキュメントが最大サイズを超えた場合のエラーを作成します。
+func documentTooLarge(maxSize int64) error {
+	return &submissionError{Status: http.StatusRequestEntityTooLarge, Err: fmt.Errorf("ドキュメントが最大サイズ %dMB を超えています", maxSize>>20)}
+}
+
+// sizeLimitReader は最大サイズを超えて読み込んだ時点で 413 のエラーを返す io.Reader です。
+// ドキュメントをメモリに溜めずにスプールファイルへ書き込みながらサイズを確認するために使用します。
+type sizeLimitReader struct {
+	r   io.Reader
+	n   int64
+	max int64
+}
+
+func (l *sizeLimitReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	l.n += int64(n)
+	if l.n > l.max {
+		return n, documentTooLarge(l.max)
+	}
+	return n, err
+}
+
+// maxSubmittedDocuments は1回のリクエスト (ZIPの展開後を含む) で受け付けるドキュメントの最大数です。
+const maxSubmittedDocuments = 1000
+
+// submittedDocument はスプールディレクトリに保存したドキュメント1つです。
+type submittedDocument struct {
+	Name      string // クライアントが指定したファイル名 (ZIPの場合はエントリー名)
+	Path      string // スプールディレクトリに保存したファイルのパス
+	Encrypted bool   // 暗号化されたPDFを復号したものかどうか
+}
+
+// printSubmission は /print-pdf のリクエストから読み取った印刷の内容です。
+// multipart/form-data、application/pdf、application/json のいずれの形式でも同じ内容になります。
+// Documents はリクエストでの順番どおりに並びます。
+type printSubmission struct {
+	Printer   string
+	Preset    string
+	Password  string            // 暗号化されたPDFを開くパスワード (ログやレスポンスには出力しません)
+	Options   map[string]string // リクエストで指定された印刷オプション
+	Documents []submittedDocument
+}
+
+// addDocument はドキュメントを保存して追加します。ZIPアーカイブの場合は展開した各ファイルを追加します。
+// contentType はクライアントが指定した Content-Type です (ない場合は空文字列)。
+// サイズの制限が必要な場合は、src に sizeLimitReader を渡してください。
+func (s *printSubmission) addDocument(name, contentType string, src io.Reader) error {
+	if len(s.Documents) >= maxSubmittedDocuments {
+		return badRequest("ドキュメントは1回のリクエストで%d個までです", maxSubmittedDocuments)
+	}
+	path, err := spoolDocument(name, src)
+	if err != nil {
+		return err
+	}
+	return s.addSpooled(name, contentType, path)
+}
+
+// addSpooled は保存済みのドキュメントを追加します。ZIPアーカイブの場合は展開した各ファイルを追加します。
+func (s *printSubmission) addSpooled(name, contentType, path string) error {
+	if name == "" {
+		name = filepath.Base(path)
+	}
+	if !isZipArchive(name, contentType) {
+		s.Documents = append(s.Documents, submittedDocument{Name: name, Path: path})
+		return nil
+	}
+	defer os.Remove(path)
+	return expandZipArchive(path, s)
+}
+
+// removeDocuments は保存したドキュメントをすべて削除します。リクエストを受け付けなかった場合や、結合する前のドキュメントに使用します。
+func (s *printSubmission) removeDocuments() {
+	for _, doc := range s.Documents {
+		os.Remove(doc.Path)
+	}
+	s.Documents = nil
+}
+
+// submissionError はリクエストの読み取りに失敗した理由と、返すHTTPステータスです。
+type submissionError struct {
+	Status int
+	Err    error
+}
+
+func (e *submissionError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *submissionError) Unwrap() error {
+	return e.Err
+}
+
+// badRequest は 400 Bad Request として返すエラーを作成します。
+func badRequest(format string, args ...interface{}) error {
+	return &submissionError{Status: http.StatusBadRequest, Err: fmt.Errorf(format, args...)}
+}
+
+// submissionStatus はエラーに対応するHTTPステータスを返します。
+func submissionStatus(err error) int {
+	var se *submissionError
+	if errors.As(err, &se) {
+		return se.Status
+	}
+	var me *http.MaxBytesError
+	if errors.As(err, &me) {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusInternalServerError
+}
+
+// readSubmission はリクエストの Content-Type に応じて印刷の内容を読み取り、ドキュメントをスプールディレクトリに保存します。
+func readSubmission(w http.ResponseWriter, r *http.Request) (*printSubmission, error) {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, badRequest("Content-Type が正しくありません: %v", err)
+	}
+	sub := &printSubmission{}
+	switch mediaType {
+	case "multipart/form-data":
+		err = readMultipartSubmission(r, sub)
+	case "application/x-www-form-urlencoded":
+		err = readURLFormSubmission(r, sub)
+	case "application/pdf", "application/zip", "image/png", "image/jpeg", "image/gif", "image/tiff", "text/plain", "text/csv", "text/tab-separated-values", "text/markdown", "text/html":
+		err = readRawSubmission(r, mediaType, sub)
+	case "application/json":
+		err = readJSONSubmission(w, r, sub)
+	default:
+		return nil, &submissionError{
+			Status: http.StatusUnsupportedMediaType,
+			Err:    fmt.Errorf("Content-Type '%s' はサポートされていません (multipart/form-data, application/x-www-form-urlencoded, application/pdf, application/zip, image/png, image/jpeg, image/gif, image/tiff, text/plain, text/csv, text/markdown, text/html, application/json)", mediaType),
+		}
+	}
+	if err == nil && len(sub.Documents) == 0 {
+		err = badRequest("ドキュメントがありません (ZIPアーカイブが空の可能性があります)")
+	}
+	if err != nil {
+		// 途中で失敗した場合は、保存済みのドキュメントを削除します。
+		sub.removeDocuments()
+		return nil, err
+	}
+	return sub, nil
+}
+
+// readMultipartSubmission は multipart/form-data の document ファイルと printer などのフィールドを読み取ります。
+// フォーム全体をメモリに読み込まず、document のパートはそのままスプールファイルに書き込みます。
+// document は複数指定でき、ZIPアーカイブも受け付けます。
+func readMultipartSubmission(r *http.Request, sub *printSubmission) error {
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return badRequest("マルチパートフォームのパースに失敗しました: %v", err)
+	}
+	fields, err := readMultipartParts(reader, sub, uploadMaxSize(appConfig.Uploads))
+	if err != nil {
+		return err
+	}
+
+	sub.Printer = fields.Get("printer")
+	sub.Preset = fields.Get("preset")
+	sub.Password = fields.Get("password")
+	sub.Options = requestOptions(fields)
+	// document ファイルの代わりに url が指定された場合は、サービスがドキュメントをダウンロードします。
+	for _, u := range fields["url"] {
+		if err := sub.download(u); err != nil {
+			return err
+		}
+	}
+	if len(sub.Documents) == 0 {
+		return badRequest("フォームデータに'document'ファイルがありません")
+	}
+	return nil
+}
+
+// readMultipartParts はパートを順に読み、document をスプールファイルに保存して sub に追加し、その他のフィールドを返します。
+// 最大サイズはリクエスト全体のドキュメントの合計に適用します。
+func readMultipartParts(reader *multipart.Reader, sub *printSubmission, maxSize int64) (url.Values, error) {
+	fields := url.Values{}
+	var total int64
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return fields, nil
+		}
+		if err != nil {
+			return nil, badRequest("マルチパートフォームのパースに失敗しました: %v", err)
+		}
+		if part.FormName() == "document" {
+			// アップロードされたPDFファイルをスプールファイルに書き込みます。
+			counter := &sizeLimitReader{r: part, max: maxSize - total}
+			err = sub.addDocument(part.FileName(), part.Header.Get("Content-Type"), counter)
+			part.Close()
+			if err != nil {
+				return nil, err
+			}
+			total += counter.n
+			continue
+		}
+		value, err := io.ReadAll(io.LimitReader(part, maxFormFieldSize+1))
+		part.Close()
+		if err != nil {
+			return nil, badRequest("マルチパートフォームのパースに失敗しました: %v", err)
+		}
+		if len(value) > maxFormFieldSize {
+			return nil, badRequest("フォームデータの'%s'が大きすぎます", part.FormName())
+		}
+		fields.Add(part.FormName(), string(value))
+	}
+}
+
+// download は url のドキュメントをダウンロードして追加します。
+func (s *printSubmission) download(rawURL string) error {
+	if len(s.Documents) >= maxSubmittedDocuments {
+		return badRequest("ドキュメントは1回のリクエストで%d個までです", maxSubmittedDocuments)
+	}
+	path, name, contentType, err := downloadDocument(appConfig.Downloads, rawURL)
+	if err != nil {
+		return err
+	}
+	return s.addSpooled(name, contentType, path)
+}
+
+// readURLFormSubmission は application/x-www-form-urlencoded の url で指定されたドキュメントをダウンロードします。
+func readURLFormSubmission(r *http.Request, sub *printSubmission) error {
+	if err := r.ParseForm(); err != nil {
+		return badRequest("フォームのパースに失敗しました: %v", err)
+	}
+	if r.FormValue("url") == "" {
+		return badRequest("フォームデータに'url'がありません (ファイルを送信する場合は multipart/form-data を使用してください)")
+	}
+	sub.Printer = r.FormValue("printer")
+	sub.Preset = r.FormValue("preset")
+	sub.Password = r.FormValue("password")
+	sub.Options = requestOptions(r.Form)
+	for _, u := range r.Form["url"] {
+		if err := sub.download(u); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rawDocumentExtensions はファイル名が指定されなかったテキストのボディに付ける拡張子です。
+var rawDocumentExtensions = map[string]string{
+	"text/plain":                ".txt",
+	"text/csv":                  ".csv",
+	"text/tab-separated-values": ".tsv",
+	"text/markdown":             ".md",
+	"text/html":                 ".html",
+}
+
+// readRawSubmission は application/pdf (または application/zip、画像、テキスト) のボディをそのままドキュメントとして読み取ります。
+// プリンター名と印刷オプションはクエリパラメータ (printer, preset, copies など)、
+// またはヘッダー (X-Print-Printer, X-Print-Preset, X-Print-Copies など) で指定します。クエリパラメータが優先します。
+// パスワードはアクセスログに残らないよう、ヘッダー (X-Print-Password) で指定することを推奨します。
+func readRawSubmission(r *http.Request, mediaType string, sub *printSubmission) error {
+	query := r.URL.Query()
+	sub.Printer = firstNonEmpty(query.Get("printer"), r.Header.Get("X-Print-Printer"))
+	sub.Preset = firstNonEmpty(query.Get("preset"), r.Header.Get("X-Print-Preset"))
+	sub.Password = firstNonEmpty(query.Get("password"), r.Header.Get("X-Print-Password"))
+	sub.Options = mergeOptions(headerOptions(r.Header), requestOptions(query))
+
+	name := query.Get("filename")
+	if name == "" {
+		if _, params, err := mime.ParseMediaType(r.Header.Get("Content-Disposition")); err == nil {
+			name = params["filename"]
+		}
+	}
+	// テキストは拡張子で種類を判定するため、ファイル名がない場合は Content-Type に合わせた拡張子を付けます。
+	if ext, ok := rawDocumentExtensions[mediaType]; ok && name == "" {
+		name = newJobID() + ext
+	}
+	return sub.addDocument(name, mediaType, &sizeLimitReader{r: r.Body, max: uploadMaxSize(appConfig.Uploads)})
+}
+
+// jsonDocument は application/json で送信するドキュメント1つです。
+// document はPDFをBase64でエンコードしたものです ("data:application/pdf;base64," で始まるデータURLも受け付けます)。
+// document の代わりに url を指定すると、サービスがドキュメントをダウンロードします。
+type jsonDocument struct {
+	Filename string `json:"filename"`
+	Document string `json:"document"`
+	URL      string `json:"url"`
+}
+
+// jsonSubmission は application/json で送信する印刷リクエストです。
+// 複数のドキュメントを送信する場合は documents に並べます。
+type jsonSubmission struct {
+	Printer  string `json:"printer"`
+	Preset   string `json:"preset"`
+	Password string `json:"password"`
+	jsonDocument
+	Documents []jsonDocument         `json:"documents"`
+	Options   map[string]interface{} `json:"options"`
+}
+
+// readJSONSubmission は application/json のボディからBase64のドキュメントと印刷オプションを読み取ります。
+func readJSONSubmission(w http.ResponseWriter, r *http.Request, sub *printSubmission) error {
+	// JSONはデコードのためにメモリに読み込みます。大きなドキュメントは multipart/form-data か application/pdf で送信してください。
+	// Base64は元のデータの約4/3倍の大きさになるため、その分だけ上限を広げます。
+	body := http.MaxBytesReader(w, r.Body, uploadMaxSize(appConfig.Uploads)*4/3+maxFormFieldSize)
+	var req jsonSubmission
+	if err := json.NewDecoder(body).Decode(&req); err != nil {
+		var me *http.MaxBytesError
+		if errors.As(err, &me) {
+			return err
+		}
+		return badRequest("JSONのパースに失敗しました: %v", err)
+	}
+	options, err := jsonOptions(req.Options)
+	if err != nil {
+		return badRequest("印刷オプションが正しくありません: %v", err)
+	}
+	sub.Printer = req.Printer
+	sub.Preset = req.Preset
+	sub.Password = req.Password
+	sub.Options = options
+
+	documents := req.Documents
+	if req.Document != "" || req.URL != "" {
+		documents = append([]jsonDocument{req.jsonDocument}, documents...)
+	}
+	if len(documents) == 0 {
+		return badRequest("JSONに'document'、'url'または'documents'がありません")
+	}
+	for i, doc := range documents {
+		if doc.Document == "" && doc.URL != "" {
+			if err := sub.download(doc.URL); err != nil {
+				return err
+			}
+			if doc.Filename != "" {
+				sub.Documents[len(sub.Documents)-1].Name = doc.Filename
+			}
+			continue
+		}
+		if doc.Document == "" {
+			return badRequest("documents[%d] に'document'または'url'がありません", i)
+		}
+		data := doc.Document
+		var contentType string
+		if strings.HasPrefix(data, "data:") {
+			if i := strings.Index(data, ","); i >= 0 {
+				// データURLのメディアタイプ ("data:application/zip;base64,") を Content-Type として扱います。
+				contentType = strings.TrimSuffix(data[len("data:"):i], ";base64")
+				data = data[i+1:]
+			}
+		}
+		document, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(data), ""))
+		if err != nil {
+			return badRequest("'document' のBase64のデコードに失敗しました: %v", err)
+		}
+		if err := sub.addDocument(doc.Filename, contentType, bytes.NewReader(document)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// headerOptions はヘッダー (例: X-Print-Copies, X-Print-Auto-Rotate) から印刷オプションを取り出します。
+func headerOptions(h http.Header) map[string]string {
+	options := make(map[string]string)
+	for _, key := range printOptionKeys {
+		if v := strings.TrimSpace(h.Get("X-Print-" + strings.ReplaceAll(key, "_", "-"))); v != "" {
+			options[key] = v
+		}
+	}
+	return options
+}
+
+// firstNonEmpty は最初の空でない文字列を返します。
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// spoolDirectory は受け付けたドキュメントを保存するディレクトリです。テストでは一時ディレクトリに置き換えます。
+var spoolDirectory = "c:\\pdf"
+
+// spoolDocument はドキュメントをスプールディレクトリに保存し、そのパスを返します。
+// ファイル名が指定されなかった場合はランダムな名前を付けます。
+func spoolDocument(name string, src io.Reader) (string, error) {
+	// 一時ファイルを作成し、アップロードされたPDFを書き込みます。
+	// tempDir := os.TempDir() // システムの一時ディレクトリを使用
+	//root ディレクトリ(c:\)に一時ファイルを作成します。
+	if err := os.MkdirAll(spoolDirectory, 0755); err != nil { // ディレクトリが存在しない場合は作成します。
+		return "", fmt.Errorf("一時ディレクトリの取得に失敗しました: %w", err)
+	}
+	// クライアントが指定したファイル名にディレクトリが含まれていても、スプールディレクトリの外には保存しません。
+	name = filepath.Base(strings.ReplaceAll(name, "\\", "/"))
+	if name == "" || name == "." || name == "/" {
+		name = newJobID() + ".pdf"
+	}
+	// 同じ名前のファイルが処理待ちのジョブで使われている可能性があるため、上書きせずに別の名前で保存します。
+	tempFilePath := filepath.Join(spoolDirectory, name)
+	tempFile, err := os.OpenFile(tempFilePath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if os.IsExist(err) {
+		tempFilePath = filepath.Join(spoolDirectory, newJobID()+"_"+name)
+		tempFile, err = os.OpenFile(tempFilePath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	}
+	if err != nil {
+		return "", fmt.Errorf("一時ファイルの作成に失敗しました: %w", err)
+	}
+	log.Printf("アップロードされたファイルを一時パスに保存しています: %s\n", tempFilePath)             // ログ出力
+	fmt.Printf("Saving uploaded file to temporary path: %s\n", tempFilePath) // デバッグ用ログ
+
+	_, err = io.Copy(tempFile, src)
+	// io.Copy の後にファイルを明示的に閉じる必要があります。
+	// これにより、印刷に使用するプログラムがファイルにアクセスできるようになります。
+	tempFile.Close()
+
+	if err != nil {
+		os.Remove(tempFilePath)
+		return "", fmt.Errorf("アップロードされたファイルの保存に失敗しました: %w", err)
+	}
+	log.Printf("一時ファイルに正常に保存しました: %s", tempFilePath) // ログ出力
+	return tempFilePath, nil
+}
+
+// preparedJob はジョブを開始する前に検証したドキュメント1つ分の印刷内容です。
+type preparedJob struct {
+	Document   submittedDocument
+	Info       documentInfo
+	Options    printOptions
+	Candidates []printTarget
+}
+
+// preparePrintJob はドキュメントのページ数を取得し、印刷オプションとプリンターの機能を検証します。
+// オプションは 論理プリンターのデフォルト < プリセット < リクエスト の順に優先します。
+func preparePrintJob(printerName string, presetOptions, reqOptions map[string]string, doc submittedDocument) (preparedJob, error) {
+	// プリンター名 (論理プリンター名やプールを含む) を印刷先の候補に解決します。
+	candidates := resolveCandidates(appConfig, printerName)
+
+	// ドキュメントのページ数とページの大きさを取得し、リクエストの印刷オプション (部数、ページ範囲、部単位) を検証します。
+	info, err := readDocumentInfo(doc.Path)
+	if err != nil {
+		return preparedJob{}, &submissionError{Status: http.StatusUnprocessableEntity, Err: fmt.Errorf("PDFのページ数を取得できませんでした: %w", err)}
+	}
+	// 復号したドキュメントも、元のPDFが暗号化されていたことを返します。
+	info.Encrypted = info.Encrypted || doc.Encrypted
+	var options printOptions
+	for i := range candidates {
+		candidates[i].Options = mergeOptions(mergeOptions(candidates[i].Options, presetOptions), reqOptions)
+		// media=auto はドキュメントのページの大きさの用紙に置き換え、プリンターのドライバーがその用紙のトレイを選べるようにします。
+		// スプーラーは任意サイズの用紙をジョブごとに指定できないため、その場合はプリンターの既定の用紙を使用します。
+		if strings.EqualFold(candidates[i].Options["media"], mediaAuto) {
+			media := info.autoMedia()
+			_, named := spoolerPaper(media)
+			switch {
+			case media == "":
+				delete(candidates[i].Options, "media")
+				log.Printf("ドキュメント '%s' は大きさの異なるページを含むため、media=auto ではプリンターの既定の用紙を使用します。", doc.Name)
+			case candidates[i].Backend == "spooler" && !named:
+				delete(candidates[i].Options, "media")
+				log.Printf("ドキュメント '%s' の用紙 '%s' はスプーラーで指定できないため、media=auto ではプリンターの既定の用紙を使用します。", doc.Name, media)
+			default:
+				candidates[i].Options["media"] = media
+			}
+		}
+		if options, err = parsePrintOptions(candidates[i].Options, info.PageCount); err != nil {
+			return preparedJob{}, badRequest("印刷オプションが正しくありません: %v", err)
+		}
+		if _, _, err := parseStamp(appConfig, candidates[i].Options); err != nil {
+			return preparedJob{}, badRequest("印刷オプションが正しくありません: %v", err)
+		}
+		im, imposed, err := parseImposition(candidates[i].Options)
+		if err != nil {
+			return preparedJob{}, badRequest("印刷オプションが正しくありません: %v", err)
+		}
+		// バーコードは印刷する直前にPDFへ重ねるため、失敗するものは受け付ける時点で拒否します。
+		if b, ok, err := parseBarcode(candidates[i].Options); err != nil {
+			return preparedJob{}, badRequest("印刷オプションが正しくありません: %v", err)
+		} else if ok {
+			// 面付けした場合は、面付けした後のページにバーコードを重ねます。
+			pageCount := info.PageCount
+			if imposed {
+				pageCount = im.sheetCount(selectedPageCount(options, info.PageCount))
+			}
+			if err := b.checkPages(pageCount); err != nil {
+				return preparedJob{}, badRequest("印刷オプションが正しくありません: %v", err)
+			}
+			// ジョブIDは受け付けた後に決まるため、同じ形式の値で確認します。
+			values := stampValues{JobID: strings.Repeat("0", 16), Printer: printerName, Document: doc.Name, User: candidates[i].Options["user"], Time: time.Now()}
+			if _, err := b.encode(expandJobPlaceholders(b.Content, values)); err != nil {
+				return preparedJob{}, &submissionError{Status: http.StatusUnprocessableEntity, Err: err}
+			}
+		}
+		if a, _, err := parsePageAdjustment(candidates[i].Options); err != nil {
+			return preparedJob{}, badRequest("印刷オプションが正しくありません: %v", err)
+		} else if err := a.checkPages(info.PageCount); err != nil {
+			return preparedJob{}, badRequest("印刷オプションが正しくありません: %v", err)
+		}
+		// "10-" のような終わりのないページ範囲は、ページ数が分かっているここで解決しておきます。
+		if options.Pages != "" {
+			candidates[i].Options["pages"] = options.Pages
+		}
+	}
+
+	// 印刷オプションがプリンターの機能の範囲内かを、ジョブを開始する前に確認します。
+	candidates, err = filterCapableCandidates(appConfig, candidates)
+	if err != nil {
+		return preparedJob{}, &submissionError{Status: http.StatusUnprocessableEntity, Err: fmt.Errorf("印刷オプションがプリンターの機能に対応していません: %w", err)}
+	}
+	return preparedJob{Document: doc, Info: info, Options: options, Candidates: candidates}, nil
+}
@@ -0,0 +1,437 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding/japanese"
+)
+
+// textExtensions はテキストとしてPDFに変換するドキュメントの拡張子と、その種類 (text, csv, tsv) です。
+var textExtensions = map[string]string{
+	".txt":  "text",
+	".text": "text",
+	".log":  "text",
+	".prn":  "text",
+	".lst":  "text",
+	".csv":  "csv",
+	".tsv":  "tsv",
+}
+
+// textFormat はドキュメントの拡張子からテキストの種類 (text, csv, tsv) を返します。対象でない場合は空文字列を返します。
+// 拡張子がテキストでも、中身がPDFの場合はPDFとして扱います。
+func textFormat(name, filePath string) string {
+	format := textExtensions[strings.ToLower(filepath.Ext(name))]
+	if format == "" || isPDFFile(filePath) {
+		return ""
+	}
+	return format
+}
+
+// isPDFFile はファイルの先頭がPDFのヘッダー (%PDF-) かどうかを返します。
+func isPDFFile(filePath string) bool {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	head := make([]byte, 5)
+	n, _ := io.ReadFull(f, head)
+	return bytes.Equal(head[:n], []byte("%PDF-"))
+}
+
+// textLayout はテキストとCSVをPDFに変換するときの設定です。
+// 印刷オプションと同じく、リクエスト、プリセット、論理プリンターの options で指定します。
+type textLayout struct {
+	pageLayout
+	FontSize   float64 // font_size: 文字の大きさ (ポイント、省略時は10)
+	Wrap       bool    // wrap: 用紙の幅を超える行を折り返すかどうか (false の場合は切り詰めます)
+	PageHeader bool    // page_header: 各ページの上部にファイル名とページ番号を印刷するかどうか
+	CSVHeader  bool    // csv_header: CSVの1行目を見出しとして各ページに繰り返すかどうか
+	Encoding   string  // encoding: auto (省略時), utf-8, shift_jis, euc-jp
+}
+
+// parseTextLayout は用紙と余白、font_size, wrap, page_header, csv_header, encoding のオプションを解析します。
+func parseTextLayout(options map[string]string) (textLayout, error) {
+	page, err := parsePageLayout(options)
+	if err != nil {
+		return textLayout{}, err
+	}
+	l := textLayout{pageLayout: page, FontSize: 10, Wrap: true, PageHeader: true, CSVHeader: true, Encoding: "auto"}
+	if v, ok := options["font_size"]; ok {
+		size, err := strconv.ParseFloat(v, 64)
+		if err != nil || size < 4 || size > 72 {
+			return l, fmt.Errorf("font_size '%s' は4から72までの数値 (ポイント) で指定してください", v)
+		}
+		l.FontSize = size
+	}
+	for key, dst := range map[string]*bool{"wrap": &l.Wrap, "page_header": &l.PageHeader, "csv_header": &l.CSVHeader} {
+		if v, ok := options[key]; ok {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return l, fmt.Errorf("%s '%s' は true または false で指定してください", key, v)
+			}
+			*dst = b
+		}
+	}
+	if v, ok := options["encoding"]; ok {
+		switch strings.ToLower(strings.ReplaceAll(v, "-", "_")) {
+		case "auto":
+			l.Encoding = "auto"
+		case "utf_8", "utf8":
+			l.Encoding = "utf-8"
+		case "shift_jis", "sjis", "cp932", "windows_31j":
+			l.Encoding = "shift_jis"
+		case "euc_jp", "eucjp":
+			l.Encoding = "euc-jp"
+		default:
+			return l, fmt.Errorf("encoding '%s' は auto, utf-8, shift_jis, euc-jp のいずれかで指定してください", v)
+		}
+	}
+	return l, nil
+}
+
+// convertTextDocument はテキストまたはCSVのドキュメントをPDFに変換し、変換後のドキュメントを返します。
+func convertTextDocument(doc submittedDocument, format string, options map[string]string) (submittedDocument, error) {
+	layout, err := parseTextLayout(options)
+	if err != nil {
+		return doc, badRequest("印刷オプションが正しくありません: %v", err)
+	}
+	data, err := os.ReadFile(doc.Path)
+	if err != nil {
+		return doc, fmt.Errorf("ドキュメントを読み込めませんでした: %w", err)
+	}
+	text, err := decodeText(data, layout.Encoding)
+	if err != nil {
+		return doc, &submissionError{Status: http.StatusUnprocessableEntity, Err: fmt.Errorf("'%s' の文字コードを変換できませんでした: %w", doc.Name, err)}
+	}
+
+	p, err := newTextPDF()
+	if err != nil {
+		return doc, err
+	}
+	if format == "text" {
+		renderPlainText(p, text, layout, doc.Name)
+	} else {
+		comma := ','
+		if format == "tsv" {
+			comma = '\t'
+		}
+		if err := renderCSV(p, text, comma, layout, doc.Name); err != nil {
+			return doc, &submissionError{Status: http.StatusUnprocessableEntity, Err: fmt.Errorf("'%s' をCSVとして読み込めませんでした: %w", doc.Name, err)}
+		}
+	}
+	dst := doc.Path + ".pdf"
+	if err := p.writeFile(dst); err != nil {
+		return doc, &submissionError{Status: http.StatusUnprocessableEntity, Err: fmt.Errorf("'%s' をPDFに変換できませんでした: %w", doc.Name, err)}
+	}
+	os.Remove(doc.Path)
+	log.Printf("テキスト '%s' (%s) をPDFに変換しました: %s (%dページ)", doc.Name, format, dst, len(p.pages))
+	return submittedDocument{Name: doc.Name, Path: dst}, nil
+}
+
+// decodeText はテキストを文字コードに応じてUTF-8に変換します。
+// auto の場合、UTF-8として正しくないテキストはShift_JIS (Windowsの日本語の既定) として扱います。
+func decodeText(data []byte, encoding string) (string, error) {
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+	switch encoding {
+	case "shift_jis":
+		b, err := japanese.ShiftJIS.NewDecoder().Bytes(data)
+		return string(b), err
+	case "euc-jp":
+		b, err := japanese.EUCJP.NewDecoder().Bytes(data)
+		return string(b), err
+	case "auto":
+		if !utf8.Valid(data) {
+			b, err := japanese.ShiftJIS.NewDecoder().Bytes(data)
+			return string(b), err
+		}
+	}
+	return string(data), nil
+}
+
+// expandTabs はタブを8桁ごとの位置まで空白に置き換えます。
+func expandTabs(s string) string {
+	if !strings.Contains(s, "\t") {
+		return s
+	}
+	var b strings.Builder
+	col := 0
+	for _, r := range s {
+		if r == '\t' {
+			n := 8 - col%8
+			b.WriteString(strings.Repeat(" ", n))
+			col += n
+			continue
+		}
+		b.WriteRune(r)
+		col++
+	}
+	return b.String()
+}
+
+// bodyArea はページヘッダーを除いた本文の領域の上端と下端のY座標を返します。
+func (l textLayout) bodyArea(p *textPDF) (top, bottom float64) {
+	margin := l.Margin * pointsPerMM
+	top = p.Height - margin
+	if l.PageHeader {
+		top -= l.headerSize() * 2
+	}
+	return top, margin
+}
+
+// headerSize はページヘッダーの文字の大きさです。
+func (l textLayout) headerSize() float64 {
+	if l.FontSize < 9 {
+		return l.FontSize
+	}
+	return 9
+}
+
+// drawPageHeader は描画中のページの上部に、ファイル名とページ番号 (ページ/総ページ数) を印刷します。
+func (l textLayout) drawPageHeader(p *textPDF, title string, pageNr, total int) {
+	if !l.PageHeader {
+		return
+	}
+	margin := l.Margin * pointsPerMM
+	size := l.headerSize()
+	y := p.Height - margin - size
+	number := fmt.Sprintf("%d / %d", pageNr, total)
+	numberWidth := p.textWidth(number, size)
+	p.text(margin, y, size, p.truncateText(title, size, p.Width-2*margin-numberWidth-size*2))
+	p.text(p.Width-margin-numberWidth, y, size, number)
+	p.line(margin, y-size*0.5, p.Width-margin, y-size*0.5, 0.5)
+}
+
+// renderPlainText はテキストを等幅で1行ずつ印刷します。改ページ (\f) の位置では新しいページを始めます。
+func renderPlainText(p *textPDF, text string, l textLayout, title string) {
+	p.Width, p.Height = l.pageSize(false)
+	margin := l.Margin * pointsPerMM
+	width := p.Width - 2*margin
+	top, bottom := l.bodyArea(p)
+	lineHeight := l.FontSize * lineSpacing
+	perPage := int((top - bottom) / lineHeight)
+	if perPage < 1 {
+		perPage = 1
+	}
+
+	// 先にページごとの行を決めてから、総ページ数を付けて描画します。
+	var pages [][]string
+	var current []string
+	for i, chunk := range strings.Split(strings.TrimRight(text, "\r\n"), "\f") {
+		if i > 0 && len(current) > 0 {
+			pages, current = append(pages, current), nil
+		}
+		for _, line := range strings.Split(strings.TrimPrefix(chunk, "\n"), "\n") {
+			line = expandTabs(strings.TrimRight(line, "\r"))
+			wrapped := []string{p.truncateText(line, l.FontSize, width)}
+			if l.Wrap {
+				wrapped = p.wrapText(line, l.FontSize, width)
+			}
+			for _, w := range wrapped {
+				if len(current) == perPage {
+					pages, current = append(pages, current), nil
+				}
+				current = append(current, w)
+			}
+		}
+	}
+	if len(current) > 0 || len(pages) == 0 {
+		pages = append(pages, current)
+	}
+
+	for i, lines := range pages {
+		p.newPage()
+		l.drawPageHeader(p, title, i+1, len(pages))
+		y := top - l.FontSize
+		for _, line := range lines {
+			p.text(margin, y, l.FontSize, line)
+			y -= lineHeight
+		}
+	}
+}
+
+// csvRow は折り返し済みのCSVの1行です。
+type csvRow struct {
+	cells  [][]string // 列ごとの折り返した行
+	height float64
+}
+
+// renderCSV はCSVを罫線付きの表として印刷します。用紙の幅に収まらない場合は列の幅を縮めてセル内で折り返し、
+// csv_header が有効な場合は1行目を見出しとして各ページの先頭に繰り返します。
+func renderCSV(p *textPDF, text string, comma rune, l textLayout, title string) error {
+	r := csv.NewReader(strings.NewReader(text))
+	r.Comma = comma
+	r.FieldsPerRecord = -1
+	r.LazyQuotes = true
+	records, err := r.ReadAll()
+	if err != nil {
+		return err
+	}
+
+	// 向きが指定されていない場合は、縦向きに収まらない表を横向きで印刷します。
+	size := l.FontSize
+	pad := size * 0.3
+	widths := p.tableColumnWidths(records, size, pad)
+	total := 0.0
+	for _, w := range widths {
+		total += w
+	}
+	columns := len(widths)
+	margin := l.Margin * pointsPerMM
+	p.Width, p.Height = l.pageSize(false)
+	if total > p.Width-2*margin {
+		p.Width, p.Height = l.pageSize(true)
+	}
+	fitColumnWidths(widths, p.Width-2*margin)
+
+	top, bottom := l.bodyArea(p)
+	lineHeight := size * lineSpacing
+	layoutRow := func(rec []string) csvRow {
+		row := csvRow{cells: make([][]string, columns)}
+		lines := 1
+		for i := range row.cells {
+			cell := ""
+			if i < len(rec) {
+				cell = strings.ReplaceAll(rec[i], "\r", "")
+			}
+			var wrapped []string
+			for _, s := range strings.Split(cell, "\n") {
+				if l.Wrap {
+					wrapped = append(wrapped, p.wrapText(s, size, widths[i]-2*pad)...)
+				} else {
+					wrapped = append(wrapped, p.truncateText(s, size, widths[i]-2*pad))
+				}
+			}
+			row.cells[i] = wrapped
+			if len(wrapped) > lines {
+				lines = len(wrapped)
+			}
+		}
+		// 1ページに収まらない行は、収まる行数で切り詰めます。
+		if max := int((top - bottom - 2*pad) / lineHeight); lines > max && max > 0 {
+			lines = max
+			for i, c := range row.cells {
+				if len(c) > lines {
+					row.cells[i] = c[:lines]
+				}
+			}
+		}
+		row.height = float64(lines)*lineHeight + 2*pad
+		return row
+	}
+
+	var header *csvRow
+	if l.CSVHeader && len(records) > 1 {
+		h := layoutRow(records[0])
+		header = &h
+		records = records[1:]
+	}
+	var pages [][]csvRow
+	var current []csvRow
+	y := top
+	if header != nil {
+		y -= header.height
+	}
+	for _, rec := range records {
+		row := layoutRow(rec)
+		if y-row.height < bottom && len(current) > 0 {
+			pages, current = append(pages, current), nil
+			y = top
+			if header != nil {
+				y -= header.height
+			}
+		}
+		current = append(current, row)
+		y -= row.height
+	}
+	if len(current) > 0 || len(pages) == 0 {
+		pages = append(pages, current)
+	}
+
+	drawRow := func(row csvRow, y float64, fill float64) {
+		x := margin
+		for i, lines := range row.cells {
+			p.rect(x, y-row.height, widths[i], row.height, 0.5, fill)
+			for j, s := range lines {
+				tx := x + pad
+				if isNumeric(s) {
+					tx = x + widths[i] - pad - p.textWidth(s, size)
+				}
+				p.text(tx, y-pad-size-float64(j)*lineHeight, size, s)
+			}
+			x += widths[i]
+		}
+	}
+	for i, rows := range pages {
+		p.newPage()
+		l.drawPageHeader(p, title, i+1, len(pages))
+		y := top
+		if header != nil {
+			drawRow(*header, y, 0.9)
+			y -= header.height
+		}
+		for _, row := range rows {
+			drawRow(row, y, -1)
+			y -= row.height
+		}
+	}
+	return nil
+}
+
+// tableColumnWidths は表の列ごとに、セルの内容の最大の幅 (左右の余白 pad を含む) を返します。
+func (p *textPDF) tableColumnWidths(rows [][]string, size, pad float64) []float64 {
+	columns := 0
+	for _, row := range rows {
+		if len(row) > columns {
+			columns = len(row)
+		}
+	}
+	widths := make([]float64, columns)
+	for i := range widths {
+		widths[i] = size + 2*pad
+		for _, row := range rows {
+			if i >= len(row) {
+				continue
+			}
+			for _, s := range strings.Split(row[i], "\n") {
+				if w := p.textWidth(s, size) + 2*pad; w > widths[i] {
+					widths[i] = w
+				}
+			}
+		}
+	}
+	return widths
+}
+
+// fitColumnWidths は列の幅の合計が avail を超える場合に、比率を保って縮めます。
+func fitColumnWidths(widths []float64, avail float64) {
+	total := 0.0
+	for _, w := range widths {
+		total += w
+	}
+	if total > avail {
+		for i := range widths {
+			widths[i] *= avail / total
+		}
+	}
+}
+
+// isNumeric は s が数値 (桁区切りのカンマや符号、%を含む) かどうかを返します。数値のセルは右寄せで印刷します。
+func isNumeric(s string) bool {
+	s = strings.TrimSuffix(strings.ReplaceAll(strings.TrimSpace(s), ",", ""), "%")
+	if s == "" {
+		return false
+	}
+	_, err := strconv.ParseFloat(s, 64)
+	return err == nil
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	"github.com/pdfcpu/pdfcpu/pkg/api"
+	"github.com/pdfcpu/pdfcpu/pkg/font"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu"
+	pdffont "github.com/pdfcpu/pdfcpu/pkg/pdfcpu/font"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/model"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/types"
+)
+
+// lineSpacing はフォントサイズに対する行の高さの比率です。
+const lineSpacing = 1.3
+
+// textPDF は文字、罫線、画像で構成されるPDFを1ページずつ組み立てます。テキスト、CSV、Markdownの変換に使用します。
+// 座標はPDFと同じく用紙の左下を原点とするポイント単位です。
+type textPDF struct {
+	ctx     *model.Context
+	font    string
+	Width   float64
+	Height  float64
+	pages   []*bytes.Buffer
+	current int                          // 描画中のページ (pages の添字)
+	images  map[string]types.IndirectRef // 画像の XObject (リソース名から)
+}
+
+// textStyle は文字の描画方法です。
+// 埋め込むフォントは1種類のため、太字は輪郭を重ねて描画し、斜体は文字を傾けて表現します。
+type textStyle struct {
+	Size   float64
+	Bold   bool
+	Italic bool
+	Color  rgbColor
+}
+
+// rgbColor は0から1の範囲のRGBの色です。
+type rgbColor struct{ R, G, B float64 }
+
+// newTextPDF は新しいPDFを作成します。ページを追加する前に Width と Height (ポイント) に用紙の大きさを設定してください。
+func newTextPDF() (*textPDF, error) {
+	conf := pdfConfig()
+	conf.Cmd = model.CREATE
+	ctx, err := pdfcpu.CreateContextWithXRefTable(conf, types.PaperSize["A4"])
+	if err != nil {
+		return nil, err
+	}
+	return &textPDF{ctx: ctx, font: documentFont(), images: map[string]types.IndirectRef{}}, nil
+}
+
+// newPage は新しいページを追加します。以降の描画はこのページに行います。
+func (p *textPDF) newPage() {
+	p.pages = append(p.pages, &bytes.Buffer{})
+	p.current = len(p.pages) - 1
+}
+
+// selectPage は描画するページを pageNr (1から) に切り替えます。総ページ数が決まった後のページ番号の描画に使用します。
+func (p *textPDF) selectPage(pageNr int) {
+	p.current = pageNr - 1
+}
+
+// page は描画中のページの内容を返します。
+func (p *textPDF) page() *bytes.Buffer {
+	if len(p.pages) == 0 {
+		p.newPage()
+	}
+	return p.pages[p.current]
+}
+
+// textWidth はフォントサイズ size で s を描画したときの幅を返します。
+func (p *textPDF) textWidth(s string, size float64) float64 {
+	w := 0
+	for _, r := range s {
+		w += font.CharWidth(p.font, r)
+	}
+	return float64(w) * size / 1000
+}
+
+// text は (x, y) をベースラインの左端として s を描画します。
+func (p *textPDF) text(x, y, size float64, s string) {
+	fmt.Fprintf(p.page(), "BT /F0 %.2f Tf %.2f %.2f Td (%s) Tj ET\n", size, x, y, model.PrepBytes(p.ctx.XRefTable, s, p.font, true, false, false))
+}
+
+// styledText は (x, y) をベースラインの左端として、st の大きさ、色、太字、斜体で s を描画します。
+func (p *textPDF) styledText(x, y float64, st textStyle, s string) {
+	w := p.page()
+	fmt.Fprintf(w, "q %.3f %.3f %.3f rg %.3f %.3f %.3f RG BT /F0 %.2f Tf ", st.Color.R, st.Color.G, st.Color.B, st.Color.R, st.Color.G, st.Color.B, st.Size)
+	if st.Bold {
+		fmt.Fprintf(w, "2 Tr %.2f w ", st.Size*0.04)
+	}
+	skew := 0.0
+	if st.Italic {
+		skew = 0.2
+	}
+	fmt.Fprintf(w, "1 0 %.2f 1 %.2f %.2f Tm (%s) Tj ET Q\n", skew, x, y, model.PrepBytes(p.ctx.XRefTable, s, p.font, true, false, false))
+}
+
+// line は (x1, y1) から (x2, y2) まで太さ width の線を描画します。
+func (p *textPDF) line(x1, y1, x2, y2, width float64) {
+	fmt.Fprintf(p.page(), "%.2f w %.2f %.2f m %.2f %.2f l S\n", width, x1, y1, x2, y2)
+}
+
+// fillRect は左下 (x, y)、幅 w、高さ h の長方形を c で塗りつぶします。
+func (p *textPDF) fillRect(x, y, w, h float64, c rgbColor) {
+	fmt.Fprintf(p.page(), "q %.3f %.3f %.3f rg %.2f %.2f %.2f %.2f re f Q\n", c.R, c.G, c.B, x, y, w, h)
+}
+
+// addImage は画像を XObject として追加し、リソース名と大きさ (ピクセル) を返します。
+// 複数のフレームを持つ画像 (TIFF) は最初のフレームだけを使用します。
+func (p *textPDF) addImage(r io.Reader) (name string, width, height int, err error) {
+	images, err := model.CreateImageResources(p.ctx.XRefTable, r, false, false)
+	if err != nil {
+		return "", 0, 0, err
+	}
+	if len(images) == 0 {
+		return "", 0, 0, fmt.Errorf("画像がありません")
+	}
+	name = fmt.Sprintf("Im%d", len(p.images))
+	p.images[name] = *images[0].Res.IndRef
+	return name, images[0].Width, images[0].Height, nil
+}
+
+// image は addImage で追加した画像を、左下 (x, y)、幅 w、高さ h で描画します。
+func (p *textPDF) image(name string, x, y, w, h float64) {
+	fmt.Fprintf(p.page(), "q %.2f 0 0 %.2f %.2f %.2f cm /%s Do Q\n", w, h, x, y, name)
+}
+
+// rect は左下 (x, y)、幅 w、高さ h の長方形を描画します。gray が0以上の場合はその濃さ (0が黒、1が白) で塗りつぶします。
+func (p *textPDF) rect(x, y, w, h, lineWidth, gray float64) {
+	if gray >= 0 {
+		fmt.Fprintf(p.page(), "q %.2f g %.2f %.2f %.2f %.2f re f Q\n", gray, x, y, w, h)
+	}
+	if lineWidth > 0 {
+		fmt.Fprintf(p.page(), "%.2f w %.2f %.2f %.2f %.2f re S\n", lineWidth, x, y, w, h)
+	}
+}
+
+// wrapText は s を幅 width に収まるように行に分割します。
+// 日本語のように空白で区切られない文字列もあるため、文字単位で折り返します。
+func (p *textPDF) wrapText(s string, size, width float64) []string {
+	var lines []string
+	var line []rune
+	w := 0.0
+	for _, r := range s {
+		cw := float64(font.CharWidth(p.font, r)) * size / 1000
+		if w+cw > width && len(line) > 0 {
+			lines = append(lines, string(line))
+			line, w = nil, 0
+		}
+		line = append(line, r)
+		w += cw
+	}
+	return append(lines, string(line))
+}
+
+// truncateText は s を幅 width に収まるように末尾を切り詰めます。
+func (p *textPDF) truncateText(s string, size, width float64) string {
+	return p.wrapText(s, size, width)[0]
+}
+
+// writeFile は組み立てたページでPDFを作成して dst に保存します。フォントは使用した文字だけを埋め込みます。
+func (p *textPDF) writeFile(dst string) error {
+	if len(p.pages) == 0 {
+		p.newPage()
+	}
+	// 使用した文字が確定してからフォントを作成します。
+	fontRef, err := pdffont.EnsureFontDict(p.ctx.XRefTable, p.font, "", "", false, nil)
+	if err != nil {
+		return fmt.Errorf("フォントの埋め込みに失敗しました: %w", err)
+	}
+	resources := types.Dict(map[string]types.Object{
+		"Font": types.Dict(map[string]types.Object{"F0": *fontRef}),
+	})
+	if len(p.images) > 0 {
+		xobjects := types.Dict{}
+		for name, ref := range p.images {
+			xobjects[name] = ref
+		}
+		resources["XObject"] = xobjects
+	}
+
+	pagesIndRef, err := p.ctx.Pages()
+	if err != nil {
+		return err
+	}
+	pagesDict, err := p.ctx.DereferenceDict(*pagesIndRef)
+	if err != nil {
+		return err
+	}
+	for _, content := range p.pages {
+		sd, err := p.ctx.NewStreamDictForBuf(content.Bytes())
+		if err != nil {
+			return err
+		}
+		if err := sd.Encode(); err != nil {
+			return err
+		}
+		contents, err := p.ctx.IndRefForNewObject(*sd)
+		if err != nil {
+			return err
+		}
+		page := types.Dict(map[string]types.Object{
+			"Type":      types.Name("Page"),
+			"Parent":    *pagesIndRef,
+			"MediaBox":  types.RectForDim(p.Width, p.Height).Array(),
+			"Resources": resources,
+			"Contents":  *contents,
+		})
+		indRef, err := p.ctx.IndRefForNewObject(page)
+		if err != nil {
+			return err
+		}
+		if err := p.ctx.SetValid(*indRef); err != nil {
+			return err
+		}
+		if err := model.AppendPageTree(indRef, 1, pagesDict); err != nil {
+			return err
+		}
+		p.ctx.PageCount++
+	}
+
+	if err := api.WriteContextFile(p.ctx, dst); err != nil {
+		return fmt.Errorf("変換したPDFの保存に失敗しました: %w", err)
+	}
+	return nil
+}
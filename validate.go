@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/pdfcpu/pdfcpu/pkg/api"
+)
+
+// 印刷ツールは壊れたPDFを渡されてもエラーを返さずに終了することがあるため、
+// 変換後のドキュメントがPDFとして読み込めることをジョブを開始する前に確認します。
+
+// pdfHeaderSearchSize と pdfTrailerSearchSize は、PDFのヘッダー (%PDF-) とファイルの終わり (%%EOF) を探す範囲 (バイト) です。
+// 仕様ではヘッダーは先頭に置きますが、多くのPDFリーダーと同じく先頭1024バイト以内であれば受け付けます。
+const (
+	pdfHeaderSearchSize  = 1024
+	pdfTrailerSearchSize = 1024
+)
+
+// documentSignatures はPDFではないドキュメントの種類をエラーメッセージで伝えるための、ファイルの先頭のシグネチャです。
+var documentSignatures = []struct {
+	magic       []byte
+	description string
+}{
+	{[]byte("PK\x03\x04"), "ZIPアーカイブ (Word、Excel、PowerPointの文書を含む)"},
+	{[]byte("\xD0\xCF\x11\xE0\xA1\xB1\x1A\xE1"), "Microsoft Office 97-2003 の文書"},
+	{[]byte("{\\rtf"), "RTF文書"},
+	{[]byte("%!PS"), "PostScript"},
+	{[]byte("\x1b%-12345X"), "PCL/PJLの印刷データ"},
+	{[]byte("\x1bE"), "PCLの印刷データ"},
+	{[]byte("BM"), "BMP画像"},
+	{[]byte("RIFF"), "WebP画像などのRIFFファイル"},
+	{[]byte("\x1f\x8b"), "gzipで圧縮されたファイル"},
+	{[]byte("Rar!"), "RARアーカイブ"},
+	{[]byte("7z\xBC\xAF\x27\x1C"), "7-Zipアーカイブ"},
+	{[]byte("MZ"), "実行ファイル"},
+	{[]byte("<?xml"), "XML"},
+	{[]byte("<!DOCTYPE"), "HTML"},
+	{[]byte("<html"), "HTML"},
+}
+
+// describeDocument はPDFではないドキュメントの先頭の内容から、その種類の説明を返します。
+func describeDocument(head []byte) string {
+	if len(head) == 0 {
+		return "空のファイル"
+	}
+	for _, s := range documentSignatures {
+		if bytes.HasPrefix(head, s.magic) {
+			return s.description
+		}
+	}
+	if bytes.IndexByte(head, 0) < 0 {
+		return "テキスト"
+	}
+	return "不明な形式"
+}
+
+// validateDocument はドキュメントがPDFとして印刷できるかを検証します。
+// PDFではない場合は 415 Unsupported Media Type、PDFのヘッダーはあるが壊れている場合や途中で切れている場合は
+// 422 Unprocessable Entity のエラーを返します。
+func validateDocument(doc submittedDocument) error {
+	f, err := os.Open(doc.Path)
+	if err != nil {
+		return fmt.Errorf("ドキュメントを開けませんでした: %w", err)
+	}
+	defer f.Close()
+
+	// ヘッダー: 先頭に %PDF- がなければPDFではありません。
+	head := make([]byte, pdfHeaderSearchSize)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return fmt.Errorf("ドキュメントを読み込めませんでした: %w", err)
+	}
+	head = head[:n]
+	if !bytes.Contains(head, []byte("%PDF-")) {
+		return &submissionError{
+			Status: http.StatusUnsupportedMediaType,
+			Err:    fmt.Errorf("'%s' はPDFではありません (%s)。PDF、画像、テキスト、CSV、Markdown、HTMLを送信してください", doc.Name, describeDocument(head)),
+		}
+	}
+
+	// ファイルの終わり: 末尾に %%EOF がなければ、アップロードやダウンロードが途中で切れています。
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("ドキュメントを読み込めませんでした: %w", err)
+	}
+	tailSize := min(info.Size(), pdfTrailerSearchSize)
+	tail := make([]byte, tailSize)
+	if _, err := f.ReadAt(tail, info.Size()-tailSize); err != nil {
+		return fmt.Errorf("ドキュメントを読み込めませんでした: %w", err)
+	}
+	if !bytes.Contains(tail, []byte("%%EOF")) {
+		return invalidPDF(doc, "ファイルの終わり (%%%%EOF) がありません。ファイルが途中で切れている可能性があります")
+	}
+	if !bytes.Contains(tail, []byte("startxref")) {
+		return invalidPDF(doc, "トレーラーにクロスリファレンステーブルの位置 (startxref) がありません")
+	}
+
+	// クロスリファレンステーブル、トレーラー、ページツリー: pdfcpu で読み込み、すべてのページを辿れることを確認します。
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("ドキュメントを読み込めませんでした: %w", err)
+	}
+	ctx, err := api.ReadContext(f, pdfConfig())
+	if err != nil {
+		return invalidPDF(doc, "PDFの構造 (クロスリファレンステーブル、トレーラー) を解析できませんでした: %v", err)
+	}
+	if err := ctx.EnsurePageCount(); err != nil {
+		return invalidPDF(doc, "ページツリーを読み込めませんでした: %v", err)
+	}
+	if ctx.PageCount == 0 {
+		return invalidPDF(doc, "ページがありません")
+	}
+	for pageNr := 1; pageNr <= ctx.PageCount; pageNr++ {
+		d, _, _, err := ctx.PageDict(pageNr, false)
+		if err != nil {
+			return invalidPDF(doc, "ページツリーの %d ページ目を読み込めませんでした: %v", pageNr, err)
+		}
+		if d == nil {
+			return invalidPDF(doc, "ページツリーに %d ページ目がありません", pageNr)
+		}
+	}
+	log.Printf("ドキュメント '%s' をPDFとして検証しました (%dページ)", doc.Name, ctx.PageCount)
+	return nil
+}
+
+// invalidPDF は壊れたPDFとして 422 Unprocessable Entity で返すエラーを作成します。
+func invalidPDF(doc submittedDocument, format string, args ...interface{}) error {
+	return &submissionError{
+		Status: http.StatusUnprocessableEntity,
+		Err:    fmt.Errorf("'%s' はPDFとして読み込めません: %s", doc.Name, fmt.Sprintf(format, args...)),
+	}
+}